@@ -10,6 +10,7 @@ import (
 	"github.com/Focinfi/oncekv/config"
 	db "github.com/Focinfi/oncekv/db/master"
 	"github.com/Focinfi/oncekv/log"
+	"github.com/Focinfi/oncekv/namespace"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
@@ -32,6 +33,7 @@ type Admin struct {
 
 	CacheMaster *cache.Master
 	DBMaster    *db.Master
+	Namespaces  *namespace.Registry
 }
 
 // Start starts the admin server
@@ -44,8 +46,15 @@ func (a *Admin) newServer() *gin.Engine {
 	engine := gin.Default()
 	engine.GET("/caches", a.handleCaches)
 	engine.GET("/dbs", a.handleDBs)
+	engine.GET("/dbs/nodes", a.handleDBNodes)
+	engine.POST("/dbs/promote", a.handlePromote)
+	engine.POST("/dbs/demote", a.handleDemote)
 	engine.GET("/ws/caches", a.handleWebSocketCaches)
 	engine.GET("/ws/dbs", a.handleWebSocketDBs)
+	engine.GET("/namespaces", a.handleNamespaces)
+	engine.POST("/namespaces", a.handleCreateNamespace)
+	engine.POST("/purge", a.handlePurge)
+	engine.GET("/purges", a.handlePurges)
 	return engine
 }
 
@@ -69,6 +78,35 @@ func (a *Admin) handleDBs(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, peers)
 }
 
+func (a *Admin) handleNamespaces(ctx *gin.Context) {
+	namespaces, err := a.Namespaces.All()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, namespaces)
+}
+
+func (a *Admin) handleCreateNamespace(ctx *gin.Context) {
+	ns := &namespace.Namespace{}
+	if err := ctx.BindJSON(ns); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch err := a.Namespaces.Create(ns); err {
+	case nil:
+		ctx.JSON(http.StatusOK, ns)
+	case namespace.ErrInvalidName:
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case namespace.ErrExists:
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
 func (a *Admin) handleWebSocketCaches(ctx *gin.Context) {
 	conn, err := wsUpgrader.Upgrade(ctx.Writer, ctx.Request, nil)
 	if err != nil {
@@ -149,6 +187,7 @@ func init() {
 	adm := &Admin{
 		CacheMaster: cache.Default,
 		DBMaster:    db.Default,
+		Namespaces:  namespace.Default,
 		addr:        defaultAddr,
 	}
 
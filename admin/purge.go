@@ -0,0 +1,154 @@
+package admin
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Focinfi/oncekv/config"
+	"github.com/Focinfi/oncekv/log"
+	"github.com/Focinfi/oncekv/utils/urlutil"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// codeNotLeader is the code of a database refusing a write as a follower
+	codeNotLeader = 1005
+
+	bearerPrefix = "Bearer "
+	dbTimeout    = 10 * time.Second
+)
+
+var (
+	adminToken = config.Config.AdminToken
+	dbClient   = &http.Client{Timeout: dbTimeout}
+
+	errNoLeader = errors.New("no database took the purge")
+)
+
+// purgeResp for the response of a database to a purge
+type purgeResp struct {
+	Code    int             `json:"Code"`
+	Message string          `json:"Message"`
+	Purge   json.RawMessage `json:"purge,omitempty"`
+}
+
+// authorized reports whether the request carries the admin token, in the
+// token query or as the bearer token of the Authorization header.
+func authorized(ctx *gin.Context) bool {
+	token := ctx.Query("token")
+	if auth := ctx.GetHeader("Authorization"); strings.HasPrefix(auth, bearerPrefix) {
+		token = strings.TrimPrefix(auth, bearerPrefix)
+	}
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// handlePurge purges a key on the database leader, then starts a new purge
+// epoch, so the caches stop serving the values they hold.
+func (a *Admin) handlePurge(ctx *gin.Context) {
+	if !authorized(ctx) {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	body, err := ioutil.ReadAll(ctx.Request.Body)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	status, resp, err := a.purgeOnLeader(body)
+	if err != nil {
+		log.DB.Error(err)
+		ctx.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	if status != http.StatusOK {
+		ctx.JSON(status, resp)
+		return
+	}
+
+	epoch, err := a.CacheMaster.Purge()
+	if err != nil {
+		log.DB.Error(err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "purged in the databases, failed to purge the caches: " + err.Error(), "purge": resp.Purge})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"purge": resp.Purge, "epoch": epoch})
+}
+
+// purgeOnLeader sends the purge to the databases until the leader takes
+// it, and returns the status and the response of the leader.
+func (a *Admin) purgeOnLeader(body []byte) (int, *purgeResp, error) {
+	dbs, err := a.DBMaster.Peers()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, db := range dbs {
+		res, err := a.requestDB(http.MethodPost, db, "/purge", bytes.NewReader(body))
+		if err != nil {
+			log.DB.Error(err)
+			continue
+		}
+
+		resp := &purgeResp{}
+		err = json.NewDecoder(res.Body).Decode(resp)
+		res.Body.Close()
+		if err != nil {
+			log.DB.Error(err)
+			continue
+		}
+		if resp.Code == codeNotLeader {
+			continue
+		}
+		return res.StatusCode, resp, nil
+	}
+	return 0, nil, errNoLeader
+}
+
+// handlePurges responds the audit records of the purges kept by a database.
+func (a *Admin) handlePurges(ctx *gin.Context) {
+	if !authorized(ctx) {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	dbs, err := a.DBMaster.Peers()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, db := range dbs {
+		res, err := a.requestDB(http.MethodGet, db, "/purges", nil)
+		if err != nil {
+			log.DB.Error(err)
+			continue
+		}
+
+		ctx.Status(res.StatusCode)
+		ctx.Header("Content-Type", res.Header.Get("Content-Type"))
+		io.Copy(ctx.Writer, res.Body)
+		res.Body.Close()
+		return
+	}
+	ctx.JSON(http.StatusBadGateway, gin.H{"error": "no database available"})
+}
+
+// requestDB sends a request with the admin token to the database db.
+func (a *Admin) requestDB(method, db, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, urlutil.MakeURL(db)+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", bearerPrefix+adminToken)
+	return dbClient.Do(req)
+}
@@ -0,0 +1,101 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/Focinfi/oncekv/log"
+	"github.com/gin-gonic/gin"
+)
+
+// dbNode for a database of GET /dbs/nodes, with its role and raft state
+// from its stats
+type dbNode struct {
+	Addr         string `json:"addr"`
+	Role         string `json:"role,omitempty"`
+	State        string `json:"state,omitempty"`
+	Leader       string `json:"leader,omitempty"`
+	AppliedIndex string `json:"applied_index,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// roleParams for the body of POST /dbs/promote and POST /dbs/demote, the
+// HTTP address of the database
+type roleParams struct {
+	Addr string `json:"addr"`
+}
+
+// handleDBNodes responds the databases with their roles, a voter or a
+// replica.
+func (a *Admin) handleDBNodes(ctx *gin.Context) {
+	dbs, err := a.DBMaster.Peers()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	nodes := make([]dbNode, len(dbs))
+	for i, db := range dbs {
+		nodes[i] = a.dbNodeOf(db)
+	}
+	ctx.JSON(http.StatusOK, nodes)
+}
+
+// dbNodeOf reads the stats of the database db.
+func (a *Admin) dbNodeOf(db string) dbNode {
+	node := dbNode{Addr: db}
+	res, err := a.requestDB(http.MethodGet, db, "/stats", nil)
+	if err != nil {
+		node.Error = err.Error()
+		return node
+	}
+	defer res.Body.Close()
+
+	stats := map[string]string{}
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		node.Error = err.Error()
+		return node
+	}
+	node.Role, node.State, node.Leader, node.AppliedIndex = stats["role"], stats["state"], stats["leader"], stats["applied_index"]
+	return node
+}
+
+// handlePromote promotes the replica at the HTTP address of the body to a
+// voter.
+func (a *Admin) handlePromote(ctx *gin.Context) {
+	a.changeRole(ctx, "/promote")
+}
+
+// handleDemote demotes the voter at the HTTP address of the body to a
+// replica.
+func (a *Admin) handleDemote(ctx *gin.Context) {
+	a.changeRole(ctx, "/demote")
+}
+
+// changeRole sends the role change to the database and responds its
+// answer.
+func (a *Admin) changeRole(ctx *gin.Context, path string) {
+	if !authorized(ctx) {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	params := &roleParams{}
+	if err := ctx.BindJSON(params); err != nil || params.Addr == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "addr is required"})
+		return
+	}
+
+	res, err := a.requestDB(http.MethodPost, params.Addr, path, nil)
+	if err != nil {
+		log.DB.Error(err)
+		ctx.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	defer res.Body.Close()
+
+	ctx.Status(res.StatusCode)
+	ctx.Header("Content-Type", res.Header.Get("Content-Type"))
+	io.Copy(ctx.Writer, res.Body)
+}
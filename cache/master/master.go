@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/rpc"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -30,6 +31,7 @@ var (
 	defaultHeartbeatPeriod = time.Second
 	defaultAddr            = config.Config.CacheMasterAddr
 	cacheNodesKey          = config.Config.CacheNodesKey
+	purgeEpochKey          = config.Config.PurgeEpochKey
 	httpPoster             = mock.HTTPPoster(mock.HTTPPosterFunc(http.Post))
 )
 
@@ -63,6 +65,8 @@ func (p nodesMap) nodeAddrs() []string {
 type PeerParam struct {
 	Peers []string `json:"peers"`
 	DBs   []string `json:"dbs"`
+	// Epoch of the purges, the nodes drop the values cached before it
+	Epoch uint64 `json:"epoch"`
 }
 
 type JoinParam struct {
@@ -76,13 +80,15 @@ type Master struct {
 	sync.RWMutex
 	nodesMap nodesMap
 	dbs      []string
+	epoch    uint64
 
 	// http server
 	addr string
 
 	// database store
-	meta        meta.Meta
-	nodesMapKey string
+	meta          meta.Meta
+	nodesMapKey   string
+	purgeEpochKey string
 }
 
 // Default returns a new Master with the default addr
@@ -91,9 +97,10 @@ var Default = New(defaultAddr)
 // New returns a new Master with the addr
 func New(addr string) *Master {
 	m := &Master{
-		addr:        addr,
-		nodesMapKey: cacheNodesKey,
-		meta:        meta.Default,
+		addr:          addr,
+		nodesMapKey:   cacheNodesKey,
+		purgeEpochKey: purgeEpochKey,
+		meta:          meta.Default,
 	}
 
 	nodesMap, err := m.fetchNodesMap()
@@ -103,7 +110,13 @@ func New(addr string) *Master {
 
 	log.Biz.Infoln(logPrefix, "Nodes: ", nodesMap)
 
+	epoch, err := m.fetchEpoch()
+	if err != nil {
+		panic(err)
+	}
+
 	m.nodesMap = nodesMap
+	m.epoch = epoch
 	return m
 }
 
@@ -150,7 +163,7 @@ func (m *Master) JoinNode(args *JoinParam, reply *PeerParam) error {
 		return fmt.Errorf("%s fail updateNodesMap, err: %v", logPrefix, err)
 	}
 
-	*reply = PeerParam{Peers: m.nodesMap.httpAddrs(), DBs: m.dbs}
+	*reply = PeerParam{Peers: m.nodesMap.httpAddrs(), DBs: m.dbs, Epoch: m.epoch}
 	m.Unlock()
 	log.DB.Infoln("join:", m.nodesMap)
 	return nil
@@ -206,8 +219,13 @@ func (m *Master) sendPeers(node string, nodes []string) error {
 	if err := m.syncDBs(); err != nil {
 		return err
 	}
+	if err := m.syncEpoch(); err != nil {
+		return err
+	}
 
-	params := PeerParam{Peers: nodes, DBs: m.dbs}
+	m.RLock()
+	params := PeerParam{Peers: nodes, DBs: m.dbs, Epoch: m.epoch}
+	m.RUnlock()
 
 	b, err := json.Marshal(&params)
 	if err != nil {
@@ -246,6 +264,66 @@ func (m *Master) removeNode(node string) {
 	m.Unlock()
 }
 
+// Purge starts a new epoch of the purges and sends it to the nodes at
+// once, so they stop serving the values they cached, including the keys
+// purged in the databases. The nodes missed get it with the heartbeats.
+func (m *Master) Purge() (uint64, error) {
+	epoch, err := m.fetchEpoch()
+	if err != nil {
+		return 0, err
+	}
+	epoch++
+	if err := m.meta.Put(m.purgeEpochKey, strconv.FormatUint(epoch, 10)); err != nil {
+		return 0, err
+	}
+
+	m.Lock()
+	m.epoch = epoch
+	nodesMap := m.nodesMap
+	m.Unlock()
+
+	var wg sync.WaitGroup
+	nodePeers := nodesMap.nodeAddrs()
+	for _, nodeURL := range nodesMap.httpAddrs() {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			if err := m.sendPeers(node, nodePeers); err != nil {
+				log.Internal.Errorln(logPrefix, "failed to send the purge epoch to", node, err)
+			}
+		}(nodeURL)
+	}
+	wg.Wait()
+	return epoch, nil
+}
+
+func (m *Master) fetchEpoch() (uint64, error) {
+	val, err := m.meta.Get(m.purgeEpochKey)
+	if err == config.ErrDataNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(val, 10, 64)
+}
+
+// syncEpoch reads the epoch of the purges, which an admin may have started
+// on another master.
+func (m *Master) syncEpoch() error {
+	epoch, err := m.fetchEpoch()
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if epoch > m.epoch {
+		m.epoch = epoch
+	}
+	return nil
+}
+
 func (m *Master) syncDBs() error {
 	dbs, err := master.Default.Peers()
 	if err != nil {
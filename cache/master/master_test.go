@@ -3,8 +3,13 @@ package master
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"net/rpc"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -146,3 +151,44 @@ func TestJoin(t *testing.T) {
 		t.Errorf("can not join a node, expect %v, got: %v\n", expect, got)
 	}
 }
+
+func TestPurge(t *testing.T) {
+	nodes := testNodes()
+	b, err := json.Marshal(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.Default.Put(cacheNodesKey, string(b))
+
+	var mux sync.Mutex
+	var sent []PeerParam
+	httpPoster = mock.HTTPPosterFunc(func(url string, contentType string, body io.Reader) (*http.Response, error) {
+		params := PeerParam{}
+		if err := json.NewDecoder(body).Decode(&params); err != nil {
+			return nil, err
+		}
+		mux.Lock()
+		sent = append(sent, params)
+		mux.Unlock()
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+
+	m := New(testAddr)
+	m.purgeEpochKey = "test.purge.epoch"
+	for _, expect := range []uint64{1, 2} {
+		epoch, err := m.Purge()
+		if err != nil || epoch != expect {
+			t.Errorf("expect epoch %d, got: %d, %v\n", expect, epoch, err)
+		}
+	}
+	if len(sent) != 2 || sent[1].Epoch != 2 {
+		t.Errorf("failed to send the epochs to the nodes, got: %v\n", sent)
+	}
+
+	// another master reads the epoch
+	other := New(testAddr)
+	other.purgeEpochKey = m.purgeEpochKey
+	if err := other.syncEpoch(); err != nil || other.epoch != 2 {
+		t.Errorf("failed to sync the epoch, got: %d, %v\n", other.epoch, err)
+	}
+}
@@ -0,0 +1,101 @@
+package node
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Focinfi/oncekv/log"
+	"github.com/Focinfi/oncekv/namespace"
+	"github.com/Focinfi/oncekv/utils/urlutil"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/groupcache"
+)
+
+const (
+	// nsGroupPrefix prefixes the names of the groups of the namespaces
+	nsGroupPrefix = "ns."
+
+	// tokenQuery is the query of the access token of a namespace, which
+	// may also be given as the bearer token of the Authorization header
+	tokenQuery   = "token"
+	bearerPrefix = "Bearer "
+)
+
+var namespaces = namespace.Default
+
+// groupOf returns the group of the namespace of the request, creating it
+// with the cache budget of the namespace on its first read. It responds
+// the error and returns false if the namespace is not found or the token
+// does not grant the access to it.
+func (node *Node) groupOf(ctx *gin.Context) (*groupcache.Group, bool) {
+	name := ctx.Param("ns")
+	if name == "" {
+		return node.group, true
+	}
+
+	ns, err := namespaces.Get(name)
+	if err == namespace.ErrNotFound {
+		ctx.JSON(http.StatusNotFound, nil)
+		return nil, false
+	}
+	if err != nil {
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, nil)
+		return nil, false
+	}
+	if !ns.Authorized(tokenOf(ctx)) {
+		ctx.JSON(http.StatusUnauthorized, nil)
+		return nil, false
+	}
+
+	node.groupsMux.Lock()
+	defer node.groupsMux.Unlock()
+
+	group, ok := node.groups[name]
+	if !ok {
+		// the groups are registered in the process, like the default one
+		if group = groupcache.GetGroup(nsGroupPrefix + name); group == nil {
+			group = newGroup(node, nsGroupPrefix+name, name, ns.CacheBytes)
+		}
+		node.groups[name] = group
+	}
+	return group, true
+}
+
+// tokenOf returns the token of the request
+func tokenOf(ctx *gin.Context) string {
+	if auth := ctx.GetHeader("Authorization"); strings.HasPrefix(auth, bearerPrefix) {
+		return strings.TrimPrefix(auth, bearerPrefix)
+	}
+	return ctx.Query(tokenQuery)
+}
+
+// keyParam returns the key of the route, which may contain slashes.
+func keyParam(ctx *gin.Context) string {
+	return strings.TrimPrefix(ctx.Param("key"), "/")
+}
+
+// dbGetURL returns the URL reading the key of the namespace ns from the
+// database db with the query, the cache reads a namespace with its first
+// token.
+func dbGetURL(db string, ns string, key string, query url.Values) (string, error) {
+	var nsPath string
+	if ns != "" {
+		policy, err := namespaces.Get(ns)
+		if err != nil {
+			return "", err
+		}
+		if len(policy.Tokens) > 0 {
+			query.Set(tokenQuery, policy.Tokens[0])
+		}
+		nsPath = "/ns/" + ns
+	}
+
+	getURL := fmt.Sprintf(dbGetURLFormat, urlutil.MakeURL(db), nsPath, url.PathEscape(key))
+	if len(query) > 0 {
+		getURL += "?" + query.Encode()
+	}
+	return getURL, nil
+}
@@ -1,13 +1,16 @@
 package node
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/rpc"
+	"net/url"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +18,7 @@ import (
 	"github.com/Focinfi/oncekv/cache/master"
 	"github.com/Focinfi/oncekv/config"
 	"github.com/Focinfi/oncekv/log"
+	"github.com/Focinfi/oncekv/utils/cas"
 	"github.com/Focinfi/oncekv/utils/mock"
 	"github.com/Focinfi/oncekv/utils/urlutil"
 	"github.com/gin-gonic/gin"
@@ -26,8 +30,11 @@ const (
 	jsonHTTPHeader = "application-type/json"
 	basePath       = "/oncekv/"
 	defaultGroup   = "kv"
-	dbGetURLFormat = "%s/i/key/%s"
+	dbGetURLFormat = "%s%s/i/key/%s"
 	logPrefix      = "cache/node:"
+	// maxKeyGens is the most keys of the groups found expired kept, the
+	// generations start over once it is reached
+	maxKeyGens = 1 << 16
 )
 
 var (
@@ -35,6 +42,8 @@ var (
 	ErrDataNotFound = fmt.Errorf("%s data not found", logPrefix)
 	// ErrDatabaseQueryTimeout for underlying data query timeout error
 	ErrDatabaseQueryTimeout = fmt.Errorf("%s upderlying data query timeout", logPrefix)
+	// ErrChecksumMismatch for the data of a database failing its checksum
+	ErrChecksumMismatch = fmt.Errorf("%s checksum mismatch", logPrefix)
 
 	dbQueryTimeout  = config.Config.HTTPRequestTimeout
 	groupcacheBytes = config.Config.CacheBytes
@@ -54,6 +63,7 @@ var (
 type masterParam struct {
 	Peers []string `json:"peers"`
 	DBs   []string `json:"dbs"`
+	Epoch uint64   `json:"epoch"`
 }
 
 // Node for one groupcache server
@@ -62,10 +72,13 @@ type Node struct {
 	sync.RWMutex // protect updating for dbs and peers
 	// underlying database
 	dbs []string
-	// fast db
-	fastDB string
+	// index of the database for the next read
+	nextDBIndex int
 	// cache peers
 	peers []string
+	// epoch of the purges, the keys of the groups start with it, so the
+	// values cached in the former epochs are not read any more
+	epoch uint64
 	// master url for update meta(dbs and peers)
 	masterAddr      string
 	masterRPCClient mock.RPCClient
@@ -78,6 +91,15 @@ type Node struct {
 	nodeAddr string
 	pool     *groupcache.HTTPPool
 	group    *groupcache.Group
+
+	// groups of the namespaces, created on their first reads
+	groupsMux sync.Mutex
+	groups    map[string]*groupcache.Group
+
+	// generations of the keys found expired in the groups, by group name and
+	// key, a key added again is cached under its next generation
+	gensMux sync.Mutex
+	gens    map[string]uint64
 }
 
 // New returns a new Node with the given info
@@ -87,10 +109,12 @@ func New(httpAddr string, nodeAddr string, masterAddr string) *Node {
 		httpAddr:   httpAddr,
 		nodeAddr:   nodeAddr,
 		pool:       newPool(nodeAddr),
+		groups:     map[string]*groupcache.Group{},
+		gens:       map[string]uint64{},
 	}
 
 	cache.Engine = newServer(cache)
-	cache.group = newGroup(cache, defaultGroup)
+	cache.group = newGroup(cache, defaultGroup, "", groupcacheBytes)
 
 	client, err := rpc.DialHTTP("tcp", masterAddr)
 	if err != nil {
@@ -123,7 +147,11 @@ func newServer(node *Node) *gin.Engine {
 	server.GET("/stats", func(ctx *gin.Context) {
 		ctx.JSON(http.StatusOK, node.group.Stats)
 	})
-	server.GET("/key/:key", node.handleGetKey)
+	// the keys of the default namespace, and of the namespace :ns
+	for _, routes := range []gin.IRoutes{server, server.Group("/ns/:ns")} {
+		routes.GET("/key/*key", node.handleGetKey)
+		routes.GET("/object/*key", node.handleGetObject)
+	}
 	server.GET("/ws/stats", node.handleStatsWebSocket)
 	return server
 }
@@ -152,11 +180,41 @@ func (node *Node) handleStatsWebSocket(ctx *gin.Context) {
 	}
 }
 
+// handleGetKey responds the response of the database for the key as it is,
+// so the metadata of the key passes through the cache, or the value as the
+// body with the format=raw query. The misses of a read
+// with min_index are read again from a database having applied the index,
+// for a write the cache may not know yet, and the misses of a read with
+// wait are passed to a database waiting for the key. A key expired in the
+// cache is read again from a database, it may have been added again. With
+// verify=true, a value not matching its content-addressed key gets 502.
 func (node *Node) handleGetKey(ctx *gin.Context) {
-	result := &groupcache.ByteView{}
+	group, ok := node.groupOf(ctx)
+	if !ok {
+		return
+	}
+
+	key := keyParam(ctx)
+	query := url.Values{}
+	if minIndex := ctx.Query("min_index"); minIndex != "" {
+		if _, err := strconv.ParseUint(minIndex, 10, 64); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		query.Set("min_index", minIndex)
+	}
+	if wait := ctx.Query("wait"); wait != "" {
+		if _, err := time.ParseDuration(wait); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		query.Set("wait", wait)
+	}
+
 	log.DB.Infoln("Start Get")
-	err := node.group.Get(ctx.Request.Context(), ctx.Param("key"), groupcache.ByteViewSink(result))
+	data, err := node.getData(ctx.Request.Context(), ctx.Param("ns"), group, key, query)
 	log.DB.Infoln("End Get")
+
 	if err == ErrDataNotFound {
 		ctx.JSON(http.StatusNotFound, nil)
 		return
@@ -168,9 +226,44 @@ func (node *Node) handleGetKey(ctx *gin.Context) {
 		return
 	}
 
-	ctx.Writer.WriteHeader(http.StatusOK)
+	if ctx.Query("verify") == "true" {
+		if _, value, err := decodeRecord(data); err != nil || !cas.Verify(key, value) {
+			log.DB.Errorln(logPrefix, "value not matching the content-addressed key:", key, err)
+			ctx.JSON(http.StatusBadGateway, nil)
+			return
+		}
+	}
+
+	if ctx.Query("format") == formatRaw {
+		writeRaw(ctx, data)
+		return
+	}
+
 	ctx.Writer.Header()["Content-Type"] = []string{"application/json; charset=utf-8"}
-	ctx.Writer.Write(result.ByteSlice())
+	ctx.Writer.WriteHeader(http.StatusOK)
+	ctx.Writer.Write(data)
+}
+
+// getData gets the database response data of the key of the namespace ns
+// through the group. A key expired in the cache is read under its next
+// generation, so a key added again is cached again, the misses of a read
+// with a query and the keys still expired are read from the databases.
+func (node *Node) getData(ctx context.Context, ns string, group *groupcache.Group, key string, query url.Values) ([]byte, error) {
+	cacheKey := node.cacheKey(group, key)
+	result := &groupcache.ByteView{}
+	err := group.Get(ctx, cacheKey, groupcache.ByteViewSink(result))
+	if err == nil && expired(result.ByteSlice()) {
+		err = group.Get(ctx, node.renewCacheKey(group, key, cacheKey), groupcache.ByteViewSink(result))
+	}
+	switch {
+	case err == nil && expired(result.ByteSlice()):
+		return node.findAfter(ns, key, query)
+	case err == nil:
+		return result.ByteSlice(), nil
+	case err == ErrDataNotFound && len(query) > 0:
+		return node.findAfter(ns, key, query)
+	}
+	return nil, err
 }
 
 func newPool(addr string) *groupcache.HTTPPool {
@@ -180,8 +273,57 @@ func newPool(addr string) *groupcache.HTTPPool {
 		})
 }
 
-func newGroup(n *Node, name string) *groupcache.Group {
-	return groupcache.NewGroup(name, groupcacheBytes, groupcache.GetterFunc(n.fetchData))
+// newGroup returns a new group caching cacheBytes of the keys of the
+// namespace ns.
+func newGroup(n *Node, name string, ns string, cacheBytes int64) *groupcache.Group {
+	return groupcache.NewGroup(name, cacheBytes, groupcache.GetterFunc(
+		func(ctx groupcache.Context, cacheKey string, dest groupcache.Sink) error {
+			return n.fetchData(ns, keyOfCacheKey(cacheKey), dest)
+		}))
+}
+
+// cacheKey returns the key of the group for the key in the current epoch
+// of the purges and generation of the key.
+func (node *Node) cacheKey(group *groupcache.Group, key string) string {
+	node.gensMux.Lock()
+	defer node.gensMux.Unlock()
+	return node.cacheKeyLocked(group, key)
+}
+
+// renewCacheKey moves the key of the group found expired under stale to its
+// next generation and returns its key of the group, a key renewed by
+// another read meanwhile keeps its generation.
+func (node *Node) renewCacheKey(group *groupcache.Group, key string, stale string) string {
+	node.gensMux.Lock()
+	defer node.gensMux.Unlock()
+	if cacheKey := node.cacheKeyLocked(group, key); cacheKey != stale {
+		return cacheKey
+	}
+
+	genKey := group.Name() + "/" + key
+	gen := node.gens[genKey] + 1
+	if len(node.gens) >= maxKeyGens {
+		node.gens = map[string]uint64{}
+	}
+	node.gens[genKey] = gen
+	return node.cacheKeyLocked(group, key)
+}
+
+func (node *Node) cacheKeyLocked(group *groupcache.Group, key string) string {
+	node.RLock()
+	epoch := strconv.FormatUint(node.epoch, 10)
+	node.RUnlock()
+
+	if gen := node.gens[group.Name()+"/"+key]; gen > 0 {
+		return epoch + "." + strconv.FormatUint(gen, 10) + "/" + key
+	}
+	return epoch + "/" + key
+}
+
+// keyOfCacheKey returns the key of the key of the groups, the epoch and
+// generation never contain a '/'.
+func keyOfCacheKey(cacheKey string) string {
+	return cacheKey[strings.IndexByte(cacheKey, '/')+1:]
 }
 
 func (node *Node) join() error {
@@ -203,6 +345,7 @@ func (node *Node) join() error {
 	node.pool.Set(reply.Peers...)
 	node.peers = reply.Peers
 	node.dbs = reply.DBs
+	node.epoch = reply.Epoch
 	return nil
 }
 
@@ -218,7 +361,8 @@ func (node *Node) handleMeta(ctx *gin.Context) {
 
 	node.RLock()
 	if reflect.DeepEqual(node.peers, params.Peers) &&
-		reflect.DeepEqual(node.dbs, params.DBs) {
+		reflect.DeepEqual(node.dbs, params.DBs) &&
+		node.epoch == params.Epoch {
 
 		node.RUnlock()
 		// return if no changes
@@ -236,32 +380,82 @@ func (node *Node) handleMeta(ctx *gin.Context) {
 	node.pool.Set(params.Peers...)
 	node.peers = params.Peers
 	node.dbs = params.DBs
+	if params.Epoch > node.epoch {
+		log.Biz.Infof("%s purge epoch: %d\n", logPrefix, params.Epoch)
+		node.epoch = params.Epoch
+	}
 
 	ctx.JSON(http.StatusOK, nil)
 }
 
-func (node *Node) fetchData(ctx groupcache.Context, key string, dest groupcache.Sink) error {
-	if node.fastDB == "" {
-		return node.tryAllDBFind(ctx, key, dest)
+// fetchData reads the key of the namespace ns from the databases in turn,
+// every replica serves the keys it holds and forwards the misses to the
+// leader.
+func (node *Node) fetchData(ns string, key string, dest groupcache.Sink) error {
+	db := node.nextDB()
+	if db == "" {
+		return node.tryAllDBFind(ns, key, dest)
 	}
 
-	data, err := node.find(key, node.fastDB)
+	data, err := node.find(ns, key, db)
 	if err == ErrDataNotFound {
 		return err
 	}
 
 	if err != nil {
 		log.DB.Error(logPrefix, err)
-		go node.setFastDB("")
-		return node.tryAllDBFind(ctx, key, dest)
+		return node.tryAllDBFind(ns, key, dest)
 	}
 
 	dest.SetBytes(data)
 	return nil
 }
 
-func (node *Node) find(key string, url string) ([]byte, error) {
-	url = fmt.Sprintf(dbGetURLFormat, urlutil.MakeURL(url), key)
+// nextDB returns the databases in turn, or "" if there is none.
+func (node *Node) nextDB() string {
+	node.Lock()
+	defer node.Unlock()
+
+	if len(node.dbs) == 0 {
+		return ""
+	}
+
+	node.nextDBIndex = (node.nextDBIndex + 1) % len(node.dbs)
+	return node.dbs[node.nextDBIndex]
+}
+
+func (node *Node) find(ns string, key string, db string) ([]byte, error) {
+	getURL, err := dbGetURL(db, ns, key, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	return node.get(key, getURL)
+}
+
+// findAfter reads the key from the databases with the query, each waits
+// for the min_index or the wait in it before answering a miss.
+func (node *Node) findAfter(ns string, key string, query url.Values) ([]byte, error) {
+	node.RLock()
+	dbs := make([]string, len(node.dbs))
+	copy(dbs, node.dbs)
+	node.RUnlock()
+
+	err := fmt.Errorf("%s databases are not available", logPrefix)
+	for _, db := range dbs {
+		var data []byte
+		var getURL string
+		if getURL, err = dbGetURL(db, ns, key, query); err != nil {
+			return nil, err
+		}
+		if data, err = node.get(key, getURL); err == nil || err == ErrDataNotFound {
+			return data, err
+		}
+		log.DB.Error(logPrefix, err)
+	}
+	return nil, err
+}
+
+func (node *Node) get(key string, url string) ([]byte, error) {
 	resp, err := httpGetter.Get(url)
 	if err != nil {
 		return nil, err
@@ -281,6 +475,9 @@ func (node *Node) find(key string, url string) ([]byte, error) {
 		if len(b) == 0 {
 			return nil, fmt.Errorf("%s database error, lost data of key: %s\n", logPrefix, key)
 		}
+		if err := verifyChecksum(b); err != nil {
+			return nil, fmt.Errorf("%s database error, corrupted data of key: %s, %v", logPrefix, key, err)
+		}
 
 		return b, nil
 	}
@@ -288,7 +485,7 @@ func (node *Node) find(key string, url string) ([]byte, error) {
 	return nil, fmt.Errorf("%s failed to fetch data", logPrefix)
 }
 
-func (node *Node) tryAllDBFind(ctx groupcache.Context, key string, dest groupcache.Sink) error {
+func (node *Node) tryAllDBFind(ns string, key string, dest groupcache.Sink) error {
 	dbs := make([]string, len(node.dbs))
 	copy(dbs, node.dbs)
 	log.Biz.Infoln(logPrefix, "start fetchData:", time.Now(), dbs)
@@ -297,21 +494,21 @@ func (node *Node) tryAllDBFind(ctx groupcache.Context, key string, dest groupcac
 	}
 
 	var got bool
+	var mux sync.Mutex
 	var data = make(chan []byte)
 	var completeCount int
-	var fastURL string
 	var resErr error
 
 	for _, db := range dbs {
 		go func(url string) {
-			val, err := node.find(key, url)
+			val, err := node.find(ns, key, url)
 
-			node.Lock()
-			defer node.Unlock()
+			mux.Lock()
+			defer mux.Unlock()
+			completeCount++
 			if len(val) > 0 || err == ErrDataNotFound || completeCount == len(dbs) {
 				if !got {
 					got = true
-					fastURL = url
 					resErr = err
 
 					go func() { data <- val }()
@@ -322,24 +519,15 @@ func (node *Node) tryAllDBFind(ctx groupcache.Context, key string, dest groupcac
 
 	select {
 	case <-time.After(dbQueryTimeout):
-		go node.setFastDB("")
 		return ErrDatabaseQueryTimeout
 
 	case value := <-data:
 		log.Biz.Infoln(logPrefix, "end get:", time.Now())
-		dest.SetBytes(value)
-
-		if len(value) > 0 || resErr == ErrDataNotFound {
-			go node.setFastDB(fastURL)
+		if resErr != nil {
+			return resErr
 		}
 
-		return resErr
+		dest.SetBytes(value)
+		return nil
 	}
 }
-
-func (node *Node) setFastDB(db string) {
-	node.Lock()
-	defer node.Unlock()
-
-	node.fastDB = db
-}
@@ -4,13 +4,18 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"net/http"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/Focinfi/oncekv/config"
+	"github.com/Focinfi/oncekv/namespace"
+	"github.com/Focinfi/oncekv/utils/cas"
+	"github.com/Focinfi/oncekv/utils/object"
 	"github.com/Focinfi/oncekv/utils/urlutil"
 )
 
@@ -83,7 +88,7 @@ func TestJoinAndMeta(t *testing.T) {
 
 	// mock with getters
 	getters := map[string]mock.HTTPGetter{}
-	getters[newDBs[0]] = mock.MakeHTTPGetter(newDBs[0], `{"key":"foo","value":"bar"}`, nil, 0)
+	getters[newDBs[0]] = mock.MakeHTTPGetter(newDBs[0], `{"key":"foo","value":"bar","index":7,"term":2,"writer":"w"}`, nil, 0)
 	getters[newDBs[1]] = mock.MakeHTTPGetter(newDBs[1], "{}", fmt.Errorf("i am not a leader"), 0)
 	httpGetter = mock.HTTPGetterCluster(getters)
 
@@ -103,7 +108,7 @@ func TestJoinAndMeta(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	resMap := map[string]string{}
+	resMap := map[string]interface{}{}
 	if err := json.Unmarshal(b, &resMap); err != nil {
 		t.Fatal(err)
 	}
@@ -112,7 +117,233 @@ func TestJoinAndMeta(t *testing.T) {
 		t.Errorf("failed to response the value, expect bar, got %s\n", value)
 	}
 
-	if n.fastDB != dbs[0] {
-		t.Errorf("failed to set fastDB, expect: %s, got: %v\n", dbs[0], n.fastDB)
+	if resMap["index"] != 7.0 || resMap["term"] != 2.0 || resMap["writer"] != "w" {
+		t.Errorf("failed to pass through the metadata, got %v\n", resMap)
+	}
+
+	// the value is responded as the body with the format=raw query
+	resp, err = http.Get(url + "?format=raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(b) != "bar" || resp.Header.Get("X-Oncekv-Index") != "7" || resp.Header.Get("X-Oncekv-Writer") != "w" {
+		t.Errorf("failed to respond the raw value, got: %q, %v\n", b, resp.Header)
+	}
+
+	// the reads are spread across the databases
+	first, second := n.nextDB(), n.nextDB()
+	if first == second {
+		t.Errorf("failed to spread the reads, got %s twice\n", first)
+	}
+
+	// a miss is read again from the databases with the min_index or the wait
+	httpGetter = mock.HTTPGetterFunc(func(url string) (*http.Response, error) {
+		if !strings.Contains(url, "min_index=7") && !strings.Contains(url, "wait=1s") {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(`{"key":"new","value":"v"}`))}, nil
+	})
+	for path, expect := range map[string]int{
+		"/key/new":             http.StatusNotFound,
+		"/key/new?min_index=7": http.StatusOK,
+		"/key/new?min_index=x": http.StatusBadRequest,
+		"/key/new?wait=1s":     http.StatusOK,
+		"/key/new?wait=x":      http.StatusBadRequest,
+	} {
+		resp, err := http.Get(urlutil.MakeURL(httpAddr) + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != expect {
+			t.Errorf("GET %s, expect: %d, got: %d\n", path, expect, resp.StatusCode)
+		}
+	}
+	// an object is read through its chunks, with the Range header
+	data := "0123456789abcdefghij"
+	values := map[string]string{}
+	manifest := object.Manifest{Size: int64(len(data)), ChunkSize: 8, ContentType: "text/plain"}
+	for i := 0; i < len(data); i += 8 {
+		end := i + 8
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := object.Hash([]byte(data[i:end]))
+		manifest.Chunks = append(manifest.Chunks, hash)
+		values[object.ChunkKey(hash)] = fmt.Sprintf(`{"value":%q}`, data[i:end])
+	}
+	b, err = json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values["obj"] = fmt.Sprintf(`{"value":%q,"content_type":%q}`, b, object.ManifestContentType)
+	httpGetter = mock.HTTPGetterFunc(func(url string) (*http.Response, error) {
+		for key, value := range values {
+			if strings.Contains(url, "/key/"+key) {
+				return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(value))}, nil
+			}
+		}
+		return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+
+	req, err := http.NewRequest(http.MethodGet, urlutil.MakeURL(httpAddr)+"/object/obj", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=6-11")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusPartialContent || string(b) != "6789ab" || resp.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("failed to read a range of the object, got: %d, %q, %v\n", resp.StatusCode, b, resp.Header)
+	}
+
+	for path, expect := range map[string]int{
+		"/object/obj":     http.StatusOK,
+		"/object/foo":     http.StatusBadRequest,
+		"/object/missing": http.StatusNotFound,
+	} {
+		resp, err := http.Get(urlutil.MakeURL(httpAddr) + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != expect {
+			t.Errorf("GET %s, expect: %d, got: %d\n", path, expect, resp.StatusCode)
+		}
+		if path == "/object/obj" && string(b) != data {
+			t.Errorf("failed to read the object, got: %q\n", b)
+		}
+	}
+	// the keys of a namespace are read with its token, in its own group
+	if err := namespaces.Create(&namespace.Namespace{Name: "cteam", Tokens: []string{"ct"}}); err != nil {
+		t.Fatal(err)
+	}
+	httpGetter = mock.HTTPGetterFunc(func(url string) (*http.Response, error) {
+		if !strings.Contains(url, "/ns/cteam/i/key/foo?token=ct") {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(`{"key":"foo","value":"team"}`))}, nil
+	})
+	for path, expect := range map[string]int{
+		"/ns/cteam/key/foo?token=ct": http.StatusOK,
+		"/ns/cteam/key/foo":          http.StatusUnauthorized,
+		"/ns/missing/key/foo":        http.StatusNotFound,
+	} {
+		resp, err := http.Get(urlutil.MakeURL(httpAddr) + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != expect {
+			t.Errorf("GET %s, expect: %d, got: %d\n", path, expect, resp.StatusCode)
+		}
+		if expect == http.StatusOK && !strings.Contains(string(b), `"team"`) {
+			t.Errorf("GET %s, got the value of another namespace: %s\n", path, b)
+		}
+	}
+
+	// an expired key in the cache is read again from the databases
+	expiresAt := time.Now().Add(50 * time.Millisecond).Format(time.RFC3339Nano)
+	value := fmt.Sprintf(`{"key":"exp","value":"v1","expires_at":%q}`, expiresAt)
+	httpGetter = mock.HTTPGetterFunc(func(url string) (*http.Response, error) {
+		if value == "" || !strings.Contains(url, "/key/exp") {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(value))}, nil
+	})
+	getExp := func() (int, string) {
+		resp, err := http.Get(urlutil.MakeURL(httpAddr) + "/key/exp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(b)
+	}
+	if code, b := getExp(); code != http.StatusOK || !strings.Contains(b, "v1") {
+		t.Errorf("failed to read the key with a ttl, got: %d, %s\n", code, b)
+	}
+	time.Sleep(60 * time.Millisecond)
+	value = ""
+	if code, _ := getExp(); code != http.StatusNotFound {
+		t.Errorf("expect the expired key not found, got: %d\n", code)
+	}
+	value = `{"key":"exp","value":"v2"}`
+	if code, b := getExp(); code != http.StatusOK || !strings.Contains(b, "v2") {
+		t.Errorf("failed to read the key added again, got: %d, %s\n", code, b)
+	}
+	value = `{"key":"exp","value":"v2-db"}`
+	if code, b := getExp(); code != http.StatusOK || !strings.Contains(b, `"v2"`) {
+		t.Errorf("expect the key added again cached, got: %d, %s\n", code, b)
+	}
+
+	// a purge epoch drops the values cached
+	value = `{"key":"exp","value":"v3"}`
+	b, err = json.Marshal(masterParam{Peers: newPeers, DBs: newDBs, Epoch: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Post(fmt.Sprintf("%s/meta", urlutil.MakeURL(httpAddr)), jsonHTTPHeader, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if code, b := getExp(); code != http.StatusOK || !strings.Contains(b, "v3") {
+		t.Errorf("failed to drop the values cached before the purge, got: %d, %s\n", code, b)
+	}
+
+	// the values of the content-addressed keys are verified with verify=true
+	helloKey := cas.Key([]byte("hello"))
+	httpGetter = mock.HTTPGetterFunc(func(url string) (*http.Response, error) {
+		value := "hello"
+		if strings.Contains(url, "/key/bad") {
+			value = "forged"
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"value":%q}`, value)))}, nil
+	})
+	for path, expect := range map[string]int{
+		"/key/" + helloKey + "?verify=true":    http.StatusOK,
+		"/key/bad" + helloKey:                  http.StatusOK,
+		"/key/bad" + helloKey + "?verify=true": http.StatusBadGateway,
+	} {
+		resp, err := http.Get(urlutil.MakeURL(httpAddr) + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expect {
+			t.Errorf("GET %s, expect: %d, got: %d\n", path, expect, resp.StatusCode)
+		}
+	}
+
+	// the data of a database failing its checksum is not cached
+	checksum := fmt.Sprintf("%08x", crc32.Checksum([]byte("abc"), crcTable))
+	httpGetter = mock.HTTPGetterFunc(func(url string) (*http.Response, error) {
+		value := "abc"
+		if strings.Contains(url, "/key/corrupted") {
+			value = "abd"
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"value":%q,"checksum":%q}`, value, checksum)))}, nil
+	})
+	for path, ok := range map[string]bool{"/key/checksummed": true, "/key/corrupted": false} {
+		resp, err := http.Get(urlutil.MakeURL(httpAddr) + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if (resp.StatusCode == http.StatusOK) != ok {
+			t.Errorf("GET %s, expect ok: %v, got: %d\n", path, ok, resp.StatusCode)
+		}
 	}
 }
@@ -0,0 +1,67 @@
+package node
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/Focinfi/oncekv/log"
+	"github.com/Focinfi/oncekv/utils/object"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/groupcache"
+)
+
+// handleGetObject streams the object of the key, reading its manifest and
+// then its chunks through the cache, the Range header selects a part of
+// it. Every chunk is checked against its hash.
+func (node *Node) handleGetObject(ctx *gin.Context) {
+	group, ok := node.groupOf(ctx)
+	if !ok {
+		return
+	}
+
+	key, ns := keyParam(ctx), ctx.Param("ns")
+	rec, value, err := node.getValue(ctx.Request.Context(), ns, group, key)
+	if err == ErrDataNotFound {
+		ctx.JSON(http.StatusNotFound, nil)
+		return
+	}
+	if err != nil {
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+	if rec.ContentType != object.ManifestContentType {
+		ctx.JSON(http.StatusBadRequest, nil)
+		return
+	}
+
+	manifest, err := object.DecodeManifest(value)
+	if err != nil {
+		log.DB.Error(logPrefix, key, err)
+		ctx.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	reader := object.NewReader(manifest, func(chunkKey string) ([]byte, error) {
+		_, chunk, err := node.getValue(ctx.Request.Context(), ns, group, chunkKey)
+		return chunk, err
+	})
+
+	contentType := manifest.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	ctx.Header("Content-Type", contentType)
+	http.ServeContent(ctx.Writer, ctx.Request, key, rec.Timestamp, reader)
+}
+
+// getValue gets the record and the decoded value of the key of the
+// namespace ns through the group.
+func (node *Node) getValue(ctx context.Context, ns string, group *groupcache.Group, key string) (*record, []byte, error) {
+	data, err := node.getData(ctx, ns, group, key, url.Values{})
+	if err != nil {
+		return nil, nil, err
+	}
+	return decodeRecord(data)
+}
@@ -0,0 +1,123 @@
+package node
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Focinfi/oncekv/log"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	formatRaw      = "raw"
+	encodingBase64 = "base64"
+
+	defaultContentType = "application/octet-stream"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// record is the response of a database for a key, the value is encoded as
+// the encoding tells.
+type record struct {
+	Value       string    `json:"value"`
+	Encoding    string    `json:"encoding"`
+	ContentType string    `json:"content_type"`
+	Index       uint64    `json:"index"`
+	Term        uint64    `json:"term"`
+	Timestamp   time.Time `json:"timestamp"`
+	Writer      string    `json:"writer"`
+	RequestID   string    `json:"request_id"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Checksum    string    `json:"checksum"`
+}
+
+// expired reports whether the database response data is of a key expired,
+// the data of the keys without a ttl is not decoded.
+func expired(data []byte) bool {
+	if !bytes.Contains(data, []byte(`"expires_at"`)) {
+		return false
+	}
+
+	rec := struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	}{}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return false
+	}
+	return !rec.ExpiresAt.IsZero() && !rec.ExpiresAt.After(time.Now())
+}
+
+// verifyChecksum checks the value of the database response data against
+// its checksum, the data of the databases before the checksums has none.
+func verifyChecksum(data []byte) error {
+	if !bytes.Contains(data, []byte(`"checksum"`)) {
+		return nil
+	}
+
+	rec, value, err := decodeRecord(data)
+	if err != nil {
+		return err
+	}
+	if rec.Checksum != "" && rec.Checksum != fmt.Sprintf("%08x", crc32.Checksum(value, crcTable)) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// decodeRecord decodes the database response data, and returns it with
+// the decoded value.
+func decodeRecord(data []byte) (*record, []byte, error) {
+	rec := &record{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, nil, err
+	}
+
+	if rec.Encoding != encodingBase64 {
+		return rec, []byte(rec.Value), nil
+	}
+	value, err := base64.StdEncoding.DecodeString(rec.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rec, value, nil
+}
+
+// writeRaw responds the value of the database response data as the body,
+// with its content type and the metadata in the headers, like a database.
+func writeRaw(ctx *gin.Context, data []byte) {
+	rec, value, err := decodeRecord(data)
+	if err != nil {
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	contentType := rec.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	ctx.Header("X-Oncekv-Index", strconv.FormatUint(rec.Index, 10))
+	ctx.Header("X-Oncekv-Term", strconv.FormatUint(rec.Term, 10))
+	ctx.Header("X-Oncekv-Timestamp", rec.Timestamp.Format(time.RFC3339Nano))
+	if rec.Writer != "" {
+		ctx.Header("X-Oncekv-Writer", rec.Writer)
+	}
+	if rec.RequestID != "" {
+		ctx.Header("X-Oncekv-Request-Id", rec.RequestID)
+	}
+	if !rec.ExpiresAt.IsZero() {
+		ctx.Header("X-Oncekv-Expires-At", rec.ExpiresAt.Format(time.RFC3339Nano))
+	}
+	if rec.Checksum != "" {
+		ctx.Header("X-Oncekv-Checksum", rec.Checksum)
+	}
+	ctx.Data(http.StatusOK, contentType, value)
+}
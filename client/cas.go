@@ -0,0 +1,46 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Focinfi/oncekv/log"
+	"github.com/Focinfi/oncekv/utils/cas"
+)
+
+// PutContent puts the value under its content-addressed key, the SHA-256
+// of the value in lowercase hex, which the database derives and checks.
+// It returns the key, putting the same value again is not an error.
+func (kv *KV) PutContent(value []byte, contentType string) (string, *PutResult, error) {
+	key := cas.Key(value)
+	requestID := NewRequestID()
+	res, err := kv.write(func(url string) (interface{}, time.Duration, error) {
+		log.Biz.Debugln(logPrefix, "put content: ", key, len(value), url)
+		putURL := fmt.Sprintf(dbPutCASURLFormat, kv.baseURL(url), kv.rawQuery(requestID))
+		return kv.sendRaw(http.MethodPost, putURL, key, value, contentType, url)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	result := res.(*putResult)
+	kv.observe(result.Token.index())
+	if result.err == ErrKeyExists {
+		return key, &result.PutResult, nil
+	}
+	return key, &result.PutResult, result.err
+}
+
+// GetContent gets the value of a content-addressed key like GetBytes, and
+// returns ErrHashMismatch if the value does not match the key.
+func (kv *KV) GetContent(key string) ([]byte, *Meta, error) {
+	value, meta, err := kv.GetBytes(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !cas.Verify(key, value) {
+		return nil, nil, ErrHashMismatch
+	}
+	return value, meta, nil
+}
@@ -33,8 +33,13 @@ type client struct {
 	caches []string
 	// last fast enough cache server URL
 	fastCache string
-	// last fast enough database server URL
+	// last fast enough database server URL, for writing
 	fastDB string
+	// HTTP address of the database leader the databases last responded,
+	// the writes are sent to it first
+	leaderDB string
+	// index of the database for the next read
+	nextDBIndex int
 
 	// meta server
 	cacheCluster cluster
@@ -70,6 +75,46 @@ func (c *client) setFastDB(dbURL string) {
 	c.fastDB = dbURL
 }
 
+func (c *client) setLeaderDB(addr string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.leaderDB = addr
+}
+
+// dropLeaderDB forgets the database leader addr failing a write, unless
+// another leader is known meanwhile.
+func (c *client) dropLeaderDB(addr string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.leaderDB == addr {
+		c.leaderDB = ""
+	}
+}
+
+// leader returns the HTTP address of the database leader, or "" if it is
+// not known.
+func (c *client) leader() string {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.leaderDB
+}
+
+// nextDB returns the databases in turn, or "" if there is none.
+func (c *client) nextDB() string {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.dbs) == 0 {
+		return ""
+	}
+
+	c.nextDBIndex = (c.nextDBIndex + 1) % len(c.dbs)
+	return c.dbs[c.nextDBIndex]
+}
+
 func (c *client) refresh() {
 	ticker := time.NewTicker(time.Second)
 	for {
@@ -2,13 +2,19 @@ package client
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	neturl "net/url"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Focinfi/oncekv/config"
 	"github.com/Focinfi/oncekv/log"
@@ -18,8 +24,33 @@ import (
 
 const (
 	logPrefix      = "client:"
-	dbGetURLFormat = "%s/key/%s"
-	dbPutURLFormat = "%s/key"
+	dbGetURLFormat = "%s/i/key/%s?consistency=%s"
+
+	cacheGetURLFormat = "%s/key/%s"
+	dbPutURLFormat    = "%s/key"
+	dbPutRawURLFormat = "%s/key/%s?%s"
+	dbPutCASURLFormat = "%s/cas?%s"
+
+	dbPutBatchURLFormat = "%s/keys"
+
+	// leaderHeader carries the HTTP address of the database leader in the
+	// responses of the databases
+	leaderHeader = "X-Oncekv-Leader"
+
+	// response codes of the database nodes
+	codeOK           = 1000
+	codeKeyDuplicate = 1003
+	codeNotLeader    = 1005
+	codeBatchAborted = 1006
+	codeKeyExists    = 1007
+	codeTooLarge     = 1009
+	codeNoNamespace  = 1010
+	codeUnauthorized = 1011
+	codeHashMismatch = 1012
+
+	// encodingBase64 marks a value encoded in base64 in a JSON body, the
+	// values which are not valid UTF-8 are encoded so
+	encodingBase64 = "base64"
 )
 
 var (
@@ -30,28 +61,199 @@ var (
 
 	// ErrTimeout for timeout
 	ErrTimeout = fmt.Errorf("%s timeout", logPrefix)
+
+	// ErrKeyExists for putting a key which has been put with the same value
+	ErrKeyExists = fmt.Errorf("%s key exists", logPrefix)
+
+	// ErrKeyConflict for putting a key which has been put with a different value
+	ErrKeyConflict = fmt.Errorf("%s key conflict", logPrefix)
+
+	// ErrNotLeader for a write rejected by a database node not being the leader
+	ErrNotLeader = fmt.Errorf("%s not leader", logPrefix)
+
+	// ErrBatchAborted for a pair not put because the atomic batch failed
+	ErrBatchAborted = fmt.Errorf("%s batch aborted", logPrefix)
+
+	// ErrValueTooLarge for putting a value larger than the max value size
+	// of the databases
+	ErrValueTooLarge = fmt.Errorf("%s value too large", logPrefix)
+
+	// ErrNamespaceNotFound for accessing a namespace not created
+	ErrNamespaceNotFound = fmt.Errorf("%s namespace not found", logPrefix)
+
+	// ErrUnauthorized for a token not granting the access to a namespace
+	ErrUnauthorized = fmt.Errorf("%s unauthorized", logPrefix)
+
+	// ErrNotObject for getting an object of a key not holding a manifest
+	ErrNotObject = fmt.Errorf("%s not an object", logPrefix)
+
+	// ErrHashMismatch for a content-addressed key not matching its value
+	ErrHashMismatch = fmt.Errorf("%s hash mismatch", logPrefix)
 )
 
 var defaultGetter = mock.HTTPGetter(mock.HTTPGetterFunc(http.Get))
 var defaultPoster = mock.HTTPPoster(mock.HTTPPosterFunc(http.Post))
+var defaultDoer = mock.HTTPDoer(http.DefaultClient)
+
+// Consistency for the consistency level of reading the databases
+type Consistency string
+
+const (
+	// ConsistencyLinearizable reads on the leader confirming its leadership
+	// with a quorum, a read never misses a completed write
+	ConsistencyLinearizable Consistency = "linearizable"
+	// ConsistencyLeader reads on the node believing it is the leader
+	ConsistencyLeader Consistency = "leader"
+	// ConsistencyStale reads on any database node
+	ConsistencyStale Consistency = "stale"
+)
 
 // Option for Client option
 type Option struct {
 	RequestTimeout        time.Duration
 	IdealResponseDuration time.Duration
+	// Writer is an optional label kept with the keys put by the KV
+	Writer string
+	// Consistency of reading the databases on cache misses, the empty level
+	// is ConsistencyLinearizable. The caches only hold committed keys, a
+	// cache hit is valid at any level.
+	Consistency Consistency
+	// ChunkSize is the size of the chunks of the objects put by PutObject,
+	// 512KB by default, it must not be larger than the max value size of
+	// the databases
+	ChunkSize int64
 }
 
 // KV for kv storage
 type KV struct {
 	cli    *client
 	option *Option
+
+	// raft index of the latest write
+	tokenMux  sync.Mutex
+	lastIndex uint64
+
+	// namespace of the keys, and its access token
+	namespace   string
+	accessToken string
 }
 
 type kvParams struct {
-	Key     string `json:"key,omitempty"`
-	Value   string `json:"value,omitempty"`
-	Code    int    `json:"code,omitempty"`
-	Message string `json:"message,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Value     string `json:"value,omitempty"`
+	Encoding  string `json:"encoding,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Writer    string `json:"writer,omitempty"`
+	TTL       string `json:"ttl,omitempty"`
+	Index     uint64 `json:"index,omitempty"`
+	Code      int    `json:"code,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// PutResult for the result of a put
+type PutResult struct {
+	// RequestID of the put holding the key, which is the winner's on
+	// ErrKeyConflict
+	RequestID string
+	// Token for reading the put
+	Token Token
+}
+
+// Meta for the metadata of a key
+type Meta struct {
+	// Index and Term of the raft log entry which committed the key
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	// Timestamp assigned by the database leader
+	Timestamp time.Time `json:"timestamp"`
+	// Writer label and request ID of the put
+	Writer    string `json:"writer,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// ContentType given by PutBytes
+	ContentType string `json:"content_type,omitempty"`
+	// ExpiresAt of a key put by PutWithTTL, zero if it never expires
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// record for the response of getting a key
+type record struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+	Meta
+}
+
+// Pair for a key/value pair of a batch
+type Pair struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type pairParams struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type batchParams struct {
+	Atomic    bool         `json:"atomic"`
+	Pairs     []pairParams `json:"pairs"`
+	RequestID string       `json:"request_id,omitempty"`
+	Writer    string       `json:"writer,omitempty"`
+}
+
+// putResult for the outcome of a put
+type putResult struct {
+	PutResult
+	err error
+}
+
+type batchResp struct {
+	Code    int        `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+	Index   uint64     `json:"index,omitempty"`
+	Results []kvParams `json:"results,omitempty"`
+
+	// errs of every pair
+	errs []error
+}
+
+// writeFunc writes into the database of the url, err is not nil if the
+// database failed to handle the write
+type writeFunc func(url string) (res interface{}, duration time.Duration, err error)
+
+// errOfCode returns the error of the response code of a database node
+func errOfCode(code int, message string) error {
+	switch code {
+	case codeOK:
+		return nil
+	case codeKeyExists:
+		return ErrKeyExists
+	case codeKeyDuplicate:
+		return ErrKeyConflict
+	case codeNotLeader:
+		return ErrNotLeader
+	case codeBatchAborted:
+		return ErrBatchAborted
+	case codeTooLarge:
+		return ErrValueTooLarge
+	case codeNoNamespace:
+		return ErrNamespaceNotFound
+	case codeUnauthorized:
+		return ErrUnauthorized
+	case codeHashMismatch:
+		return ErrHashMismatch
+	default:
+		return fmt.Errorf("%s code: %d, message: %s", logPrefix, code, message)
+	}
+}
+
+// encodeValue returns value for a JSON body and its encoding
+func encodeValue(value string) (string, string) {
+	if utf8.ValidString(value) {
+		return value, ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(value)), encodingBase64
 }
 
 // DefaultKV returns a new KV with default option
@@ -78,39 +280,196 @@ func NewKV(option *Option) (*KV, error) {
 	return &KV{cli: cli, option: option}, nil
 }
 
+// Namespace returns a KV of the keys of the namespace name, created by
+// the admin, accessed with the token. It shares the nodes of kv.
+func (kv *KV) Namespace(name, token string) *KV {
+	return &KV{cli: kv.cli, option: kv.option, namespace: name, accessToken: token}
+}
+
+// baseURL returns the URL of the namespace of kv on the node addr
+func (kv *KV) baseURL(addr string) string {
+	if kv.namespace == "" {
+		return urlutil.MakeURL(addr)
+	}
+	return urlutil.MakeURL(addr) + "/ns/" + neturl.PathEscape(kv.namespace)
+}
+
+// withToken returns u with the access token of the namespace of kv
+func (kv *KV) withToken(u string) string {
+	if kv.accessToken == "" {
+		return u
+	}
+
+	sep := "?"
+	if strings.Contains(u, "?") {
+		sep = "&"
+	}
+	return u + sep + "token=" + neturl.QueryEscape(kv.accessToken)
+}
+
 // Get get the value of the key
 func (kv *KV) Get(key string) (string, error) {
-	val, err := kv.cache(key)
-	log.DB.Infoln(logPrefix, val, err)
+	return kv.GetWithToken(key, "")
+}
+
+// GetWithToken gets the value of the key, waiting for the write of token,
+// which may be issued by another KV
+func (kv *KV) GetWithToken(key string, token Token) (string, error) {
+	rec, err := kv.getRecord(key, kv.minIndex(token))
+	if err != nil {
+		return "", err
+	}
+
+	return rec.Value, nil
+}
+
+// GetWithMeta gets the value and the metadata of the key
+func (kv *KV) GetWithMeta(key string) (string, *Meta, error) {
+	rec, err := kv.getRecord(key, kv.minIndex(""))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return rec.Value, &rec.Meta, nil
+}
+
+// GetBytes gets the value and the metadata of the key, a value may be
+// empty
+func (kv *KV) GetBytes(key string) ([]byte, *Meta, error) {
+	rec, err := kv.getRecord(key, kv.minIndex(""))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return []byte(rec.Value), &rec.Meta, nil
+}
+
+// getRecord gets the record of the key from a node having applied minIndex
+func (kv *KV) getRecord(key string, minIndex uint64) (*record, error) {
+	rec, err := kv.cache(key, minIndex)
+	log.DB.Infoln(logPrefix, rec, err)
 
 	// believe cache, if cache alive, it can always right
 	if err == ErrDataNotFound {
-		return "", err
+		return nil, err
 	}
 
 	if err == nil {
-		return val, nil
+		return rec, nil
 	}
 
-	val, err = kv.get(key)
+	rec, err = kv.get(key, minIndex)
 	if err != nil {
 		log.DB.Error(logPrefix, err)
-		return "", err
+		return nil, err
 	}
 
-	return val, nil
+	return rec, nil
 }
 
-// Put put key/value pair
+// NewRequestID returns a random ID for a write
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Put put key/value pair, it returns ErrKeyExists if the key has been put
+// with the same value, ErrKeyConflict if the key has been put with a
+// different value, or ErrNotLeader if no database leader took the write.
+// Every attempt of the put carries the same request ID, so an attempt
+// committed before timing out is not taken as ErrKeyExists on the retry.
 func (kv *KV) Put(key string, value string) error {
+	_, err := kv.PutWithID(key, value, NewRequestID())
+	return err
+}
+
+// PutWithID puts key/value pair as the write of requestID, putting it again
+// with the same requestID and value succeeds. The result is also returned
+// with ErrKeyExists and ErrKeyConflict.
+func (kv *KV) PutWithID(key, value, requestID string) (*PutResult, error) {
+	return kv.put(key, value, requestID, 0)
+}
+
+// PutWithTTL puts key/value pair like Put, the key expires after ttl and
+// it can be put again then.
+func (kv *KV) PutWithTTL(key, value string, ttl time.Duration) (*PutResult, error) {
+	return kv.put(key, value, NewRequestID(), ttl)
+}
+
+// put puts key/value pair as the write of requestID, the key never expires
+// if ttl is 0
+func (kv *KV) put(key, value, requestID string, ttl time.Duration) (*PutResult, error) {
+	res, err := kv.write(func(url string) (interface{}, time.Duration, error) {
+		return kv.set(key, value, requestID, ttl, url)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := res.(*putResult)
+	kv.observe(result.Token.index())
+	return &result.PutResult, result.err
+}
+
+// PutBytes puts the value as it is with its media type, like PutWithID,
+// the value is sent as the raw body. The Meta of the key carries the
+// contentType.
+func (kv *KV) PutBytes(key string, value []byte, contentType, requestID string) (*PutResult, error) {
+	res, err := kv.write(func(url string) (interface{}, time.Duration, error) {
+		return kv.putRaw(key, value, contentType, requestID, url)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := res.(*putResult)
+	kv.observe(result.Token.index())
+	return &result.PutResult, result.err
+}
+
+// PutBatch puts the pairs in one raft log entry, and returns the result of
+// every pair in order, nil for a pair put. If atomic is set, no pair is put
+// when any of the keys exists, the existing keys get ErrKeyExists or
+// ErrKeyConflict and the others get ErrBatchAborted. Like Put, a retried
+// batch keeps its request ID.
+func (kv *KV) PutBatch(pairs []Pair, atomic bool) ([]error, error) {
+	requestID := NewRequestID()
+	res, err := kv.write(func(url string) (interface{}, time.Duration, error) {
+		return kv.setBatch(pairs, atomic, requestID, url)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := res.(*batchResp)
+	kv.observe(result.Index)
+	return result.errs, nil
+}
+
+// write runs w on the database leader, or on the fastDB if the leader is
+// not known yet, or on all the databases if it fails.
+func (kv *KV) write(w writeFunc) (interface{}, error) {
+	if leader := kv.cli.leader(); leader != "" {
+		res, _, err := w(leader)
+		if err != nil {
+			log.DB.Error(logPrefix, err)
+			kv.cli.dropLeaderDB(leader)
+			return kv.tryAllDBWrite(w)
+		}
+		return res, nil
+	}
+
 	if kv.cli.fastDB == "" {
-		return kv.tryAllDBSet(key, value)
+		return kv.tryAllDBWrite(w)
 	}
 
-	duration, err := kv.set(key, value, kv.cli.fastDB)
+	res, duration, err := w(kv.cli.fastDB)
 	if err != nil {
 		log.DB.Error(logPrefix, err)
-		return kv.tryAllDBSet(key, value)
+		return kv.tryAllDBWrite(w)
 	}
 
 	if duration > idealResponseDuration {
@@ -118,80 +477,79 @@ func (kv *KV) Put(key string, value string) error {
 		go func() { kv.cli.setFastDB("") }()
 	}
 
-	return nil
+	return res, nil
 }
 
-func (kv *KV) cache(key string) (string, error) {
+func (kv *KV) cache(key string, minIndex uint64) (*record, error) {
 	url := kv.cli.fastCache
 	if url == "" {
-		return kv.tryAllCaches(key)
+		return kv.tryAllCaches(key, minIndex)
 	}
 
-	val, _, err := kv.find(key, url, idealResponseDuration)
+	rec, _, err := kv.find(key, kv.cacheGetURL(url, key, minIndex), idealResponseDuration)
 	if err == ErrDataNotFound {
-		return "", err
+		return nil, err
 	}
 
 	if err != nil {
-		return kv.tryAllCaches(key)
+		return kv.tryAllCaches(key, minIndex)
 	}
 
-	return val, err
+	return rec, err
 }
 
-func (kv *KV) get(key string) (string, error) {
-	if kv.cli.fastDB == "" {
-		return kv.tryAllDBFind(key)
+// get reads the databases in turn, every replica serves the keys it holds
+// and forwards the misses to the leader, so the reads do not move the
+// fastDB, which is kept for the writes.
+func (kv *KV) get(key string, minIndex uint64) (*record, error) {
+	db := kv.cli.nextDB()
+	if db == "" {
+		return kv.tryAllDBFind(key, minIndex)
 	}
 
-	val, duration, err := kv.find(key, kv.cli.fastDB, requestTimeout)
+	rec, _, err := kv.find(key, kv.dbGetURL(db, key, minIndex), requestTimeout)
 	if err == ErrDataNotFound {
-		return "", err
+		return nil, err
 	}
 
 	if err != nil {
 		log.DB.Error(logPrefix, err)
-		return kv.tryAllDBFind(key)
-	}
-
-	if duration > idealResponseDuration {
-		go func() { kv.cli.setFastDB("") }()
+		return kv.tryAllDBFind(key, minIndex)
 	}
 
-	return val, nil
+	return rec, nil
 }
 
-func (kv *KV) tryAllDBFind(key string) (string, error) {
+func (kv *KV) tryAllDBFind(key string, minIndex uint64) (*record, error) {
 	dbs := make([]string, len(kv.cli.dbs))
 	copy(dbs, kv.cli.dbs)
 	log.Biz.Infoln(logPrefix, "start get:", time.Now(), dbs)
 	if len(dbs) == 0 {
-		return "", fmt.Errorf("%s databases are not available\n", logPrefix)
+		return nil, fmt.Errorf("%s databases are not available\n", logPrefix)
 	}
 
 	var got bool
 	var mux sync.Mutex
-	var data = make(chan string)
+	var data = make(chan *record)
 	var completeCount int
-	var fastURL string
 	var resErr error
 
 	for i, db := range dbs {
 		go func(index int, url string) {
-			val, _, err := kv.find(key, url, requestTimeout)
+			rec, _, err := kv.find(key, kv.dbGetURL(url, key, minIndex), requestTimeout)
 			if err != nil {
 				log.DB.Error(logPrefix, err)
 			}
 
 			mux.Lock()
 			defer mux.Unlock()
-			if val != "" || err == ErrDataNotFound || completeCount == len(dbs) {
+			completeCount++
+			if rec != nil || err == ErrDataNotFound || completeCount == len(dbs) {
 				if !got {
 					got = true
-					fastURL = url
 					resErr = err
 
-					go func() { data <- val }()
+					go func() { data <- rec }()
 				}
 			}
 		}(i, db)
@@ -199,39 +557,36 @@ func (kv *KV) tryAllDBFind(key string) (string, error) {
 
 	select {
 	case <-time.After(requestTimeout):
-		go kv.cli.setFastDB("")
-		return "", ErrTimeout
+		return nil, ErrTimeout
 
-	case value := <-data:
+	case rec := <-data:
 		log.Biz.Infoln(logPrefix, "end get:", time.Now())
-
-		if value != "" || resErr == ErrDataNotFound {
-			go kv.cli.setFastDB(fastURL)
-		}
-
-		return value, resErr
+		return rec, resErr
 	}
 }
 
-func (kv *KV) tryAllDBSet(key string, value string) error {
+func (kv *KV) tryAllDBWrite(w writeFunc) (interface{}, error) {
 	dbs := make([]string, len(kv.cli.dbs))
 	copy(dbs, kv.cli.dbs)
-	log.Biz.Infoln(logPrefix, "start tryAllDBSet:", time.Now(), dbs)
+	log.Biz.Infoln(logPrefix, "start tryAllDBWrite:", time.Now(), dbs)
 	if len(dbs) == 0 {
-		return fmt.Errorf("%s db unavailable", logPrefix)
+		return nil, fmt.Errorf("%s db unavailable", logPrefix)
 	}
 
 	var mux sync.Mutex
 	var fetched bool
 	var fastURL string
 	var completeCount int
-	var err error
 
-	var result = make(chan error)
+	type writeResult struct {
+		res interface{}
+		err error
+	}
+	var result = make(chan writeResult)
 
 	for i, db := range dbs {
 		go func(index int, url string) {
-			_, err = kv.set(key, value, url)
+			res, _, err := w(url)
 
 			if err != nil {
 				log.DB.Error(logPrefix, err)
@@ -245,7 +600,7 @@ func (kv *KV) tryAllDBSet(key string, value string) error {
 				if !fetched {
 					fetched = true
 					fastURL = url
-					go func() { result <- err }()
+					go func() { result <- writeResult{res: res, err: err} }()
 				}
 			}
 		}(i, db)
@@ -254,70 +609,214 @@ func (kv *KV) tryAllDBSet(key string, value string) error {
 	select {
 	case <-time.After(requestTimeout):
 		go func() { kv.cli.setFastDB("") }()
-		return ErrTimeout
+		return nil, ErrTimeout
 	case res := <-result:
-		log.Biz.Infoln(logPrefix, "end tryAllDBSet:", time.Now())
+		log.Biz.Infoln(logPrefix, "end tryAllDBWrite:", time.Now())
 
-		if res == nil {
+		if res.err == nil {
 			go kv.cli.setFastDB(fastURL)
 		}
 
-		return res
+		return res.res, res.err
+	}
+}
+
+// observeLeader keeps the leader of the response of a database for the
+// writes.
+func (kv *KV) observeLeader(httpRes *http.Response) {
+	if leader := httpRes.Header.Get(leaderHeader); leader != "" && leader != kv.cli.leader() {
+		kv.cli.setLeaderDB(leader)
 	}
 }
 
-func (kv *KV) set(key string, value string, url string) (time.Duration, error) {
+// set returns the outcome of the write as res, a *putResult with a nil err
+// or ErrKeyExists or ErrKeyConflict, or err if the database failed to
+// handle it
+func (kv *KV) set(key, value, requestID string, ttl time.Duration, url string) (res interface{}, duration time.Duration, err error) {
 	log.Biz.Debugln(logPrefix, "put: ", key, value, url)
 	begin := time.Now()
-	b, err := json.Marshal(&kvParams{Key: key, Value: value})
+	params := &kvParams{Key: key, RequestID: requestID, Writer: kv.option.Writer}
+	if ttl > 0 {
+		params.TTL = ttl.String()
+	}
+	params.Value, params.Encoding = encodeValue(value)
+	b, err := json.Marshal(params)
 	if err != nil {
-		return requestTimeout, err
+		return nil, requestTimeout, err
 	}
 
-	res, err := defaultPoster.Post(fmt.Sprintf(dbPutURLFormat, urlutil.MakeURL(url)), "application-type/json", bytes.NewReader(b))
+	httpRes, err := defaultPoster.Post(kv.withToken(fmt.Sprintf(dbPutURLFormat, kv.baseURL(url))), "application-type/json", bytes.NewReader(b))
 	if err != nil {
-		return requestTimeout, err
+		return nil, requestTimeout, err
+	}
+	return kv.putResultOf(httpRes, begin, url, key)
+}
+
+// putRaw puts the value as the body of PUT /key/:key, see set
+func (kv *KV) putRaw(key string, value []byte, contentType, requestID, url string) (res interface{}, duration time.Duration, err error) {
+	log.Biz.Debugln(logPrefix, "put raw: ", key, len(value), url)
+	putURL := fmt.Sprintf(dbPutRawURLFormat, kv.baseURL(url), neturl.PathEscape(key), kv.rawQuery(requestID))
+	return kv.sendRaw(http.MethodPut, putURL, key, value, contentType, url)
+}
+
+// rawQuery returns the query of a write sending the value as the body
+func (kv *KV) rawQuery(requestID string) string {
+	query := neturl.Values{}
+	query.Set("request_id", requestID)
+	if kv.option.Writer != "" {
+		query.Set("writer", kv.option.Writer)
+	}
+
+	if kv.accessToken != "" {
+		query.Set("token", kv.accessToken)
+	}
+	return query.Encode()
+}
+
+// sendRaw sends the value of the key as the body to the writeURL of the
+// database of the url, see set
+func (kv *KV) sendRaw(method, writeURL, key string, value []byte, contentType, url string) (res interface{}, duration time.Duration, err error) {
+	begin := time.Now()
+	req, err := http.NewRequest(method, writeURL, bytes.NewReader(value))
+	if err != nil {
+		return nil, requestTimeout, err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	httpRes, err := defaultDoer.Do(req)
+	if err != nil {
+		return nil, requestTimeout, err
+	}
+	return kv.putResultOf(httpRes, begin, url, key)
+}
+
+// putResultOf returns the outcome of a put from the response of the
+// database, see set
+func (kv *KV) putResultOf(httpRes *http.Response, begin time.Time, url, key string) (res interface{}, duration time.Duration, err error) {
+	defer httpRes.Body.Close()
+	kv.observeLeader(httpRes)
+
+	resp := &kvParams{}
+	if err := json.NewDecoder(httpRes.Body).Decode(resp); err != nil {
+		return nil, requestTimeout, fmt.Errorf("%s failed to set kv(url: %s), key: %s, err: %v\n", logPrefix, url, key, err)
+	}
+
+	outcome := errOfCode(resp.Code, resp.Message)
+	if httpRes.StatusCode != http.StatusOK || outcome == ErrNotLeader {
+		if outcome == nil {
+			outcome = fmt.Errorf("%s failed to set kv(url: %s), key: %s, status code: %d\n", logPrefix, url, key, httpRes.StatusCode)
+		}
+		return nil, requestTimeout, outcome
+	}
+
+	switch outcome {
+	case nil, ErrKeyExists, ErrKeyConflict:
+		result := &putResult{PutResult: PutResult{RequestID: resp.RequestID, Token: tokenOf(resp.Index)}, err: outcome}
+		return result, time.Now().Sub(begin), nil
+	default:
+		return nil, requestTimeout, outcome
+	}
+}
+
+func (kv *KV) setBatch(pairs []Pair, atomic bool, requestID, url string) (*batchResp, time.Duration, error) {
+	log.Biz.Debugln(logPrefix, "put batch: ", len(pairs), url)
+	begin := time.Now()
+	params := &batchParams{Atomic: atomic, Pairs: make([]pairParams, len(pairs)), RequestID: requestID, Writer: kv.option.Writer}
+	for i, pair := range pairs {
+		params.Pairs[i].Key = pair.Key
+		params.Pairs[i].Value, params.Pairs[i].Encoding = encodeValue(pair.Value)
+	}
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, requestTimeout, err
+	}
+
+	res, err := defaultPoster.Post(kv.withToken(fmt.Sprintf(dbPutBatchURLFormat, kv.baseURL(url))), "application-type/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, requestTimeout, err
 	}
 	defer res.Body.Close()
+	kv.observeLeader(res)
 
-	if res.StatusCode != http.StatusOK {
-		return requestTimeout, fmt.Errorf("%s failed to set kv(url: %s), key: %s, value: %v\n", logPrefix, url, key, value)
+	resp := &batchResp{}
+	if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
+		return nil, requestTimeout, err
+	}
+	if resp.Code == codeNotLeader {
+		return nil, requestTimeout, ErrNotLeader
+	}
+	if resp.Code == codeTooLarge {
+		return nil, requestTimeout, ErrValueTooLarge
+	}
+	if res.StatusCode != http.StatusOK || len(resp.Results) != len(pairs) {
+		return nil, requestTimeout, fmt.Errorf("%s failed to set batch(url: %s), code: %d, message: %s\n", logPrefix, url, resp.Code, resp.Message)
 	}
 
-	return time.Now().Sub(begin), nil
+	resp.errs = make([]error, len(pairs))
+	for i, result := range resp.Results {
+		resp.errs[i] = errOfCode(result.Code, result.Message)
+	}
+
+	return resp, time.Now().Sub(begin), nil
 }
 
-func (kv *KV) parseData(readCloser io.ReadCloser, key string) (string, error) {
+func (kv *KV) parseData(readCloser io.ReadCloser, key string) (*record, error) {
 	b, err := ioutil.ReadAll(readCloser)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	log.DB.Infoln("Message Resp:", string(b))
 
-	param := &kvParams{}
-	if err := json.Unmarshal(b, param); err != nil {
-		return "", err
+	rec := &record{}
+	if err := json.Unmarshal(b, rec); err != nil {
+		return nil, err
 	}
 
-	if param.Key != key {
-		return "", fmt.Errorf("%s wrong response for key='%s'\n", logPrefix, key)
+	if rec.Key != key {
+		return nil, fmt.Errorf("%s wrong response for key='%s'\n", logPrefix, key)
 	}
 
-	if param.Value == "" {
-		return "", fmt.Errorf("%s empty value response for key = '%s'\n", logPrefix, key)
+	if rec.Encoding == encodingBase64 {
+		value, err := base64.StdEncoding.DecodeString(rec.Value)
+		if err != nil {
+			return nil, err
+		}
+		rec.Value, rec.Encoding = string(value), ""
+	}
+
+	return rec, nil
+}
+
+func (kv *KV) dbGetURL(url string, key string, minIndex uint64) string {
+	consistency := kv.option.Consistency
+	if consistency == "" {
+		consistency = ConsistencyLinearizable
 	}
 
-	return param.Value, nil
+	getURL := fmt.Sprintf(dbGetURLFormat, kv.baseURL(url), neturl.PathEscape(key), consistency)
+	if minIndex > 0 {
+		getURL += fmt.Sprintf("&min_index=%d", minIndex)
+	}
+	return kv.withToken(getURL)
+}
+
+func (kv *KV) cacheGetURL(url string, key string, minIndex uint64) string {
+	getURL := fmt.Sprintf(cacheGetURLFormat, kv.baseURL(url), neturl.PathEscape(key))
+	if minIndex > 0 {
+		getURL += fmt.Sprintf("?min_index=%d", minIndex)
+	}
+	return kv.withToken(getURL)
 }
 
-func (kv *KV) find(key string, url string, timeout time.Duration) (value string, duration time.Duration, err error) {
+// find gets the key from getURL of a cache or a database
+func (kv *KV) find(key string, getURL string, timeout time.Duration) (rec *record, duration time.Duration, err error) {
 	begin := time.Now()
 	resChan := make(chan *http.Response)
 	errChan := make(chan error)
 
 	go func() {
-		res, err := defaultGetter.Get(fmt.Sprintf(dbGetURLFormat, urlutil.MakeURL(url), key))
+		res, err := defaultGetter.Get(getURL)
 		if err != nil {
 			errChan <- err
 			return
@@ -328,46 +827,47 @@ func (kv *KV) find(key string, url string, timeout time.Duration) (value string,
 
 	select {
 	case <-time.After(timeout):
-		return "", requestTimeout, ErrTimeout
+		return nil, requestTimeout, ErrTimeout
 
 	case err := <-errChan:
 		log.DB.Errorln(logPrefix, "find:", err)
-		return "", requestTimeout, err
+		return nil, requestTimeout, err
 
 	case res := <-resChan:
 		defer res.Body.Close()
+		kv.observeLeader(res)
 		duration = time.Now().Sub(begin)
 
 		if res.StatusCode == http.StatusNotFound {
-			return "", duration, ErrDataNotFound
+			return nil, duration, ErrDataNotFound
 		}
 
 		if res.StatusCode == http.StatusOK {
-			val, err := kv.parseData(res.Body, key)
+			rec, err := kv.parseData(res.Body, key)
 			if err == nil {
-				return val, duration, nil
+				return rec, duration, nil
 			}
 
 			log.Biz.Errorln(logPrefix, "find/parseData error:", err)
-			return "", requestTimeout, err
+			return nil, requestTimeout, err
 		}
 
-		return "", requestTimeout, ErrTimeout
+		return nil, requestTimeout, ErrTimeout
 	}
 }
 
 // try all caching urls, set the fastCache
-func (kv *KV) tryAllCaches(key string) (string, error) {
+func (kv *KV) tryAllCaches(key string, minIndex uint64) (*record, error) {
 	caches := make([]string, len(kv.cli.caches))
 	copy(caches, kv.cli.caches)
 	log.Biz.Infoln(logPrefix, "start tryAllCaches:", time.Now(), caches)
 	if len(caches) == 0 {
-		return "", fmt.Errorf("%s caches are unavailable ", logPrefix)
+		return nil, fmt.Errorf("%s caches are unavailable ", logPrefix)
 	}
 
 	var fetched bool
 	var mux sync.Mutex
-	var data = make(chan string)
+	var data = make(chan *record)
 	var completeCount int
 	var fastURL string
 	var minDuration = requestTimeout
@@ -376,8 +876,8 @@ func (kv *KV) tryAllCaches(key string) (string, error) {
 
 	for i, cache := range caches {
 		go func(index int, url string) {
-			val, duration, err := kv.find(key, url, requestTimeout)
-			log.DB.Infoln(logPrefix, key, url, val, duration, err)
+			rec, duration, err := kv.find(key, kv.cacheGetURL(url, key, minIndex), requestTimeout)
+			log.DB.Infoln(logPrefix, key, url, rec, duration, err)
 			if err != nil {
 				log.DB.Error(err)
 			}
@@ -399,16 +899,16 @@ func (kv *KV) tryAllCaches(key string) (string, error) {
 				if !fetched {
 					fetched = true
 					resErr = err
-					go func() { data <- val }()
+					go func() { data <- rec }()
 				}
 				return
 			}
 
-			if val != "" || err == ErrDataNotFound {
+			if rec != nil || err == ErrDataNotFound {
 				if !fetched {
 					fetched = true
 					resErr = err
-					go func() { data <- val }()
+					go func() { data <- rec }()
 				}
 			}
 		}(i, cache)
@@ -423,10 +923,10 @@ func (kv *KV) tryAllCaches(key string) (string, error) {
 
 	select {
 	case <-time.After(requestTimeout):
-		return "", ErrTimeout
+		return nil, ErrTimeout
 
-	case value := <-data:
+	case rec := <-data:
 		log.Biz.Println(logPrefix, "end tryAllCaches:", time.Now())
-		return value, resErr
+		return rec, resErr
 	}
 }
@@ -1,11 +1,21 @@
 package client
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/Focinfi/oncekv/utils/mock"
+	"github.com/Focinfi/oncekv/utils/object"
 )
 
 func defaultGetterCluster() mock.HTTPGetter {
@@ -31,7 +41,7 @@ func defaultPosterCluster() mock.HTTPPoster {
 	for i, db := range dbs {
 		delay := idealResponseDuration * time.Duration(i%2)
 		fmt.Printf("%s delay=%v\n", db, delay)
-		poster := mock.MakeHTTPPoster(db, "", nil, delay)
+		poster := mock.MakeHTTPPoster(db, `{"Code":1000}`, nil, delay)
 		host := mock.HostOfURL(db)
 		cluster[host] = poster
 	}
@@ -68,7 +78,7 @@ func TestCache(t *testing.T) {
 	setDefaultMockHTTP()
 
 	kv, _ := DefaultKV()
-	_, err := kv.cache("foo")
+	_, err := kv.cache("foo", 0)
 	if err != nil {
 		t.Fatal("can not fetch data from cache, err:", err)
 	}
@@ -82,7 +92,7 @@ func TestCache(t *testing.T) {
 	// test fastCache
 	respErr := make(chan error)
 	go func() {
-		_, err = kv.cache("foo")
+		_, err = kv.cache("foo", 0)
 		respErr <- err
 	}()
 
@@ -101,32 +111,19 @@ func TestGet(t *testing.T) {
 	setDefaultMockHTTP()
 
 	kv, _ := DefaultKV()
-	_, err := kv.get("foo")
-	if err != nil {
-		t.Fatal(err)
+	for i := 0; i < len(dbs); i++ {
+		if _, err := kv.get("foo", 0); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	//wait
-	time.Sleep(requestTimeout)
-
-	if kv.cli.fastDB != dbs[0] {
-		t.Errorf("can not set fastDB, expect %s, got %s\n", dbs[0], kv.cli.fastDB)
+	// reads are spread across the databases and keep the fastDB for writes
+	if kv.cli.fastDB != "" {
+		t.Errorf("set fastDB by reading: %s\n", kv.cli.fastDB)
 	}
 
-	// test fastDB
-	respErr := make(chan error)
-	go func() {
-		_, err = kv.get("foo")
-		respErr <- err
-	}()
-
-	select {
-	case <-time.After(time.Millisecond):
-		t.Error("can not use fastDB")
-	case err := <-respErr:
-		if err != nil {
-			t.Fatal("can not fetch data from db, err:", err)
-		}
+	if first, second := kv.cli.nextDB(), kv.cli.nextDB(); first == second {
+		t.Errorf("failed to spread the reads, got %s twice\n", first)
 	}
 }
 
@@ -163,3 +160,425 @@ func TestPut(t *testing.T) {
 		}
 	}
 }
+
+func TestPutToLeader(t *testing.T) {
+	setDefaultMockCacheAndDB()
+	var mux sync.Mutex
+	posts := map[string]int{}
+	leaderDown := false
+	defaultPoster = mock.HTTPPosterFunc(func(url string, contentType string, body io.Reader) (*http.Response, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		host := mock.HostOfURL(url)
+		posts[host]++
+		if leaderDown && host == mock.HostOfURL(dbs[1]) {
+			return nil, fmt.Errorf("%s down", host)
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{leaderHeader: []string{mock.HostOfURL(dbs[1])}},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"Code":1000}`)),
+		}, nil
+	})
+	postsOf := func(db string) int {
+		mux.Lock()
+		defer mux.Unlock()
+		return posts[mock.HostOfURL(db)]
+	}
+
+	kv, _ := DefaultKV()
+	if err := kv.Put("foo1", "bar1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if kv.cli.leader() != mock.HostOfURL(dbs[1]) {
+		t.Fatalf("failed to keep the leader of the responses, got: %q\n", kv.cli.leader())
+	}
+
+	// the writes go to the leader only
+	before := postsOf(dbs[0])
+	for i := 0; i < 3; i++ {
+		if err := kv.Put(fmt.Sprintf("foo%d", i+2), "bar"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if postsOf(dbs[0]) != before {
+		t.Errorf("expect the writes sent to the leader only, got %d writes on %s\n", postsOf(dbs[0])-before, dbs[0])
+	}
+
+	// a write failing on the leader is sent to all the databases
+	mux.Lock()
+	leaderDown = true
+	mux.Unlock()
+	if err := kv.Put("foo5", "bar5"); err != nil {
+		t.Fatal(err)
+	}
+	if postsOf(dbs[0]) != before+1 {
+		t.Errorf("expect the write failing on the leader sent to %s\n", dbs[0])
+	}
+}
+
+func TestPutBatch(t *testing.T) {
+	setDefaultMockCacheAndDB()
+	setDefaultMockHTTP()
+	resp := `{"Code":1000,"results":[{"key":"foo","Code":1000},{"key":"bar","Code":1003},{"key":"baz","Code":1007}]}`
+	posters := map[string]mock.HTTPPoster{}
+	for _, db := range dbs {
+		posters[mock.HostOfURL(db)] = mock.MakeHTTPPoster(db, resp, nil, 0)
+	}
+	defaultPoster = mock.HTTPPosterCluster(posters)
+
+	kv, _ := DefaultKV()
+	errs, err := kv.PutBatch([]Pair{{Key: "foo", Value: "1"}, {Key: "bar", Value: "2"}, {Key: "baz", Value: "3"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(errs) != 3 || errs[0] != nil || errs[1] != ErrKeyConflict || errs[2] != ErrKeyExists {
+		t.Errorf("failed to parse the results, got: %v", errs)
+	}
+}
+
+func TestPutWithID(t *testing.T) {
+	setDefaultMockCacheAndDB()
+	resp := `{"Code":1003,"Message":"key duplicate","request_id":"winner"}`
+	posters := map[string]mock.HTTPPoster{}
+	for _, db := range dbs {
+		posters[mock.HostOfURL(db)] = mock.MakeHTTPPoster(db, resp, nil, 0)
+	}
+	defaultPoster = mock.HTTPPosterCluster(posters)
+
+	kv, _ := DefaultKV()
+	res, err := kv.PutWithID("foo", "bar", "loser")
+	if err != ErrKeyConflict || res.RequestID != "winner" {
+		t.Errorf("failed to parse the conflict, got: %v, %v", res, err)
+	}
+}
+
+func TestPutWithTTL(t *testing.T) {
+	setDefaultMockCacheAndDB()
+	var params kvParams
+	defaultPoster = mock.HTTPPosterFunc(func(url string, contentType string, body io.Reader) (*http.Response, error) {
+		if err := json.NewDecoder(body).Decode(&params); err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(`{"Code":1000}`))}, nil
+	})
+
+	kv, _ := DefaultKV()
+	if _, err := kv.PutWithTTL("foo", "bar", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if params.TTL != "1h0m0s" || params.RequestID == "" {
+		t.Errorf("failed to send the ttl, got: %#v", params)
+	}
+}
+
+func TestGetWithMeta(t *testing.T) {
+	setDefaultMockCacheAndDB()
+	resp := `{"key":"foo","value":"bar","index":7,"term":2,"timestamp":"2017-01-02T03:04:05Z","writer":"w","expires_at":"2017-01-02T04:04:05Z"}`
+	getters := map[string]mock.HTTPGetter{}
+	for _, server := range append(append([]string{}, caches...), dbs...) {
+		getters[mock.HostOfURL(server)] = mock.MakeHTTPGetter(server, resp, nil, 0)
+	}
+	defaultGetter = mock.HTTPGetterCluster(getters)
+
+	kv, _ := DefaultKV()
+	value, meta, err := kv.GetWithMeta("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamp := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	if value != "bar" || meta.Index != 7 || meta.Term != 2 || !meta.Timestamp.Equal(timestamp) || meta.Writer != "w" || !meta.ExpiresAt.Equal(timestamp.Add(time.Hour)) {
+		t.Errorf("failed to parse the metadata, got: %s, %#v", value, meta)
+	}
+}
+
+func TestDBGetURL(t *testing.T) {
+	setDefaultMockCacheAndDB()
+
+	kv, _ := DefaultKV()
+	if url := kv.dbGetURL("127.0.0.1:5550", "foo", 0); url != "http://127.0.0.1:5550/i/key/foo?consistency=linearizable" {
+		t.Errorf("wrong default db url: %s", url)
+	}
+
+	kv, _ = NewKV(&Option{Consistency: ConsistencyStale})
+	if url := kv.dbGetURL("127.0.0.1:5550", "foo", 7); url != "http://127.0.0.1:5550/i/key/foo?consistency=stale&min_index=7" {
+		t.Errorf("wrong stale db url: %s", url)
+	}
+
+	if url := kv.dbGetURL("127.0.0.1:5550", "app/1.2.3/file", 0); url != "http://127.0.0.1:5550/i/key/app%2F1.2.3%2Ffile?consistency=stale" {
+		t.Errorf("wrong db url of a key with slashes: %s", url)
+	}
+}
+
+func TestToken(t *testing.T) {
+	setDefaultMockCacheAndDB()
+	resp := `{"Code":1000,"request_id":"r1","index":42}`
+	posters := map[string]mock.HTTPPoster{}
+	for _, db := range dbs {
+		posters[mock.HostOfURL(db)] = mock.MakeHTTPPoster(db, resp, nil, 0)
+	}
+	defaultPoster = mock.HTTPPosterCluster(posters)
+
+	kv, _ := DefaultKV()
+	if kv.Token() != "" {
+		t.Errorf("got a token before writing: %s", kv.Token())
+	}
+
+	res, err := kv.PutWithID("foo", "bar", "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Token != "42" || kv.Token() != "42" {
+		t.Errorf("failed to get the token, got: %s, %s", res.Token, kv.Token())
+	}
+
+	token, err := ParseToken(string(res.Token))
+	if err != nil || kv.minIndex(token) != 42 {
+		t.Errorf("failed to parse the token, got: %s, %v", token, err)
+	}
+	if kv.minIndex("43") != 43 {
+		t.Errorf("failed to wait for the newer token")
+	}
+	if _, err := ParseToken("x"); err == nil {
+		t.Errorf("failed to reject an invalid token")
+	}
+}
+
+func TestWaitGet(t *testing.T) {
+	setDefaultMockCacheAndDB()
+	defaultGetter = mock.HTTPGetterFunc(func(url string) (*http.Response, error) {
+		if strings.Contains(url, "/key/missing") || !strings.Contains(url, "wait=") {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(`{"key":"foo","value":"bar"}`))}, nil
+	})
+
+	kv, _ := DefaultKV()
+	value, err := kv.WaitGet(context.Background(), "foo")
+	if err != nil || value != "bar" {
+		t.Errorf("failed to wait for foo, got: %s, %v", value, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if _, err := kv.WaitGet(ctx, "missing"); err != context.DeadlineExceeded {
+		t.Errorf("failed to stop waiting when ctx is done, got: %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	setDefaultMockCacheAndDB()
+	keys := []string{"app/1.0.0/file", "app/1.2.3/file", "app/2.0.0/file"}
+	defaultGetter = mock.HTTPGetterFunc(func(getURL string) (*http.Response, error) {
+		u, err := url.Parse(getURL)
+		if err != nil {
+			return nil, err
+		}
+		query := u.Query()
+		if u.Path != "/keys" || query.Get("prefix") != "app/" || query.Get("limit") != "2" {
+			return &http.Response{StatusCode: http.StatusBadRequest, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+
+		body := `{"keys":["app/1.0.0/file","app/1.2.3/file"],"more":true}`
+		if query.Get("after") == "app/1.2.3/file" {
+			body = `{"keys":["app/2.0.0/file"],"more":false}`
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	})
+
+	kv, _ := DefaultKV()
+	cursor := kv.List(ListOptions{Prefix: "app/", PageSize: 2})
+	var got []string
+	for cursor.Next() {
+		got = append(got, cursor.Key())
+	}
+	if cursor.Err() != nil || fmt.Sprint(got) != fmt.Sprint(keys) {
+		t.Errorf("failed to list, expect: %v, got: %v, %v", keys, got, cursor.Err())
+	}
+}
+
+func TestPutBytes(t *testing.T) {
+	setDefaultMockCacheAndDB()
+	value := []byte{0, 0xff, 'x'}
+	defaultDoer = mock.HTTPDoerFunc(func(req *http.Request) (*http.Response, error) {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := `{"Code":1000,"request_id":"r1","index":3}`
+		status := http.StatusOK
+		if len(b) > len(value) {
+			resp, status = `{"Code":1009}`, http.StatusRequestEntityTooLarge
+		} else if req.Method != http.MethodPut || req.URL.Path != "/key/bin" ||
+			req.Header.Get("Content-Type") != "application/gzip" || !bytes.Equal(b, value) {
+			resp, status = `{"Code":1001}`, http.StatusBadRequest
+		}
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(resp))}, nil
+	})
+
+	kv, _ := DefaultKV()
+	res, err := kv.PutBytes("bin", value, "application/gzip", "r1")
+	if err != nil || res.Token != "3" {
+		t.Errorf("failed to put the raw value, got: %v, %v", res, err)
+	}
+	if _, err := kv.PutBytes("bin", []byte("large"), "application/gzip", "r2"); err != ErrValueTooLarge {
+		t.Errorf("expect ErrValueTooLarge, got: %v", err)
+	}
+
+	// values which are not valid UTF-8 come in base64
+	for resp, expect := range map[string][]byte{
+		`{"key":"bin","value":"AP94","encoding":"base64","content_type":"application/gzip"}`: value,
+		`{"key":"bin","value":""}`: {},
+	} {
+		getters := map[string]mock.HTTPGetter{}
+		for _, server := range append(append([]string{}, caches...), dbs...) {
+			getters[mock.HostOfURL(server)] = mock.MakeHTTPGetter(server, resp, nil, 0)
+		}
+		defaultGetter = mock.HTTPGetterCluster(getters)
+
+		got, _, err := kv.GetBytes("bin")
+		if err != nil || !bytes.Equal(got, expect) {
+			t.Errorf("failed to get the value from %s, got: %q, %v", resp, got, err)
+		}
+	}
+}
+
+func TestObject(t *testing.T) {
+	setDefaultMockCacheAndDB()
+	type stored struct {
+		value       []byte
+		contentType string
+	}
+	values := map[string]stored{}
+	var mux sync.Mutex
+	defaultDoer = mock.HTTPDoerFunc(func(req *http.Request) (*http.Response, error) {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		key := strings.TrimPrefix(req.URL.Path, "/key/")
+		mux.Lock()
+		defer mux.Unlock()
+		resp := `{"Code":1000,"index":1}`
+		if _, ok := values[key]; ok {
+			resp = `{"Code":1007}`
+		}
+		values[key] = stored{value: b, contentType: req.Header.Get("Content-Type")}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(resp))}, nil
+	})
+	defaultGetter = mock.HTTPGetterFunc(func(getURL string) (*http.Response, error) {
+		key := getURL[strings.LastIndex(getURL, "/key/")+len("/key/"):]
+		if i := strings.Index(key, "?"); i >= 0 {
+			key = key[:i]
+		}
+		mux.Lock()
+		v, ok := values[key]
+		mux.Unlock()
+		if !ok {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+		b, _ := json.Marshal(map[string]string{"key": key, "value": string(v.value), "content_type": v.contentType})
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(b))}, nil
+	})
+
+	kv, err := NewKV(&Option{RequestTimeout: requestTimeout, IdealResponseDuration: idealResponseDuration, ChunkSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := "0123456789abcdefghij0123"
+	if _, err := kv.PutObject("obj", strings.NewReader(data), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	// 6 chunks, the first one is shared by the last one
+	mux.Lock()
+	if len(values) != 6 {
+		t.Errorf("expect 5 chunks and the manifest, got %d keys", len(values))
+	}
+	mux.Unlock()
+	if _, err := kv.PutObject("obj", strings.NewReader(data), "text/plain"); err != ErrKeyExists {
+		t.Errorf("expect ErrKeyExists, got: %v", err)
+	}
+
+	r, m, err := kv.GetObject("obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Size != int64(len(data)) || m.ContentType != "text/plain" {
+		t.Errorf("failed to get the manifest, got: %v", m)
+	}
+	if _, err := r.Seek(10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil || string(b) != data[10:] {
+		t.Errorf("failed to read the object, got: %q, %v", b, err)
+	}
+
+	if _, _, err := kv.GetObject(object.ChunkKey(m.Chunks[0])); err != ErrNotObject {
+		t.Errorf("expect ErrNotObject, got: %v", err)
+	}
+}
+
+func TestContent(t *testing.T) {
+	setDefaultMockCacheAndDB()
+	var paths []string
+	defaultDoer = mock.HTTPDoerFunc(func(req *http.Request) (*http.Response, error) {
+		paths = append(paths, req.URL.Path)
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(`{"Code":1007}`))}, nil
+	})
+
+	kv, _ := DefaultKV()
+	key, _, err := kv.PutContent([]byte("hello"), "text/plain")
+	if err != nil || key != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" || len(paths) != 1 || paths[0] != "/cas" {
+		t.Errorf("failed to put the content, got: %s, %v, %v", key, err, paths)
+	}
+
+	for value, expect := range map[string]error{"hello": nil, "forged": ErrHashMismatch} {
+		defaultGetter = mock.HTTPGetterFunc(func(url string) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"key":%q,"value":%q}`, key, value)))}, nil
+		})
+		if _, _, err := kv.GetContent(key); err != expect {
+			t.Errorf("get %s, expect: %v, got: %v", value, expect, err)
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	setDefaultMockCacheAndDB()
+	defaultPoster = mock.HTTPPosterFunc(func(url string, contentType string, body io.Reader) (*http.Response, error) {
+		resp := `{"Code":1011}`
+		if strings.Contains(url, "/ns/team/key?token=t") {
+			resp = `{"Code":1000,"index":1}`
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(resp))}, nil
+	})
+	defaultGetter = mock.HTTPGetterFunc(func(url string) (*http.Response, error) {
+		value := "default"
+		if strings.Contains(url, "/ns/team/") && strings.Contains(url, "token=t") {
+			value = "team"
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(`{"key":"foo","value":"` + value + `"}`))}, nil
+	})
+
+	kv, _ := DefaultKV()
+	team := kv.Namespace("team", "t")
+	if err := team.Put("foo", "team"); err != nil {
+		t.Errorf("failed to put into the namespace: %v", err)
+	}
+	if val, err := team.Get("foo"); err != nil || val != "team" {
+		t.Errorf("failed to get from the namespace, got: %s, %v", val, err)
+	}
+	if val, err := kv.Get("foo"); err != nil || val != "default" {
+		t.Errorf("failed to get from the default namespace, got: %s, %v", val, err)
+	}
+
+	if err := kv.Namespace("team", "x").Put("foo", "team"); err != ErrUnauthorized {
+		t.Errorf("expect ErrUnauthorized, got: %v", err)
+	}
+}
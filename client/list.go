@@ -0,0 +1,165 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Focinfi/oncekv/log"
+)
+
+const (
+	dbListURLFormat = "%s/keys?%s"
+
+	// defaultListPageSize is the count of keys a Cursor fetches at once
+	defaultListPageSize = 100
+)
+
+// ListOptions selects the keys of a listing
+type ListOptions struct {
+	// Prefix limits the keys to the ones starting with it
+	Prefix string
+	// After and End limit the keys to the range (After, End), an empty
+	// bound leaves the range open on its side
+	After string
+	End   string
+	// PageSize is the count of keys fetched at once, 100 by default
+	PageSize int
+}
+
+type listResp struct {
+	Keys []string `json:"keys"`
+	More bool     `json:"more"`
+}
+
+// Cursor iterates over the keys of a listing in order, fetching them page
+// by page from the databases
+type Cursor struct {
+	kv   *KV
+	opts ListOptions
+
+	keys []string
+	key  string
+	more bool
+	err  error
+}
+
+// List returns a Cursor over the keys selected by opts
+func (kv *KV) List(opts ListOptions) *Cursor {
+	if opts.PageSize <= 0 {
+		opts.PageSize = defaultListPageSize
+	}
+	return &Cursor{kv: kv, opts: opts, more: true}
+}
+
+// Next moves the cursor to the next key, it returns false at the end of
+// the listing or on an error, see Err
+func (c *Cursor) Next() bool {
+	if len(c.keys) == 0 && c.more && c.err == nil {
+		var page *listResp
+		if page, c.err = c.kv.list(c.opts); c.err != nil {
+			return false
+		}
+		c.keys, c.more = page.Keys, page.More
+		if len(c.keys) > 0 {
+			c.opts.After = c.keys[len(c.keys)-1]
+		}
+	}
+
+	if len(c.keys) == 0 {
+		return false
+	}
+	c.key, c.keys = c.keys[0], c.keys[1:]
+	return true
+}
+
+// Key returns the current key
+func (c *Cursor) Key() string {
+	return c.key
+}
+
+// Err returns the error stopping the cursor
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// list fetches one page of the listing from a database, trying the others
+// if it fails
+func (kv *KV) list(opts ListOptions) (*listResp, error) {
+	dbs := make([]string, len(kv.cli.dbs))
+	copy(dbs, kv.cli.dbs)
+	if db := kv.cli.nextDB(); db != "" {
+		dbs = append([]string{db}, dbs...)
+	}
+
+	err := fmt.Errorf("%s databases are not available", logPrefix)
+	for _, db := range dbs {
+		var page *listResp
+		if page, err = kv.listPage(kv.dbListURL(db, opts)); err == nil {
+			return page, nil
+		}
+		log.DB.Error(logPrefix, err)
+	}
+	return nil, err
+}
+
+func (kv *KV) dbListURL(db string, opts ListOptions) string {
+	consistency := kv.option.Consistency
+	if consistency == "" {
+		consistency = ConsistencyLinearizable
+	}
+
+	query := url.Values{}
+	query.Set("consistency", string(consistency))
+	query.Set("limit", strconv.Itoa(opts.PageSize))
+	for name, value := range map[string]string{"prefix": opts.Prefix, "after": opts.After, "end": opts.End} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if minIndex := kv.minIndex(""); minIndex > 0 {
+		query.Set("min_index", strconv.FormatUint(minIndex, 10))
+	}
+	if kv.accessToken != "" {
+		query.Set("token", kv.accessToken)
+	}
+	return fmt.Sprintf(dbListURLFormat, kv.baseURL(db), query.Encode())
+}
+
+func (kv *KV) listPage(listURL string) (*listResp, error) {
+	resChan := make(chan *http.Response, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		res, err := defaultGetter.Get(listURL)
+		if err != nil {
+			errChan <- err
+			return
+		}
+
+		resChan <- res
+	}()
+
+	select {
+	case <-time.After(requestTimeout):
+		return nil, ErrTimeout
+
+	case err := <-errChan:
+		return nil, err
+
+	case res := <-resChan:
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s list failed, status code: %d", logPrefix, res.StatusCode)
+		}
+
+		page := &listResp{}
+		if err := json.NewDecoder(res.Body).Decode(page); err != nil {
+			return nil, err
+		}
+		return page, nil
+	}
+}
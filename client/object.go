@@ -0,0 +1,77 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/Focinfi/oncekv/utils/object"
+)
+
+// defaultChunkSize is the size of the chunks of an object by default
+const defaultChunkSize = 512 << 10
+
+// PutObject puts the content of r as an object of the key. The content is
+// split into chunks put as keys named after their hashes, then the key is
+// put with the manifest of the chunks, so the object appears only once all
+// of its chunks are put. The chunks already put by other objects are
+// shared. Like PutWithID, putting the same object again returns
+// ErrKeyExists.
+func (kv *KV) PutObject(key string, r io.Reader, contentType string) (*PutResult, error) {
+	chunkSize := kv.option.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	m := &object.Manifest{ChunkSize: chunkSize, ContentType: contentType, Chunks: []string{}}
+	for {
+		// a chunk may still be read by the writes to the other databases
+		// after PutBytes returns, so every chunk has its own buffer
+		buf := make([]byte, chunkSize)
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			hash := object.Hash(buf[:n])
+			if _, err := kv.PutBytes(object.ChunkKey(hash), buf[:n], "", NewRequestID()); err != nil && err != ErrKeyExists {
+				return nil, err
+			}
+			m.Size += int64(n)
+			m.Chunks = append(m.Chunks, hash)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return kv.PutBytes(key, b, object.ManifestContentType, NewRequestID())
+}
+
+// GetObject returns a reader of the object of the key and its manifest,
+// the reader fetches the chunks when it reaches them and checks them
+// against their hashes. It returns ErrNotObject if the key does not hold
+// a manifest.
+func (kv *KV) GetObject(key string) (*object.Reader, *object.Manifest, error) {
+	value, meta, err := kv.GetBytes(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.ContentType != object.ManifestContentType {
+		return nil, nil, ErrNotObject
+	}
+
+	m, err := object.DecodeManifest(value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return object.NewReader(m, func(chunkKey string) ([]byte, error) {
+		chunk, _, err := kv.GetBytes(chunkKey)
+		return chunk, err
+	}), m, nil
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Token is a consistency token of a write, based on its raft index. A read
+// with the token waits until the node serving it applies the write, so it
+// never misses the write. The token is a plain string, so it can be passed
+// to the readers on other hosts.
+type Token string
+
+// ParseToken parses a token passed as a string.
+func ParseToken(s string) (Token, error) {
+	if _, err := strconv.ParseUint(s, 10, 64); err != nil {
+		return "", fmt.Errorf("%s invalid token: %q", logPrefix, s)
+	}
+	return Token(s), nil
+}
+
+func tokenOf(index uint64) Token {
+	if index == 0 {
+		return ""
+	}
+	return Token(strconv.FormatUint(index, 10))
+}
+
+// index returns the raft index of t, 0 for the empty or an invalid token.
+func (t Token) index() uint64 {
+	index, _ := strconv.ParseUint(string(t), 10, 64)
+	return index
+}
+
+// Token returns the token of the latest write of kv, every read of kv
+// waits for it, which makes kv read its own writes.
+func (kv *KV) Token() Token {
+	kv.tokenMux.Lock()
+	defer kv.tokenMux.Unlock()
+
+	return tokenOf(kv.lastIndex)
+}
+
+// observe records the raft index of a write of kv.
+func (kv *KV) observe(index uint64) {
+	kv.tokenMux.Lock()
+	defer kv.tokenMux.Unlock()
+
+	if index > kv.lastIndex {
+		kv.lastIndex = index
+	}
+}
+
+// minIndex returns the index a read with token needs.
+func (kv *KV) minIndex(token Token) uint64 {
+	kv.tokenMux.Lock()
+	defer kv.tokenMux.Unlock()
+
+	if index := token.index(); index > kv.lastIndex {
+		return index
+	}
+	return kv.lastIndex
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxPollWait limits the wait of one long-poll, a longer wait is split into
+// several polls.
+const maxPollWait = 30 * time.Second
+
+type recordResult struct {
+	rec *record
+	err error
+}
+
+// WaitGet gets the value of the key, waiting until the key is put or ctx is
+// done, it returns ctx.Err() for the latter.
+func (kv *KV) WaitGet(ctx context.Context, key string) (string, error) {
+	for {
+		wait := maxPollWait
+		if deadline, ok := ctx.Deadline(); ok {
+			if left := time.Until(deadline); left < wait {
+				wait = left
+			}
+		}
+		if wait < time.Millisecond {
+			return "", context.DeadlineExceeded
+		}
+
+		result := make(chan recordResult, 1)
+		go func() {
+			rec, err := kv.poll(key, wait)
+			result <- recordResult{rec: rec, err: err}
+		}()
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+
+		case res := <-result:
+			if res.err == nil {
+				return res.rec.Value, nil
+			}
+			if res.err != ErrDataNotFound {
+				return "", res.err
+			}
+		}
+	}
+}
+
+// poll long-polls the key on the fast cache, or a database if the cache is
+// unavailable, for wait at most.
+func (kv *KV) poll(key string, wait time.Duration) (*record, error) {
+	minIndex := kv.minIndex("")
+	timeout := wait + requestTimeout
+
+	err := fmt.Errorf("%s caches are unavailable ", logPrefix)
+	if url := kv.cli.fastCache; url != "" {
+		var rec *record
+		rec, _, err = kv.find(key, withWait(kv.cacheGetURL(url, key, minIndex), wait), timeout)
+		if err == nil || err == ErrDataNotFound {
+			return rec, err
+		}
+	}
+
+	db := kv.cli.nextDB()
+	if db == "" {
+		return nil, err
+	}
+
+	rec, _, err := kv.find(key, withWait(kv.dbGetURL(db, key, minIndex), wait), timeout)
+	return rec, err
+}
+
+// withWait appends wait to getURL in milliseconds.
+func withWait(getURL string, wait time.Duration) string {
+	sep := "?"
+	if strings.Contains(getURL, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%swait=%dms", getURL, sep, wait/time.Millisecond)
+}
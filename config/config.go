@@ -49,6 +49,15 @@ var Config = struct {
 
 	RaftNodesKey  string `default:"oncekv.db.nodes" env:"ONCEKV_DB_NODES_KEY"`
 	CacheNodesKey string `default:"oncekv.cache.nodes" env:"ONCEKV_CACHE_NODES_KEY"`
+	NamespacesKey string `default:"oncekv.namespaces" env:"ONCEKV_NAMESPACES_KEY"`
+	PurgeEpochKey string `default:"oncekv.purge.epoch" env:"ONCEKV_PURGE_EPOCH_KEY"`
+
+	// a raft member of a db cluster unreachable for the grace period is
+	// removed from the cluster by the db master, default is 5m
+	RaftRemoveGracePeriod time.Duration `default:"300000000000" env:"ONCEKV_RAFT_REMOVE_GRACE_PERIOD"`
+
+	// the raft addresses of the db nodes replicating without voting
+	RaftReplicasKey string `default:"oncekv.db.replicas" env:"ONCEKV_DB_REPLICAS_KEY"`
 
 	// db shard master
 	ShardCount int `default:"10" env:"ONCEKV_SHARD_COUNT"`
@@ -58,8 +67,21 @@ var Config = struct {
 	// default is 10M
 	CacheBytes int64 `default:"10485760" env:"ONCEKV_CACHE_BYTES"`
 
+	// max size of a value, default is 1M
+	MaxValueBytes int64 `default:"1048576" env:"ONCEKV_MAX_VALUE_BYTES"`
+
+	// the interval of the scrubber of a db node, which checks the entries
+	// against their checksums and the replicas, 0 disables it
+	ScrubInterval time.Duration `default:"3600000000000" env:"ONCEKV_SCRUB_INTERVAL"`
+	// the window the leader of a db cluster gathers the concurrent adds
+	// in, to commit them in one raft log entry, 0 disables it
+	GroupCommitWindow time.Duration `default:"0" env:"ONCEKV_GROUP_COMMIT_WINDOW"`
+
 	// admin
 	AdminAddr string `default:"127.0.0.1:5546" env:"ONCEKV_ADMIN_ADDR"`
+	// AdminToken grants the admin operations like purging keys, which are
+	// disabled if it is empty
+	AdminToken string `env:"ONCEKV_ADMIN_TOKEN"`
 
 	// TODO: choose log collector
 	LogOut io.Writer
@@ -29,6 +29,9 @@ var (
 type Master struct {
 	meta   meta.Meta
 	getter mock.HTTPGetter
+
+	// the raft members unreachable and since when, for the reconciliation
+	deadSince map[string]time.Time
 }
 
 // Peers returns the peers
@@ -39,10 +42,13 @@ func (m *Master) Peers() ([]string, error) {
 // Start starts manage peers
 func (m *Master) Start() {
 	ticker := time.NewTicker(heartbeatPeriod)
+	reconcileTicker := time.NewTicker(reconcilePeriod)
 	for {
 		select {
 		case <-ticker.C:
 			m.heartbeat()
+		case <-reconcileTicker.C:
+			m.reconcile()
 		}
 	}
 }
@@ -169,6 +175,7 @@ var Default *Master
 
 func init() {
 	Default = &Master{
-		meta: meta.Default,
+		meta:      meta.Default,
+		deadSince: map[string]time.Time{},
 	}
 }
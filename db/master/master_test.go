@@ -2,7 +2,11 @@ package master
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -60,3 +64,96 @@ func TestMaster(t *testing.T) {
 		t.Errorf("can not keep relationship for the peers, result: %v\n", peers)
 	}
 }
+
+func TestReconcile(t *testing.T) {
+	leaderHTTP, leaderRaft := "127.0.0.1:55045", "127.0.0.1:55046"
+	aliveHTTP, aliveRaft := "127.0.0.1:55047", "127.0.0.1:55048"
+	deadHTTP, deadRaft := "127.0.0.1:55049", "127.0.0.1:55050"
+	m := &Master{meta: Default.meta, deadSince: map[string]time.Time{}}
+	for raftAddr, httpAddr := range map[string]string{leaderRaft: leaderHTTP, aliveRaft: aliveHTTP, deadRaft: deadHTTP} {
+		if err := m.RegisterPeer(raftAddr, httpAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.UpdatePeers([]string{leaderHTTP, aliveHTTP}); err != nil {
+		t.Fatal(err)
+	}
+
+	down := map[string]bool{deadHTTP: true}
+	httpGetter = mock.HTTPGetterFunc(func(rawurl string) (*http.Response, error) {
+		u, _ := url.Parse(rawurl)
+		if down[u.Host] {
+			return nil, fmt.Errorf("connection refused")
+		}
+		body := "pong"
+		if u.Path == "/peers" {
+			body = fmt.Sprintf(`{"leader":%q,"peers":[%q,%q,%q]}`, leaderRaft, leaderRaft, aliveRaft, deadRaft)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	})
+	removed := []string{}
+	httpDoer = mock.HTTPDoerFunc(func(req *http.Request) (*http.Response, error) {
+		removed = append(removed, req.Method+" "+req.URL.Host+req.URL.Path+" "+req.Header.Get("Authorization"))
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+
+	// within the grace period
+	removeGracePeriod = time.Hour
+	m.reconcile()
+	if len(removed) != 0 || m.deadSince[deadRaft].IsZero() {
+		t.Errorf("expect the dead member kept in the grace period, removed: %v, dead since: %v\n", removed, m.deadSince)
+	}
+
+	// below the quorum
+	removeGracePeriod = 0
+	down[aliveHTTP] = true
+	m.reconcile()
+	if len(removed) != 0 {
+		t.Errorf("expect no member removed below the quorum, removed: %v\n", removed)
+	}
+
+	// without the admin token
+	down[aliveHTTP] = false
+	adminToken = ""
+	m.reconcile()
+	if len(removed) != 0 {
+		t.Errorf("expect no member removed without the admin token, removed: %v\n", removed)
+	}
+
+	adminToken = "admin"
+	m.reconcile()
+	expect := []string{"DELETE " + leaderHTTP + "/peers/" + deadRaft + " Bearer admin"}
+	if !reflect.DeepEqual(removed, expect) {
+		t.Errorf("expect %v, removed: %v\n", expect, removed)
+	}
+	if _, ok := m.deadSince[deadRaft]; ok {
+		t.Errorf("expect the removed member forgotten, dead since: %v\n", m.deadSince)
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	m := &Master{meta: Default.meta, deadSince: map[string]time.Time{}}
+	for _, c := range []struct {
+		add, remove string
+		expect      []string
+	}{
+		{add: "127.0.0.1:55052", expect: []string{"127.0.0.1:55052"}},
+		{add: "127.0.0.1:55051", expect: []string{"127.0.0.1:55051", "127.0.0.1:55052"}},
+		{add: "127.0.0.1:55051", expect: []string{"127.0.0.1:55051", "127.0.0.1:55052"}},
+		{remove: "127.0.0.1:55052", expect: []string{"127.0.0.1:55051"}},
+		{remove: "127.0.0.1:55053", expect: []string{"127.0.0.1:55051"}},
+	} {
+		var err error
+		if c.add != "" {
+			err = m.AddReplica(c.add)
+		} else {
+			err = m.RemoveReplica(c.remove)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if replicas, err := m.Replicas(); err != nil || !reflect.DeepEqual(replicas, c.expect) {
+			t.Errorf("add %q remove %q, expect: %v, got: %v, %v", c.add, c.remove, c.expect, replicas, err)
+		}
+	}
+}
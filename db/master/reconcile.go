@@ -0,0 +1,147 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Focinfi/oncekv/config"
+	"github.com/Focinfi/oncekv/log"
+	"github.com/Focinfi/oncekv/utils/mock"
+	"github.com/Focinfi/oncekv/utils/urlutil"
+)
+
+// The heartbeat drops the unreachable nodes from the peers in the meta
+// store, but they stay in the raft configuration, where they count for the
+// quorum. The reconciliation removes a raft member unreachable for the
+// grace period through the leader, one member at a time, and only while a
+// quorum of the members is reachable, so a master cut off from the cluster
+// never shrinks it. The leader only removes members for the admin token.
+
+var (
+	reconcilePeriod   = 10 * time.Second
+	removeGracePeriod = config.Config.RaftRemoveGracePeriod
+	adminToken        = config.Config.AdminToken
+	httpDoer          = mock.HTTPDoer(http.DefaultClient)
+
+	errNoAdminToken = errors.New("no admin token to remove the members")
+)
+
+// members is the raft configuration responded by GET /peers of a node.
+type members struct {
+	Leader string   `json:"leader"`
+	Peers  []string `json:"peers"`
+}
+
+// reconcile removes a raft member unreachable for the grace period.
+func (m *Master) reconcile() {
+	peers, err := m.fetchPeers()
+	if err != nil {
+		log.DB.Error(logPrefix, err)
+		return
+	}
+
+	cluster, ok := m.fetchMembers(peers)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	alive := 0
+	dead := []string{}
+	deadSince := map[string]time.Time{}
+	for _, raftAddr := range cluster.Peers {
+		if httpAddr, err := m.PeerHTTPAddr(raftAddr); err == nil && ping(httpAddr) {
+			alive++
+			continue
+		}
+
+		since, ok := m.deadSince[raftAddr]
+		if !ok {
+			since = now
+		}
+		deadSince[raftAddr] = since
+		if now.Sub(since) >= removeGracePeriod {
+			dead = append(dead, raftAddr)
+		}
+	}
+	// the members removed or reachable again start over
+	m.deadSince = deadSince
+
+	if len(dead) == 0 {
+		return
+	}
+	if quorum := len(cluster.Peers)/2 + 1; alive < quorum {
+		log.DB.Errorf("%s %d of %d members reachable, below the quorum, not removing %v", logPrefix, alive, len(cluster.Peers), dead)
+		return
+	}
+
+	if err := m.removeMember(cluster.Leader, dead[0]); err != nil {
+		log.DB.Errorln(logPrefix, "failed to remove", dead[0], err)
+		return
+	}
+	log.DB.Infoln(logPrefix, "removed the dead member", dead[0])
+	delete(m.deadSince, dead[0])
+}
+
+// fetchMembers returns the raft configuration known by the first of the
+// peers knowing the leader, the replicas answer no members.
+func (m *Master) fetchMembers(peers []string) (members, bool) {
+	for _, peer := range peers {
+		resp, err := httpGetter.Get(fmt.Sprintf("%s/peers", urlutil.MakeURL(peer)))
+		if err != nil {
+			log.DB.Error(logPrefix, err)
+			continue
+		}
+
+		cluster := members{}
+		err = json.NewDecoder(resp.Body).Decode(&cluster)
+		resp.Body.Close()
+		if err != nil || cluster.Leader == "" || len(cluster.Peers) == 0 {
+			log.DB.Errorln(logPrefix, "no raft configuration from", peer, err)
+			continue
+		}
+		return cluster, true
+	}
+	return members{}, false
+}
+
+// removeMember asks the leader to remove the member at the raft address.
+func (m *Master) removeMember(leader, raftAddr string) error {
+	if adminToken == "" {
+		return errNoAdminToken
+	}
+	leaderHTTP, err := m.PeerHTTPAddr(leader)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/peers/%s", urlutil.MakeURL(leaderHTTP), url.PathEscape(raftAddr)), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := httpDoer.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s leader response code: %d", logPrefix, resp.StatusCode)
+	}
+	return nil
+}
+
+// ping reports whether the node at the HTTP address answers the ping.
+func ping(httpAddr string) bool {
+	resp, err := httpGetter.Get(fmt.Sprintf("%s/ping", urlutil.MakeURL(httpAddr)))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
@@ -0,0 +1,75 @@
+package master
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/Focinfi/oncekv/config"
+)
+
+// The replicas are db nodes receiving the changes of a voter without taking
+// part in the raft elections or the commit quorum. Their raft addresses are
+// kept apart from the raft members, and their HTTP addresses are in the
+// peers with the members' ones, so the caches read from them.
+
+var raftReplicasKey = config.Config.RaftReplicasKey
+
+// Replicas returns the raft addresses of the replicas.
+func (m *Master) Replicas() ([]string, error) {
+	replicas := []string{}
+	val, err := m.meta.Get(raftReplicasKey)
+	if err == config.ErrDataNotFound {
+		return replicas, nil
+	}
+	if err != nil {
+		return replicas, err
+	}
+
+	if err := json.Unmarshal([]byte(val), &replicas); err != nil {
+		return replicas, err
+	}
+	return replicas, nil
+}
+
+// AddReplica records the node at the raft address as a replica.
+func (m *Master) AddReplica(raftAddr string) error {
+	replicas, err := m.Replicas()
+	if err != nil {
+		return err
+	}
+	for _, replica := range replicas {
+		if replica == raftAddr {
+			return nil
+		}
+	}
+	return m.updateReplicas(append(replicas, raftAddr))
+}
+
+// RemoveReplica forgets the replica at the raft address, e.g. once it is
+// promoted.
+func (m *Master) RemoveReplica(raftAddr string) error {
+	replicas, err := m.Replicas()
+	if err != nil {
+		return err
+	}
+
+	remaining := []string{}
+	for _, replica := range replicas {
+		if replica != raftAddr {
+			remaining = append(remaining, replica)
+		}
+	}
+	if len(remaining) == len(replicas) {
+		return nil
+	}
+	return m.updateReplicas(remaining)
+}
+
+func (m *Master) updateReplicas(replicas []string) error {
+	sort.StringSlice(replicas).Sort()
+	b, err := json.Marshal(replicas)
+	if err != nil {
+		return err
+	}
+	return m.meta.Put(raftReplicasKey, string(b))
+}
@@ -0,0 +1,45 @@
+package service
+
+import (
+	"net/http"
+
+	"github.com/Focinfi/oncekv/utils/cas"
+	"github.com/gin-gonic/gin"
+)
+
+// CASStatus for the response of POST /cas, with the key derived from the
+// value
+type CASStatus struct {
+	WriteStatus
+	Key string `json:"key"`
+}
+
+// handleCAS adds the body as the value of its content-addressed key, the
+// SHA-256 of the value in lowercase hex, and responds the key. The options
+// of the write are given like PUT /key/:key. Adding the same value again
+// gets StatusKeyExists.
+func (s *Service) handleCAS(ctx *gin.Context) {
+	if !s.leadsWrites(ctx) {
+		return
+	}
+
+	sc, ok := scopeOf(ctx)
+	if !ok {
+		return
+	}
+
+	value, opts, ok := readRaw(ctx, sc)
+	if !ok {
+		return
+	}
+
+	key := cas.Key(value)
+	if !sc.validKey(key) {
+		ctx.JSON(http.StatusBadRequest, StatusParamsError)
+		return
+	}
+
+	if res, ok := s.tryAdd(ctx, sc.key(key), value, opts); ok {
+		ctx.JSON(http.StatusOK, CASStatus{WriteStatus: writeStatusOf(res), Key: key})
+	}
+}
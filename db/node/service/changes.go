@@ -0,0 +1,102 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Focinfi/oncekv/db/node/store"
+	"github.com/Focinfi/oncekv/log"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// changesBatchSize is the count of changes read from the store at once
+	changesBatchSize = 256
+
+	// changesIdleTimeout is how long the stream waits for new changes
+	// before pinging the consumer
+	changesIdleTimeout = time.Second
+)
+
+// changeResp for a message of /ws/changes, the metadata is empty for a
+// delete
+type changeResp struct {
+	Op string `json:"op"`
+	metaResp
+}
+
+func changeRespOf(c store.Change) changeResp {
+	if c.Meta == nil {
+		return changeResp{Op: c.Op, metaResp: metaResp{Key: c.Key, Index: c.Index}}
+	}
+	return changeResp{Op: c.Op, metaResp: metaRespOf(c.Key, c.Value, c.Meta)}
+}
+
+// handleChanges streams the changes applied by this node from the raft
+// index given by the from query, then follows the new ones. A consumer
+// resumes from the index of the last change it got plus one, an index no
+// longer kept gets StatusChangesCompacted. Only the changes of the keys of
+// the namespace are streamed.
+func (s *Service) handleChanges(ctx *gin.Context) {
+	sc, ok := scopeOf(ctx)
+	if !ok {
+		return
+	}
+
+	var from uint64
+	if param := ctx.Query("from"); param != "" {
+		var err error
+		if from, err = strconv.ParseUint(param, 10, 64); err != nil {
+			ctx.JSON(http.StatusBadRequest, StatusParamsError)
+			return
+		}
+	}
+
+	changes, next, err := s.store.Changes(from, changesBatchSize)
+	if err == store.ErrChangesCompacted {
+		ctx.JSON(http.StatusGone, StatusChangesCompacted)
+		return
+	}
+	if err != nil {
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err})
+		return
+	}
+	defer conn.Close()
+
+	for {
+		for _, change := range changes {
+			if !sc.has(change.Key) {
+				continue
+			}
+			change.Key = sc.userKey(change.Key)
+			if err := conn.WriteJSON(changeRespOf(change)); err != nil {
+				return
+			}
+		}
+		from = next
+
+		if len(changes) < changesBatchSize {
+			deadline := time.Now().Add(changesIdleTimeout)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+			// A timeout only means there is no new change yet.
+			s.store.WaitApplied(from, changesIdleTimeout)
+		}
+
+		// A consumer falling behind a trim resumes on a new stream.
+		if changes, next, err = s.store.Changes(from, changesBatchSize); err != nil {
+			log.DB.Error(logPrefix, err)
+			return
+		}
+	}
+}
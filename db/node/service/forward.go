@@ -0,0 +1,133 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Focinfi/oncekv/db/master"
+	"github.com/Focinfi/oncekv/log"
+	"github.com/Focinfi/oncekv/utils/urlutil"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// forwardedHeader marks a request forwarded by another node, which is
+	// never forwarded again, so stale leader information can not make the
+	// nodes forward a request in a loop.
+	forwardedHeader = "X-Oncekv-Forwarded"
+
+	// oncekvHeaderPrefix is the prefix of the headers relayed from the
+	// leader, like the metadata of a raw value
+	oncekvHeaderPrefix = "X-Oncekv-"
+
+	// leaderHeader carries the HTTP address of the leader in every
+	// response, for the writers to send the writes to it directly
+	leaderHeader = "X-Oncekv-Leader"
+
+	forwardTimeout = 10 * time.Second
+)
+
+var forwardClient = &http.Client{Timeout: forwardTimeout}
+
+// leaderAddrs caches the HTTP address of the leader by its raft address,
+// which is only looked up in the meta store when the leader changes.
+type leaderAddrs struct {
+	sync.Mutex
+	raftAddr string
+	httpAddr string
+}
+
+// leaderHTTPAddr returns the HTTP address of the current leader.
+func (s *Service) leaderHTTPAddr() (string, error) {
+	leader := s.store.Leader()
+	if leader == "" {
+		return "", errNoLeader
+	}
+
+	s.leader.Lock()
+	defer s.leader.Unlock()
+	if s.leader.raftAddr == leader {
+		return s.leader.httpAddr, nil
+	}
+	httpAddr, err := master.Default.PeerHTTPAddr(leader)
+	if err != nil {
+		return "", err
+	}
+	s.leader.raftAddr, s.leader.httpAddr = leader, httpAddr
+	return httpAddr, nil
+}
+
+// setLeaderHeader sets the leader header of the response, if the leader is
+// known.
+func (s *Service) setLeaderHeader(ctx *gin.Context) {
+	if leader, err := s.leaderHTTPAddr(); err == nil {
+		ctx.Header(leaderHeader, leader)
+	}
+	ctx.Next()
+}
+
+// leadsWrites reports whether the node is the leader to apply a write, a
+// follower forwards the write to the leader and responds its answer. A
+// forwarded write is never forwarded again.
+func (s *Service) leadsWrites(ctx *gin.Context) bool {
+	if s.raftAddr == s.store.Leader() {
+		return true
+	}
+
+	if isForwarded(ctx) {
+		ctx.JSON(http.StatusBadRequest, StatusNotLeaderError)
+	} else {
+		s.forwardToLeader(ctx)
+	}
+	return false
+}
+
+// isForwarded reports whether the request was forwarded by another node.
+func isForwarded(ctx *gin.Context) bool {
+	return ctx.GetHeader(forwardedHeader) != ""
+}
+
+// forwardToLeader sends the request to the leader and responds its
+// response, or StatusNotLeaderError if the leader is unknown.
+func (s *Service) forwardToLeader(ctx *gin.Context) {
+	leader, err := s.leaderHTTPAddr()
+	if err != nil || leader == s.httpAddr {
+		log.DB.Errorln(logPrefix, "no leader to forward to:", err)
+		ctx.JSON(http.StatusBadRequest, StatusNotLeaderError)
+		return
+	}
+
+	url := urlutil.MakeURL(leader) + ctx.Request.URL.RequestURI()
+	req, err := http.NewRequest(ctx.Request.Method, url, ctx.Request.Body)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return
+	}
+	req.Header.Set("Content-Type", ctx.GetHeader("Content-Type"))
+	if auth := ctx.GetHeader("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	req.Header.Set(forwardedHeader, s.httpAddr)
+
+	resp, err := forwardClient.Do(req)
+	if err != nil {
+		log.DB.Errorln(logPrefix, "failed to forward to the leader:", err)
+		ctx.JSON(http.StatusBadGateway, StatusInternalError)
+		return
+	}
+	defer resp.Body.Close()
+
+	ctx.Header("Content-Type", resp.Header.Get("Content-Type"))
+	for name := range resp.Header {
+		if strings.HasPrefix(name, oncekvHeaderPrefix) {
+			ctx.Header(name, resp.Header.Get(name))
+		}
+	}
+	ctx.Status(resp.StatusCode)
+	if _, err := io.Copy(ctx.Writer, resp.Body); err != nil {
+		log.DB.Errorln(logPrefix, "failed to relay the response of the leader:", err)
+	}
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Focinfi/oncekv/db/node/store"
+	"github.com/Focinfi/oncekv/log"
+	"github.com/Focinfi/oncekv/namespace"
+	"github.com/Focinfi/oncekv/utils/cas"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// tokenQuery is the query of the access token of a namespace, which
+	// may also be given as the bearer token of the Authorization header
+	tokenQuery   = "token"
+	bearerPrefix = "Bearer "
+)
+
+var namespaces = namespace.Default
+
+// scope is the namespace of a request, the default one serves the routes
+// without /ns/:ns
+type scope struct {
+	// ns is nil for the default namespace
+	ns            *namespace.Namespace
+	maxKeyBytes   int
+	maxValueBytes int64
+	// contentAddressed requires the keys to be the hashes of their values
+	contentAddressed bool
+}
+
+// scopeOf returns the scope of the request, or responds the error and
+// returns false if the namespace is not found or the token does not grant
+// the access to it.
+func scopeOf(ctx *gin.Context) (*scope, bool) {
+	name := ctx.Param("ns")
+	if name == "" {
+		return &scope{maxValueBytes: maxValueBytes}, true
+	}
+
+	ns, err := namespaces.Get(name)
+	if err == namespace.ErrNotFound {
+		ctx.JSON(http.StatusNotFound, StatusNamespaceNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return nil, false
+	}
+
+	if !ns.Authorized(tokenOf(ctx)) {
+		ctx.JSON(http.StatusUnauthorized, StatusUnauthorized)
+		return nil, false
+	}
+	return &scope{ns: ns, maxKeyBytes: ns.MaxKeyBytes, maxValueBytes: ns.MaxValueBytes, contentAddressed: ns.ContentAddressed}, true
+}
+
+// tokenOf returns the token of the request
+func tokenOf(ctx *gin.Context) string {
+	if auth := ctx.GetHeader("Authorization"); strings.HasPrefix(auth, bearerPrefix) {
+		return strings.TrimPrefix(auth, bearerPrefix)
+	}
+	return ctx.Query(tokenQuery)
+}
+
+// keyParam returns the key of the route, which may contain slashes.
+func keyParam(ctx *gin.Context) string {
+	return strings.TrimPrefix(ctx.Param("key"), "/")
+}
+
+// validKey reports whether the key can be used in the namespace.
+func (sc *scope) validKey(key string) bool {
+	if key == "" || len(key) > store.MaxKeyBytes || (sc.maxKeyBytes > 0 && len(key) > sc.maxKeyBytes) {
+		return false
+	}
+	return sc.ns != nil || !namespace.Reserved(key)
+}
+
+// verify reports whether the key can hold the value, the key must be the
+// hash of the value in a content-addressed namespace or if the write asks
+// for it.
+func (sc *scope) verify(key string, value []byte, contentAddressed bool) bool {
+	if !sc.contentAddressed && !contentAddressed {
+		return true
+	}
+	return cas.Verify(key, value)
+}
+
+// key returns the stored key of the key.
+func (sc *scope) key(key string) string {
+	if sc.ns == nil {
+		return key
+	}
+	return sc.ns.Key(key)
+}
+
+// has reports whether the stored key belongs to the namespace.
+func (sc *scope) has(stored string) bool {
+	if sc.ns == nil {
+		return !namespace.Reserved(stored)
+	}
+	return strings.HasPrefix(stored, namespace.Prefix(sc.ns.Name))
+}
+
+// userKey returns the key of the stored key of the namespace.
+func (sc *scope) userKey(stored string) string {
+	if sc.ns == nil {
+		return stored
+	}
+	return strings.TrimPrefix(stored, namespace.Prefix(sc.ns.Name))
+}
+
+// listOptions returns opts selecting the stored keys of the namespace.
+func (sc *scope) listOptions(opts store.ListOptions) store.ListOptions {
+	if sc.ns == nil {
+		if opts.End == "" || opts.End > namespace.ReservedStart() {
+			opts.End = namespace.ReservedStart()
+		}
+		return opts
+	}
+
+	opts.Prefix = sc.ns.Key(opts.Prefix)
+	if opts.After != "" {
+		opts.After = sc.ns.Key(opts.After)
+	}
+	if opts.End != "" {
+		opts.End = sc.ns.Key(opts.End)
+	}
+	return opts
+}
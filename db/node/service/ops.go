@@ -0,0 +1,132 @@
+package service
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Focinfi/oncekv/db/master"
+	"github.com/Focinfi/oncekv/db/node/store"
+	"github.com/Focinfi/oncekv/log"
+	"github.com/Focinfi/oncekv/utils/urlutil"
+)
+
+const (
+	// opsGateTick is how often the node checks whether it leads
+	opsGateTick = time.Second
+	// opsGateInterval is how often the leader reads the max_op of the voters
+	opsGateInterval = 10 * time.Second
+)
+
+// voterOps is the max_op last advertised by the voters, by raft address.
+// A voter never heard of counts as store.BaseOp.
+type voterOps struct {
+	sync.Mutex
+	ops map[string]byte
+}
+
+func (v *voterOps) set(raftAddr string, op byte) {
+	v.Lock()
+	defer v.Unlock()
+	if v.ops == nil {
+		v.ops = map[string]byte{}
+	}
+	v.ops[raftAddr] = op
+}
+
+func (v *voterOps) get(raftAddr string) byte {
+	v.Lock()
+	defer v.Unlock()
+	if op, ok := v.ops[raftAddr]; ok {
+		return op
+	}
+	return store.BaseOp
+}
+
+// runOpsGate keeps the ops the leader proposes to the ones every voter
+// applies, reading the max_op of the voters once the node leads and every
+// opsGateInterval after, until the node shuts down.
+func (s *Service) runOpsGate() {
+	ticker := time.NewTicker(opsGateTick)
+	defer ticker.Stop()
+
+	var last time.Time
+	for {
+		select {
+		case <-ticker.C:
+			if s.raftAddr != s.store.Leader() {
+				last = time.Time{}
+				continue
+			}
+			if time.Since(last) >= opsGateInterval {
+				s.pollVoterOps()
+				last = time.Now()
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// pollVoterOps reads the max_op of the other voters, a voter unreachable
+// keeps the one it advertised last.
+func (s *Service) pollVoterOps() {
+	raftPeers, err := s.store.Peers()
+	if err != nil {
+		log.DB.Errorln(logPrefix, "failed to get the raft peers:", err)
+		return
+	}
+
+	for _, raftAddr := range excludePeer(raftPeers, s.raftAddr) {
+		peer, err := master.Default.PeerHTTPAddr(raftAddr)
+		if err != nil {
+			continue
+		}
+		if op, err := maxOpOf(peer); err == nil {
+			s.voterOps.set(raftAddr, op)
+		}
+	}
+	s.updateClusterOp(raftPeers)
+}
+
+// updateClusterOp sets the cluster op of the store to the lowest max_op of
+// the raft peers.
+func (s *Service) updateClusterOp(raftPeers []string) {
+	op := store.MaxOp
+	for _, raftAddr := range excludePeer(raftPeers, s.raftAddr) {
+		if peerOp := s.voterOps.get(raftAddr); peerOp < op {
+			op = peerOp
+		}
+	}
+	s.store.SetClusterOp(op)
+}
+
+// maxOpOf returns the max_op advertised by the node at the HTTP address,
+// store.BaseOp for a node advertising none.
+func maxOpOf(peer string) (byte, error) {
+	stats, err := statsOf(peer)
+	if err != nil {
+		return 0, err
+	}
+	op, err := strconv.ParseUint(stats["max_op"], 10, 8)
+	if err != nil {
+		return store.BaseOp, nil
+	}
+	return byte(op), nil
+}
+
+// statsOf returns the stats of the node at the HTTP address.
+func statsOf(peer string) (map[string]string, error) {
+	resp, err := forwardClient.Get(urlutil.MakeURL(peer) + "/stats")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	stats := map[string]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
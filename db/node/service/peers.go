@@ -0,0 +1,164 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/Focinfi/oncekv/db/master"
+	"github.com/Focinfi/oncekv/db/node/store"
+	"github.com/Focinfi/oncekv/log"
+	"github.com/Focinfi/oncekv/utils/urlutil"
+	"github.com/gin-gonic/gin"
+)
+
+// peersResp for the response of GET /peers, the raft addresses of the
+// members of the cluster and of its leader
+type peersResp struct {
+	Leader string   `json:"leader"`
+	Peers  []string `json:"peers"`
+}
+
+// handlePeers responds the members of the cluster known by the node.
+func (s *Service) handlePeers(ctx *gin.Context) {
+	peers, err := s.store.Peers()
+	if err != nil {
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return
+	}
+	ctx.JSON(http.StatusOK, peersResp{Leader: s.store.Leader(), Peers: peers})
+}
+
+// handleRemovePeer removes the node at the raft address :addr from the
+// cluster for the admin, reject if current raft instance is not a *Leader*.
+func (s *Service) handleRemovePeer(ctx *gin.Context) {
+	if !isAdmin(ctx) {
+		ctx.JSON(http.StatusUnauthorized, StatusUnauthorized)
+		return
+	}
+	if s.raftAddr != s.store.Leader() {
+		ctx.JSON(http.StatusBadRequest, StatusNotLeaderError)
+		return
+	}
+	s.removePeer(ctx, ctx.Param("addr"))
+}
+
+// handleLeave removes this node from the cluster for the admin: the leader
+// removes itself, the other nodes ask the leader to remove them, and a
+// replica drops itself from the replicas.
+func (s *Service) handleLeave(ctx *gin.Context) {
+	if !isAdmin(ctx) {
+		ctx.JSON(http.StatusUnauthorized, StatusUnauthorized)
+		return
+	}
+	if s.store.Role() == store.RoleReplica {
+		s.leaveReplicas(ctx)
+		return
+	}
+	if s.raftAddr == s.store.Leader() {
+		s.removePeer(ctx, s.raftAddr)
+		return
+	}
+
+	resp, err := s.askLeaderToRemove()
+	if err == errNoLeader {
+		ctx.JSON(http.StatusBadRequest, StatusNotLeaderError)
+		return
+	}
+	if err != nil {
+		log.DB.Errorln(logPrefix, "failed to ask the leader to leave:", err)
+		ctx.JSON(http.StatusBadGateway, StatusInternalError)
+		return
+	}
+	defer resp.Body.Close()
+
+	ctx.Header("Content-Type", resp.Header.Get("Content-Type"))
+	ctx.Status(resp.StatusCode)
+	if _, err := io.Copy(ctx.Writer, resp.Body); err != nil {
+		log.DB.Errorln(logPrefix, "failed to relay the response of the leader:", err)
+	}
+}
+
+// removePeer removes the node at the raft addr on the leader, and updates
+// the peers in the meta store to the remaining ones.
+func (s *Service) removePeer(ctx *gin.Context, addr string) {
+	peers, err := s.store.Peers()
+	if err != nil {
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return
+	}
+
+	switch err := s.store.RemovePeer(addr); err {
+	case nil:
+	case store.ErrPeerNotFound:
+		ctx.JSON(http.StatusNotFound, StatusPeerNotFound)
+		return
+	case store.ErrNotLeader:
+		ctx.JSON(http.StatusBadRequest, StatusNotLeaderError)
+		return
+	default:
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, StatusOK)
+
+	go func() {
+		if err := s.updatePeersOf(excludePeer(peers, addr)); err != nil {
+			log.DB.Error(err)
+		}
+	}()
+}
+
+// askLeaderToRemove asks the leader to remove this node from the cluster,
+// and returns the response of the leader, or errNoLeader.
+func (s *Service) askLeaderToRemove() (*http.Response, error) {
+	leader, err := s.leaderHTTPAddr()
+	if err != nil || leader == s.httpAddr {
+		log.DB.Errorln(logPrefix, "no leader to leave:", err)
+		return nil, errNoLeader
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, urlutil.MakeURL(leader)+"/peers/"+url.PathEscape(s.raftAddr), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(forwardedHeader, s.httpAddr)
+	req.Header.Set("Authorization", bearerPrefix+adminToken)
+	return forwardClient.Do(req)
+}
+
+// leaveReplicas drops the replica from the replicas and its HTTP address
+// from the peers in the meta store, it stops serving the caches.
+func (s *Service) leaveReplicas(ctx *gin.Context) {
+	if err := master.Default.RemoveReplica(s.raftAddr); err != nil {
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return
+	}
+
+	peers, err := master.Default.Peers()
+	if err == nil {
+		err = master.Default.UpdatePeers(excludePeer(peers, s.httpAddr))
+	}
+	if err != nil {
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return
+	}
+	ctx.JSON(http.StatusOK, StatusOK)
+}
+
+// excludePeer returns the peers other than the addr.
+func excludePeer(peers []string, addr string) []string {
+	remaining := []string{}
+	for _, peer := range peers {
+		if peer != addr {
+			remaining = append(remaining, peer)
+		}
+	}
+	return remaining
+}
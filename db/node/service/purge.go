@@ -0,0 +1,122 @@
+package service
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/Focinfi/oncekv/config"
+	"github.com/Focinfi/oncekv/db/node/store"
+	"github.com/Focinfi/oncekv/log"
+	"github.com/Focinfi/oncekv/namespace"
+	"github.com/gin-gonic/gin"
+)
+
+var adminToken = config.Config.AdminToken
+
+type purgeParams struct {
+	Key string `json:"key"`
+	// Namespace of the key, the default one if it is empty
+	Namespace string `json:"namespace"`
+	Operator  string `json:"operator"`
+	Reason    string `json:"reason"`
+}
+
+// purgeResp for an audit record of a purge, with the key in its namespace
+type purgeResp struct {
+	store.Purge
+	Namespace string `json:"namespace,omitempty"`
+}
+
+func purgeRespOf(p store.Purge) purgeResp {
+	resp := purgeResp{Purge: p}
+	resp.Namespace, resp.Key = namespace.Split(p.Key)
+	return resp
+}
+
+// PurgeStatus for the response of a purge, with its audit record
+type PurgeStatus struct {
+	Status
+	Purge purgeResp `json:"purge"`
+}
+
+// isAdmin reports whether the request carries the admin token, no request
+// does if the token is not set.
+func isAdmin(ctx *gin.Context) bool {
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(tokenOf(ctx)), []byte(adminToken)) == 1
+}
+
+// handlePurge deletes a key through the raft log for the admin, whether or
+// not it expires, and records the operator and the reason of the purge.
+func (s *Service) handlePurge(ctx *gin.Context) {
+	if !isAdmin(ctx) {
+		ctx.JSON(http.StatusUnauthorized, StatusUnauthorized)
+		return
+	}
+
+	if !s.leadsWrites(ctx) {
+		return
+	}
+
+	params := purgeParams{}
+	if err := ctx.BindJSON(&params); err != nil || params.Operator == "" || params.Reason == "" {
+		ctx.JSON(http.StatusBadRequest, StatusParamsError)
+		return
+	}
+
+	sc := &scope{}
+	if params.Namespace != "" {
+		ns, err := namespaces.Get(params.Namespace)
+		if err == namespace.ErrNotFound {
+			ctx.JSON(http.StatusNotFound, StatusNamespaceNotFound)
+			return
+		}
+		if err != nil {
+			log.DB.Error(logPrefix, err)
+			ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+			return
+		}
+		sc.ns = ns
+	}
+	if !sc.validKey(params.Key) {
+		ctx.JSON(http.StatusBadRequest, StatusParamsError)
+		return
+	}
+
+	p, err := s.store.Purge(sc.key(params.Key), params.Operator, params.Reason)
+	if err == store.ErrNotLeader {
+		ctx.JSON(http.StatusBadRequest, StatusNotLeaderError)
+		return
+	}
+	if err == store.ErrUnsupportedOp {
+		ctx.JSON(http.StatusServiceUnavailable, StatusUnsupportedOp)
+		return
+	}
+	if err != nil {
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return
+	}
+
+	log.DB.Infof("%s %s purged %q: %s", logPrefix, params.Operator, p.Key, params.Reason)
+	ctx.JSON(http.StatusOK, PurgeStatus{Status: StatusOK, Purge: purgeRespOf(*p)})
+}
+
+// handlePurges responds the audit records of the purges for the admin.
+func (s *Service) handlePurges(ctx *gin.Context) {
+	if !isAdmin(ctx) {
+		ctx.JSON(http.StatusUnauthorized, StatusUnauthorized)
+		return
+	}
+
+	purges, err := s.store.Purges()
+	if err != nil {
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return
+	}
+	resp := make([]purgeResp, len(purges))
+	for i, p := range purges {
+		resp[i] = purgeRespOf(p)
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,355 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Focinfi/oncekv/db/master"
+	"github.com/Focinfi/oncekv/db/node/store"
+	"github.com/Focinfi/oncekv/log"
+	"github.com/Focinfi/oncekv/utils/urlutil"
+	"github.com/gin-gonic/gin"
+)
+
+// A replica follows the changes of the leader on GET /i/replicate, which
+// ships the entries as stored, and applies them to its store without raft.
+// It joins the cluster with the replica role, the leader records it in the
+// meta store, so its HTTP address is in the peers for the caches, but it is
+// no raft member. The writes it gets are forwarded to the leader, the reads
+// needing the leader too. A replica behind the last snapshot restored by
+// the node it reads from gets resync instead of the changes, and replaces
+// its store with a snapshot read from GET /i/snapshot. The internal routes
+// need the admin token.
+
+const (
+	// replicaPollInterval is how long a replica caught up waits before
+	// reading the changes again
+	replicaPollInterval = 100 * time.Millisecond
+)
+
+// snapshotClient reads the snapshots, which take longer than a request
+// forwarded.
+var snapshotClient = &http.Client{}
+
+// replicatedResp for a change of GET /i/replicate, the key is in bytes
+// since the stored keys of the namespaces are not valid UTF-8
+type replicatedResp struct {
+	Index uint64 `json:"index"`
+	Op    string `json:"op"`
+	Key   []byte `json:"key"`
+	Entry []byte `json:"entry,omitempty"`
+}
+
+// replicateResp for the response of GET /i/replicate, the following
+// changes are read from next, or from a snapshot if resync is set
+type replicateResp struct {
+	Leader  string           `json:"leader"`
+	Next    uint64           `json:"next"`
+	Changes []replicatedResp `json:"changes"`
+	Resync  bool             `json:"resync,omitempty"`
+}
+
+// replication runs the loop of a replica following the leader.
+type replication struct {
+	sync.Mutex
+	stop    chan struct{} // Closed to stop following the leader.
+	stopped chan struct{} // Closed when the loop returns.
+}
+
+// startReplica starts following the leader, unless the loop runs.
+func (s *Service) startReplica() {
+	s.replication.Lock()
+	defer s.replication.Unlock()
+	if s.replication.stop != nil {
+		return
+	}
+
+	s.replication.stop, s.replication.stopped = make(chan struct{}), make(chan struct{})
+	go s.runReplica(s.replication.stop, s.replication.stopped)
+}
+
+// stopReplica stops following the leader and waits for the loop to return.
+func (s *Service) stopReplica() {
+	s.replication.Lock()
+	defer s.replication.Unlock()
+	if s.replication.stop == nil {
+		return
+	}
+
+	close(s.replication.stop)
+	<-s.replication.stopped
+	s.replication.stop, s.replication.stopped = nil, nil
+}
+
+// runReplica joins the cluster as a replica and applies the changes of the
+// leader until it is stopped or the node shuts down.
+func (s *Service) runReplica(stop, stopped chan struct{}) {
+	defer close(stopped)
+
+	joined := false
+	for {
+		if !joined {
+			peers, err := master.Default.Peers()
+			if err == nil {
+				err = s.tryToJoin(peers, store.RoleReplica)
+			}
+			if joined = err == nil; !joined {
+				log.DB.Errorln(logPrefix, "failed to join as a replica:", err)
+			}
+		}
+
+		caughtUp := true
+		if n, err := s.replicateOnce(); err != nil {
+			log.DB.Errorln(logPrefix, "failed to replicate:", err)
+		} else {
+			caughtUp = n < changesBatchSize
+		}
+
+		wait := time.Duration(0)
+		if caughtUp || !joined {
+			wait = replicaPollInterval
+		}
+		select {
+		case <-stop:
+			return
+		case <-s.done:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// replicateOnce applies a batch of changes from the leader, or from another
+// peer if the leader is not reachable, and returns the count of them.
+func (s *Service) replicateOnce() (int, error) {
+	path := "/i/replicate?" + url.Values{
+		"from":  {strconv.FormatUint(s.store.AppliedIndex()+1, 10)},
+		"limit": {strconv.Itoa(changesBatchSize)},
+	}.Encode()
+
+	var err error
+	for _, peer := range s.replicaSources() {
+		resp := replicateResp{}
+		if err = s.getPeer(peer, path, &resp); err != nil {
+			continue
+		}
+		if resp.Resync {
+			return 0, s.resyncFrom(peer, resp.Leader)
+		}
+
+		changes := make([]store.ReplicatedChange, len(resp.Changes))
+		for i, c := range resp.Changes {
+			changes[i] = store.ReplicatedChange{Index: c.Index, Op: c.Op, Key: string(c.Key), Entry: c.Entry}
+		}
+		return len(changes), s.store.ApplyReplicated(changes, resp.Next, resp.Leader)
+	}
+	if err == nil {
+		err = errNoLeader
+	}
+	return 0, err
+}
+
+// replicaSources returns the HTTP addresses of the nodes to replicate from,
+// the leader first if it is known.
+func (s *Service) replicaSources() []string {
+	sources := []string{}
+	leader, err := s.leaderHTTPAddr()
+	if err == nil && leader != s.httpAddr {
+		sources = append(sources, leader)
+	}
+	for _, peer := range s.otherPeers() {
+		if peer != leader {
+			sources = append(sources, peer)
+		}
+	}
+	return sources
+}
+
+// handleReplicate responds the changes from the raft index given by the
+// from query with the entries as stored, for the replicas.
+func (s *Service) handleReplicate(ctx *gin.Context) {
+	if !isAdmin(ctx) {
+		ctx.JSON(http.StatusUnauthorized, StatusUnauthorized)
+		return
+	}
+
+	from, err := strconv.ParseUint(ctx.Query("from"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, StatusParamsError)
+		return
+	}
+	limit := changesBatchSize
+	if param := ctx.Query("limit"); param != "" {
+		if limit, err = strconv.Atoi(param); err != nil || limit <= 0 {
+			ctx.JSON(http.StatusBadRequest, StatusParamsError)
+			return
+		}
+	}
+
+	changes, next, err := s.store.ReplicatedChanges(from, limit)
+	if err == store.ErrResync {
+		ctx.JSON(http.StatusOK, replicateResp{Leader: s.store.Leader(), Resync: true})
+		return
+	}
+	if err != nil {
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return
+	}
+
+	resp := replicateResp{Leader: s.store.Leader(), Next: next, Changes: make([]replicatedResp, len(changes))}
+	for i, c := range changes {
+		resp.Changes[i] = replicatedResp{Index: c.Index, Op: c.Op, Key: []byte(c.Key), Entry: c.Entry}
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// resyncFrom replaces the store of the replica with a snapshot of the peer.
+func (s *Service) resyncFrom(peer, leader string) error {
+	req, err := http.NewRequest(http.MethodGet, urlutil.MakeURL(peer)+"/i/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", bearerPrefix+adminToken)
+
+	resp, err := snapshotClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responds %s for the snapshot", peer, resp.Status)
+	}
+
+	log.DB.Infoln(logPrefix, "resyncing from a snapshot of", peer)
+	return s.store.ResyncReplica(resp.Body, leader)
+}
+
+// handleSnapshot streams a snapshot of the store, for a replica to resync.
+func (s *Service) handleSnapshot(ctx *gin.Context) {
+	if !isAdmin(ctx) {
+		ctx.JSON(http.StatusUnauthorized, StatusUnauthorized)
+		return
+	}
+
+	ctx.Header("Content-Type", "application/octet-stream")
+	ctx.Status(http.StatusOK)
+	if err := s.store.WriteSnapshot(ctx.Writer); err != nil {
+		// the replica fails to read the snapshot cut short
+		log.DB.Error(logPrefix, err)
+	}
+}
+
+// handlePromote turns the replica into a voter for the admin: it opens its
+// raft log and joins the cluster, raft then catches it up from the leader.
+// The replica goes on following the leader if the join fails.
+func (s *Service) handlePromote(ctx *gin.Context) {
+	if !isAdmin(ctx) {
+		ctx.JSON(http.StatusUnauthorized, StatusUnauthorized)
+		return
+	}
+
+	s.roleMu.Lock()
+	defer s.roleMu.Unlock()
+	if s.store.Role() != store.RoleReplica {
+		ctx.JSON(http.StatusConflict, StatusRoleConflict)
+		return
+	}
+
+	s.stopReplica()
+	if err := s.store.Promote(); err != nil {
+		log.DB.Errorln(logPrefix, "failed to promote:", err)
+		s.startReplica()
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return
+	}
+
+	peers, err := master.Default.Peers()
+	if err == nil {
+		err = s.tryToJoin(peers, store.RoleVoter)
+	}
+	if err != nil {
+		log.DB.Errorln(logPrefix, "failed to join as a voter:", err)
+		if err := s.store.Demote(); err != nil {
+			log.DB.Errorln(logPrefix, "failed to demote back:", err)
+		}
+		s.startReplica()
+		ctx.JSON(http.StatusBadGateway, StatusInternalError)
+		return
+	}
+
+	log.DB.Infoln(logPrefix, "promoted to a voter")
+	ctx.JSON(http.StatusOK, StatusOK)
+}
+
+// handleDemote turns the voter into a replica for the admin: the leader
+// removes it from the cluster, a leader removes itself and steps down, then
+// the node follows the leader as a replica.
+func (s *Service) handleDemote(ctx *gin.Context) {
+	if !isAdmin(ctx) {
+		ctx.JSON(http.StatusUnauthorized, StatusUnauthorized)
+		return
+	}
+
+	s.roleMu.Lock()
+	defer s.roleMu.Unlock()
+	if s.store.Role() != store.RoleVoter {
+		ctx.JSON(http.StatusConflict, StatusRoleConflict)
+		return
+	}
+
+	if err := s.leaveCluster(); err != nil {
+		log.DB.Errorln(logPrefix, "failed to leave the cluster:", err)
+		ctx.JSON(http.StatusBadGateway, StatusInternalError)
+		return
+	}
+	if err := s.store.Demote(); err != nil {
+		log.DB.Errorln(logPrefix, "failed to demote:", err)
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return
+	}
+	s.startReplica()
+
+	log.DB.Infoln(logPrefix, "demoted to a replica")
+	ctx.JSON(http.StatusOK, StatusOK)
+}
+
+// leaveCluster removes the node from the raft members: the leader removes
+// itself, the other nodes ask the leader to remove them.
+func (s *Service) leaveCluster() error {
+	if s.raftAddr == s.store.Leader() {
+		peers, err := s.store.Peers()
+		if err != nil {
+			return err
+		}
+		if err := s.store.RemovePeer(s.raftAddr); err != nil {
+			return err
+		}
+		go func() {
+			if err := s.updatePeersOf(excludePeer(peers, s.raftAddr)); err != nil {
+				log.DB.Error(err)
+			}
+		}()
+		return nil
+	}
+
+	resp, err := s.askLeaderToRemove()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	status := Status{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return err
+	}
+	if status.Code != OK && status.Code != PeerNotFound {
+		return fmt.Errorf("leader responds %d: %s", status.Code, status.Message)
+	}
+	return nil
+}
@@ -1,5 +1,7 @@
 package service
 
+import "github.com/Focinfi/oncekv/db/node/store"
+
 const (
 	// OK for successful response
 	OK = 1000
@@ -7,12 +9,34 @@ const (
 	ParamsError = 1001
 	// KeyNotFound for key/value no found response
 	KeyNotFound = 1002
-	// KeyDuplicate for key/value duplicate response
+	// KeyDuplicate for a key which has been set with a different value
 	KeyDuplicate = 1003
 	// InternalError for internal error
 	InternalError = 1004
 	// NotLeaderError for not leader error
 	NotLeaderError = 1005
+	// BatchAborted for a pair not added because the atomic batch failed
+	BatchAborted = 1006
+	// KeyExists for a key which has been set with the same value
+	KeyExists = 1007
+	// ApplyTimeout for a read whose min_index was not applied in time
+	ApplyTimeout = 1008
+	// ValueTooLarge for a value larger than the max value size
+	ValueTooLarge = 1009
+	// NamespaceNotFound for a namespace not created
+	NamespaceNotFound = 1010
+	// Unauthorized for a token not granting the access to a namespace
+	Unauthorized = 1011
+	// HashMismatch for a content-addressed key not matching its value
+	HashMismatch = 1012
+	// PeerNotFound for removing a node which is not in the cluster
+	PeerNotFound = 1013
+	// RoleConflict for promoting a voter or demoting a replica
+	RoleConflict = 1014
+	// UnsupportedOp for a write some voter can not apply before it is upgraded
+	UnsupportedOp = 1015
+	// ChangesCompacted for reading the changes from an index not kept
+	ChangesCompacted = 1016
 )
 
 // Status for response
@@ -45,14 +69,133 @@ var StatusKeyDuplicate = Status{
 	Message: "key duplicate",
 }
 
+// StatusKeyExists for a key which has been set with the same value
+var StatusKeyExists = Status{
+	Code:    KeyExists,
+	Message: "key exists",
+}
+
+// StatusApplyTimeout for a read whose min_index was not applied in time
+var StatusApplyTimeout = Status{
+	Code:    ApplyTimeout,
+	Message: "min index not applied in time",
+}
+
+// StatusValueTooLarge for a value larger than the max value size
+var StatusValueTooLarge = Status{
+	Code:    ValueTooLarge,
+	Message: "value too large",
+}
+
+// StatusNamespaceNotFound for a namespace not created
+var StatusNamespaceNotFound = Status{
+	Code:    NamespaceNotFound,
+	Message: "namespace not found",
+}
+
+// StatusUnauthorized for a token not granting the access to a namespace
+var StatusUnauthorized = Status{
+	Code:    Unauthorized,
+	Message: "unauthorized",
+}
+
+// StatusHashMismatch for a content-addressed key not matching its value
+var StatusHashMismatch = Status{
+	Code:    HashMismatch,
+	Message: "key does not match the hash of the value",
+}
+
+// StatusShuttingDown for a write to a node shutting down, answered like a
+// write to a follower
+var StatusShuttingDown = Status{
+	Code:    NotLeaderError,
+	Message: "i am shutting down",
+}
+
+// StatusPeerNotFound for removing a node which is not in the cluster
+var StatusPeerNotFound = Status{
+	Code:    PeerNotFound,
+	Message: "peer not found",
+}
+
+// StatusRoleConflict for promoting a voter or demoting a replica
+var StatusRoleConflict = Status{
+	Code:    RoleConflict,
+	Message: "node already has the role",
+}
+
+// StatusUnsupportedOp for a write some voter can not apply before it is
+// upgraded
+var StatusUnsupportedOp = Status{
+	Code:    UnsupportedOp,
+	Message: "not supported by every node yet",
+}
+
+// StatusChangesCompacted for reading the changes from an index not kept
+var StatusChangesCompacted = Status{
+	Code:    ChangesCompacted,
+	Message: "changes compacted, read from 0 for the oldest kept",
+}
+
 // StatusInternalError for internal error
 var StatusInternalError = Status{
 	Code:    InternalError,
 	Message: "internal error",
 }
 
+// StatusBatchAborted for a pair not added because the atomic batch failed
+var StatusBatchAborted = Status{
+	Code:    BatchAborted,
+	Message: "batch aborted",
+}
+
 // StatusOK for successful status
 var StatusOK = Status{
 	Code:    OK,
 	Message: "",
 }
+
+// WriteStatus for the response of a write, with the request ID of the
+// write holding the key and the raft index of the write, a read with the
+// index as min_index sees the write
+type WriteStatus struct {
+	Status
+	RequestID string `json:"request_id,omitempty"`
+	Index     uint64 `json:"index,omitempty"`
+}
+
+// KeyStatus for the status of one key in a batch
+type KeyStatus struct {
+	Key string `json:"key"`
+	WriteStatus
+}
+
+// BatchStatus for the response of a batch
+type BatchStatus struct {
+	Status
+	Index   uint64      `json:"index,omitempty"`
+	Results []KeyStatus `json:"results"`
+}
+
+// writeStatusOf returns the response of the result of adding a key
+func writeStatusOf(res store.AddResult) WriteStatus {
+	return WriteStatus{Status: statusOfResult(res.Result), RequestID: res.RequestID, Index: res.Index}
+}
+
+// statusOfResult returns the status of the result of adding a key
+func statusOfResult(res store.Result) Status {
+	switch res {
+	case store.Created:
+		return StatusOK
+	case store.Exists:
+		return StatusKeyExists
+	case store.Conflict:
+		return StatusKeyDuplicate
+	case store.NotLeader:
+		return StatusNotLeaderError
+	case store.Aborted:
+		return StatusBatchAborted
+	default:
+		return StatusInternalError
+	}
+}
@@ -0,0 +1,364 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Focinfi/oncekv/config"
+	"github.com/Focinfi/oncekv/db/master"
+	"github.com/Focinfi/oncekv/db/node/store"
+	"github.com/Focinfi/oncekv/log"
+	"github.com/Focinfi/oncekv/utils/urlutil"
+	"github.com/gin-gonic/gin"
+)
+
+// The scrubber walks the local entries a page of keys at a time. An entry
+// failing its checksum is repaired with the entry of a peer, and the
+// checksums of every page are compared with the peers by their digests, a
+// key whose checksum differs from the one most peers agree on is repaired
+// the same way. The peers serve the digests, the checksums and the entries
+// on the internal routes for the admin token only, so without the token
+// the scrubber only finds the corrupted entries.
+
+const (
+	// scrubPageKeys limits the keys of a page compared with the peers
+	scrubPageKeys = 1000
+
+	// maxRepairedKeys limits the keys repaired kept for /stats
+	maxRepairedKeys = 10
+)
+
+var scrubInterval = config.Config.ScrubInterval
+
+// digestResp for the response of GET /i/digest
+type digestResp struct {
+	Digest string `json:"digest"`
+	Count  int    `json:"count"`
+}
+
+// checksumResp for a checksum of GET /i/checksums, the key is in bytes
+// since the stored keys of the namespaces are not valid UTF-8
+type checksumResp struct {
+	Key       []byte `json:"key"`
+	Checksum  uint32 `json:"checksum"`
+	Index     uint64 `json:"index"`
+	Corrupted bool   `json:"corrupted,omitempty"`
+}
+
+// scrubRun counts what a run of the scrubber found and fixed.
+type scrubRun struct {
+	checked    int
+	corrupted  int
+	mismatched int
+	repaired   int
+	failed     int
+	keys       []string
+}
+
+// repaired records the key repaired.
+func (run *scrubRun) repair(key string) {
+	run.repaired++
+	if len(run.keys) < maxRepairedKeys {
+		run.keys = append(run.keys, strconv.Quote(key))
+	}
+}
+
+// scrubStats keeps the totals of the runs and the last one for /stats.
+type scrubStats struct {
+	sync.Mutex
+	runs     int
+	repaired int
+	lastRun  time.Time
+	last     scrubRun
+}
+
+func (st *scrubStats) record(run scrubRun) {
+	st.Lock()
+	defer st.Unlock()
+	st.runs++
+	st.repaired += run.repaired
+	st.lastRun = time.Now()
+	st.last = run
+}
+
+func (st *scrubStats) stats() map[string]string {
+	st.Lock()
+	defer st.Unlock()
+	stats := map[string]string{
+		"scrub_runs":           strconv.Itoa(st.runs),
+		"scrub_repaired_total": strconv.Itoa(st.repaired),
+		"scrub_checked":        strconv.Itoa(st.last.checked),
+		"scrub_corrupted":      strconv.Itoa(st.last.corrupted),
+		"scrub_mismatched":     strconv.Itoa(st.last.mismatched),
+		"scrub_repaired":       strconv.Itoa(st.last.repaired),
+		"scrub_failed":         strconv.Itoa(st.last.failed),
+		"scrub_repaired_keys":  strings.Join(st.last.keys, " "),
+	}
+	if !st.lastRun.IsZero() {
+		stats["scrub_last_run"] = st.lastRun.Format(time.RFC3339)
+	}
+	return stats
+}
+
+// stats returns the stats of the store and of the scrubber.
+func (s *Service) stats() map[string]string {
+	stats := s.store.Stats()
+	for k, v := range s.scrub.stats() {
+		stats[k] = v
+	}
+	return stats
+}
+
+// runScrubber scrubs the local entries every scrubInterval, until the node
+// shuts down.
+func (s *Service) runScrubber() {
+	if scrubInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(scrubInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.scrubOnce()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// scrubOnce checks all the local entries once.
+func (s *Service) scrubOnce() {
+	peers := s.scrubPeers()
+	run := scrubRun{}
+	after := ""
+	for {
+		sums, err := s.store.Checksums(after, "", scrubPageKeys)
+		if err != nil {
+			log.DB.Errorln(logPrefix, "failed to read the checksums:", err)
+			break
+		}
+		if len(sums) == 0 {
+			break
+		}
+
+		last := sums[len(sums)-1].Key
+		s.scrubPage(sums, after, last, peers, &run)
+		after = last
+	}
+
+	if run.corrupted > 0 || run.mismatched > 0 {
+		log.DB.Infof("%s scrubbed %d keys, %d corrupted, %d mismatched, %d repaired, %d failed",
+			logPrefix, run.checked, run.corrupted, run.mismatched, run.repaired, run.failed)
+	}
+	s.scrub.record(run)
+}
+
+// scrubPeers returns the HTTP addresses of the other db nodes, none if the
+// admin token to read from them is not set.
+func (s *Service) scrubPeers() []string {
+	if adminToken == "" {
+		return nil
+	}
+	return s.otherPeers()
+}
+
+// otherPeers returns the HTTP addresses of the other db nodes.
+func (s *Service) otherPeers() []string {
+	peers, err := master.Default.Peers()
+	if err != nil {
+		log.DB.Errorln(logPrefix, "failed to get the peers:", err)
+		return nil
+	}
+
+	others := []string{}
+	for _, peer := range peers {
+		if peer != s.httpAddr {
+			others = append(others, peer)
+		}
+	}
+	return others
+}
+
+// scrubPage checks the checksums of the key range (after, last], and
+// repairs the keys corrupted or in the minority of the replicas.
+func (s *Service) scrubPage(sums []store.KeyChecksum, after, last string, peers []string, run *scrubRun) {
+	rangeQuery := url.Values{"after": {after}, "last": {last}}.Encode()
+	digest := store.Digest(sums)
+
+	// the checksums of the peers whose digests differ, the others agree
+	agreed := 0
+	differed := map[string]map[string]store.KeyChecksum{}
+	for _, peer := range peers {
+		resp := digestResp{}
+		if err := s.getPeer(peer, "/i/digest?"+rangeQuery, &resp); err != nil {
+			log.DB.Errorln(logPrefix, "failed to get the digest:", err)
+			continue
+		}
+		if resp.Digest == digest {
+			agreed++
+			continue
+		}
+
+		peerSums := []checksumResp{}
+		if err := s.getPeer(peer, "/i/checksums?"+rangeQuery, &peerSums); err != nil {
+			log.DB.Errorln(logPrefix, "failed to get the checksums:", err)
+			continue
+		}
+		byKey := make(map[string]store.KeyChecksum, len(peerSums))
+		for _, sum := range peerSums {
+			byKey[string(sum.Key)] = store.KeyChecksum{Key: string(sum.Key), Checksum: sum.Checksum, Index: sum.Index, Corrupted: sum.Corrupted}
+		}
+		differed[peer] = byKey
+	}
+
+	for _, sum := range sums {
+		run.checked++
+		if sum.Corrupted {
+			run.corrupted++
+			s.repairKey(sum.Key, peers, run)
+			continue
+		}
+
+		// the votes of the replicas for the checksums of the key
+		votes := map[store.KeyChecksum]int{{Checksum: sum.Checksum, Index: sum.Index}: 1 + agreed}
+		holders := map[store.KeyChecksum][]string{}
+		for peer, byKey := range differed {
+			peerSum, ok := byKey[sum.Key]
+			if !ok || peerSum.Corrupted {
+				continue
+			}
+			vote := store.KeyChecksum{Checksum: peerSum.Checksum, Index: peerSum.Index}
+			votes[vote]++
+			holders[vote] = append(holders[vote], peer)
+		}
+		if len(votes) == 1 {
+			continue
+		}
+
+		run.mismatched++
+		local := votes[store.KeyChecksum{Checksum: sum.Checksum, Index: sum.Index}]
+		for vote, count := range votes {
+			if count > local && count*2 > len(peers)+1 {
+				s.repairKey(sum.Key, holders[vote], run)
+				break
+			}
+		}
+	}
+}
+
+// repairKey repairs the local entry of the key with the entry of the first
+// of the peers holding a healthy one.
+func (s *Service) repairKey(key string, peers []string, run *scrubRun) {
+	for _, peer := range peers {
+		b, err := s.readPeer(peer, "/i/entry?"+url.Values{"key": {key}}.Encode())
+		if err != nil {
+			log.DB.Errorln(logPrefix, "failed to get the entry:", err)
+			continue
+		}
+		if err := s.store.Repair(key, b); err != nil {
+			log.DB.Errorf("%s failed to repair %q with the entry of %s: %v", logPrefix, key, peer, err)
+			continue
+		}
+
+		log.DB.Infof("%s repaired %q with the entry of %s", logPrefix, key, peer)
+		run.repair(key)
+		return
+	}
+	run.failed++
+}
+
+// getPeer decodes the JSON response of the internal route of a peer.
+func (s *Service) getPeer(peer, path string, v interface{}) error {
+	b, err := s.readPeer(peer, path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// readPeer reads the response of the internal route of a peer.
+func (s *Service) readPeer(peer, path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, urlutil.MakeURL(peer)+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", bearerPrefix+adminToken)
+
+	resp, err := forwardClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responds %s for %s", peer, resp.Status, path)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// checksumsOf returns the local checksums of the range of the request.
+func (s *Service) checksumsOf(ctx *gin.Context) ([]store.KeyChecksum, bool) {
+	if !isAdmin(ctx) {
+		ctx.JSON(http.StatusUnauthorized, StatusUnauthorized)
+		return nil, false
+	}
+
+	sums, err := s.store.Checksums(ctx.Query("after"), ctx.Query("last"), 0)
+	if err != nil {
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return nil, false
+	}
+	return sums, true
+}
+
+// handleDigest responds the digest of the local checksums of a key range.
+func (s *Service) handleDigest(ctx *gin.Context) {
+	sums, ok := s.checksumsOf(ctx)
+	if !ok {
+		return
+	}
+	ctx.JSON(http.StatusOK, digestResp{Digest: store.Digest(sums), Count: len(sums)})
+}
+
+// handleChecksums responds the local checksums of a key range.
+func (s *Service) handleChecksums(ctx *gin.Context) {
+	sums, ok := s.checksumsOf(ctx)
+	if !ok {
+		return
+	}
+	resp := make([]checksumResp, len(sums))
+	for i, sum := range sums {
+		resp[i] = checksumResp{Key: []byte(sum.Key), Checksum: sum.Checksum, Index: sum.Index, Corrupted: sum.Corrupted}
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// handleEntry responds the local entry of a key as stored.
+func (s *Service) handleEntry(ctx *gin.Context) {
+	if !isAdmin(ctx) {
+		ctx.JSON(http.StatusUnauthorized, StatusUnauthorized)
+		return
+	}
+
+	b, err := s.store.Entry(ctx.Query("key"))
+	if err != nil {
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return
+	}
+	if b == nil {
+		ctx.JSON(http.StatusNotFound, StatusKeyNotFound)
+		return
+	}
+	ctx.Data(http.StatusOK, "application/octet-stream", b)
+}
@@ -4,16 +4,21 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/Focinfi/oncekv/config"
 	"github.com/Focinfi/oncekv/db/master"
 	"github.com/Focinfi/oncekv/db/node/store"
 	"github.com/Focinfi/oncekv/log"
-	"github.com/Focinfi/oncekv/raftboltdb"
 	"github.com/Focinfi/oncekv/utils/mock"
 	"github.com/Focinfi/oncekv/utils/urlutil"
 	"github.com/gin-gonic/gin"
@@ -23,19 +28,96 @@ import (
 const (
 	logPrefix     = "db/node/service:"
 	joinURLFormat = "%s/join"
+
+	// maxBatchPairs limits the pairs of one batch
+	maxBatchPairs = 10000
+
+	// minIndexTimeout limits waiting for the min_index of a read
+	minIndexTimeout = 5 * time.Second
+
+	// maxWait limits the wait of a read waiting for its key
+	maxWait = time.Minute
+
+	// defaultListLimit and maxListLimit for the count of keys of a listing
+	defaultListLimit = 100
+	maxListLimit     = 1000
 )
 
 var (
 	httpPoster = mock.HTTPPoster(mock.HTTPPosterFunc(http.Post))
+
+	errNoLeader = errors.New("no leader")
+
+	wsUpgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
 )
 
+// joinParams for the body of POST /join, the role is store.RoleVoter by
+// default or store.RoleReplica, the max op is store.MaxOp of the node
 type joinParams struct {
-	Addr string `json:"addr"`
+	Addr  string `json:"addr"`
+	Role  string `json:"role,omitempty"`
+	MaxOp byte   `json:"max_op,omitempty"`
+}
+
+type pairParams struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
 }
 
-type kvResp struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+// metaResp for the response of GET /i/key/:key, the value is encoded as
+// the encoding tells
+type metaResp struct {
+	Key         string    `json:"key"`
+	Value       string    `json:"value"`
+	Encoding    string    `json:"encoding,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Index       uint64    `json:"index"`
+	Term        uint64    `json:"term"`
+	Timestamp   time.Time `json:"timestamp"`
+	Writer      string    `json:"writer,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+	// ExpiresAt is nil for a key which never expires
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Checksum is the CRC-32C of the value in 8 hex digits, for the
+	// readers to verify the value
+	Checksum string `json:"checksum"`
+}
+
+// listResp for the response of GET /keys, the following page starts after
+// the last key if there are more
+type listResp struct {
+	Keys []string `json:"keys"`
+	More bool     `json:"more"`
+}
+
+type setParams struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	Encoding    string `json:"encoding"`
+	ContentType string `json:"content_type"`
+	RequestID   string `json:"request_id"`
+	Writer      string `json:"writer"`
+	TTL         string `json:"ttl"`
+	// ContentAddressed requires the key to be the hash of the value
+	ContentAddressed bool `json:"content_addressed"`
+}
+
+type batchParams struct {
+	Atomic      bool         `json:"atomic"`
+	Pairs       []pairParams `json:"pairs"`
+	ContentType string       `json:"content_type"`
+	RequestID   string       `json:"request_id"`
+	Writer      string       `json:"writer"`
+	TTL         string       `json:"ttl"`
+	// ContentAddressed requires every key to be the hash of its value
+	ContentAddressed bool `json:"content_addressed"`
 }
 
 // Store is the interface Raft-backed key-value stores must implement.
@@ -43,15 +125,94 @@ type Store interface {
 	// Open opens a store in a single mode or not
 	Open(singleMode bool) error
 
-	// Get returns the value for the given key.
-	Get(key string) (string, error)
+	// OpenReplica opens the store as a replica, applying the changes given
+	// to ApplyReplicated instead of a raft log.
+	OpenReplica() error
+
+	// Role returns store.RoleVoter or store.RoleReplica.
+	Role() string
+
+	// Promote turns the replica into a voter, which has to be joined.
+	Promote() error
+
+	// Demote turns the voter removed from the cluster into a replica.
+	Demote() error
+
+	// ReplicatedChanges returns the changes from the raft index from with
+	// the entries as stored, and the index to read the following ones from.
+	ReplicatedChanges(from uint64, limit int) ([]store.ReplicatedChange, uint64, error)
+
+	// ApplyReplicated applies the changes on a replica, up to next-1, and
+	// records the leader they come from.
+	ApplyReplicated(changes []store.ReplicatedChange, next uint64, leader string) error
+
+	// AppliedIndex returns the last raft index applied.
+	AppliedIndex() uint64
+
+	// WriteSnapshot writes a snapshot of the store into w.
+	WriteSnapshot(w io.Writer) error
 
-	// Add adds key/value, via distributed consensus.
-	Add(key, value string) error
+	// ResyncReplica replaces the store of a replica with the snapshot read
+	// from r, and records the leader it comes from.
+	ResyncReplica(r io.Reader, leader string) error
+
+	// VerifyRead returns nil if the store can serve a read of the given
+	// consistency level, or store.ErrNotLeader.
+	VerifyRead(c store.Consistency) error
+
+	// WaitApplied waits until the raft index is applied, or returns
+	// store.ErrApplyTimeout.
+	WaitApplied(index uint64, timeout time.Duration) error
+
+	// WaitKey returns the value and the metadata for the given key once it
+	// is added, or a nil metadata if ctx is done before.
+	WaitKey(ctx context.Context, key string) ([]byte, *store.Meta, error)
+
+	// GetWithMeta returns the value and the metadata for the given key,
+	// the metadata is nil if the key does not exist.
+	GetWithMeta(key string) ([]byte, *store.Meta, error)
+
+	// Add adds key/value, via distributed consensus. A retry with the same
+	// request ID and value gets store.Created again.
+	Add(key string, value []byte, opts store.WriteOptions) (store.AddResult, error)
+
+	// AddBatch adds the pairs in one log entry, and returns the result of
+	// every pair. If atomic is set, no pair is added when any key exists.
+	AddBatch(pairs []store.Pair, atomic bool, opts store.WriteOptions) ([]store.AddResult, error)
+
+	// List returns the keys selected by opts in order, and whether there
+	// are more keys after them.
+	List(opts store.ListOptions) ([]string, bool, error)
+
+	// Changes returns the changes from the raft index from, and the index
+	// to read the following changes from.
+	Changes(from uint64, limit int) ([]store.Change, uint64, error)
+
+	// Purge deletes the key and records the purge in the audit records.
+	Purge(key, operator, reason string) (*store.Purge, error)
+
+	// Purges returns the audit records of the purges.
+	Purges() ([]store.Purge, error)
+
+	// Checksums returns the checksums of the entries in the key range
+	// (after, last], at most limit of them if limit is positive.
+	Checksums(after, last string, limit int) ([]store.KeyChecksum, error)
+
+	// Entry returns the encoded entry of the key, or nil if it does not
+	// exist.
+	Entry(key string) ([]byte, error)
+
+	// Repair replaces the local entry of the key with the encoded entry of
+	// a healthy replica.
+	Repair(key string, b []byte) error
 
 	// Join joins the node, reachable at addr, to the cluster.
 	Join(addr string) error
 
+	// RemovePeer removes the node at the raft addr from the cluster, or
+	// returns store.ErrNotLeader.
+	RemovePeer(addr string) error
+
 	// Peers returns the store peers
 	Peers() ([]string, error)
 
@@ -60,6 +221,17 @@ type Store interface {
 
 	// Stats return the stats as a map[string]string
 	Stats() map[string]string
+
+	// SetClusterOp sets the highest op every voter applies, the store
+	// refuses the writes of higher ops with store.ErrUnsupportedOp.
+	SetClusterOp(op byte)
+
+	// Drain stops the store taking writes and waits for the ones in
+	// flight, the leader returns the index of its last log entry.
+	Drain() (uint64, error)
+
+	// Shutdown shuts the store down gracefully.
+	Shutdown() error
 }
 
 // Service provides HTTP service.
@@ -74,6 +246,27 @@ type Service struct {
 
 	// underlying store
 	store Store
+
+	// the stats of the scrubber
+	scrub scrubStats
+
+	// the addresses of the leader
+	leader leaderAddrs
+
+	// the max op of the voters, for the ops the leader proposes
+	voterOps voterOps
+
+	// the role the node starts with, and the loop following the leader
+	// while it is a replica
+	role        string
+	roleMu      sync.Mutex // Held while promoting or demoting.
+	replication replication
+
+	server       *http.Server
+	draining     int32
+	shutdownOnce sync.Once
+	done         chan struct{} // Closed when the node starts shutting down.
+	stopped      chan struct{} // Closed when the node has shut down.
 }
 
 // New returns an uninitialized HTTP service.
@@ -81,34 +274,53 @@ func New(httpAddr string, raftAddr string, storeDir string) *Service {
 	storage := store.New()
 	storage.RaftBind = raftAddr
 	storage.RaftDir = storeDir
+	storage.GroupWindow = config.Config.GroupCommitWindow
 
 	s := &Service{
 		httpAddr: httpAddr,
 		raftAddr: raftAddr,
 		store:    storage,
+		role:     store.SavedRole(storeDir),
 		Engine:   gin.Default(),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	s.server = &http.Server{Addr: httpAddr, Handler: s.Engine}
+	s.Use(s.setLeaderHeader, s.rejectDrainedWrites)
+
+	// the keys of the default namespace, and of the namespace :ns
+	for _, routes := range []gin.IRoutes{s.Engine, s.Group("/ns/:ns")} {
+		routes.GET("/i/key/*key", s.handleGet)
+		routes.POST("/key", s.handleSet)
+		routes.PUT("/key/*key", s.handlePut)
+		routes.POST("/cas", s.handleCAS)
+		routes.GET("/keys", s.handleList)
+		routes.POST("/keys", s.handleSetBatch)
+		routes.GET("/ws/changes", s.handleChanges)
 	}
-
-	s.GET("/i/key/:key", s.handleGet)
-	s.POST("/key", s.handleSet)
 	s.POST("/join", s.handleJoin)
+	s.GET("/peers", s.handlePeers)
+	s.DELETE("/peers/:addr", s.handleRemovePeer)
+	s.POST("/leave", s.handleLeave)
+	s.POST("/shutdown", s.handleShutdown)
+	s.POST("/purge", s.handlePurge)
+	s.GET("/purges", s.handlePurges)
+	s.GET("/i/digest", s.handleDigest)
+	s.GET("/i/checksums", s.handleChecksums)
+	s.GET("/i/entry", s.handleEntry)
+	s.GET("/i/replicate", s.handleReplicate)
+	s.GET("/i/snapshot", s.handleSnapshot)
+	s.POST("/promote", s.handlePromote)
+	s.POST("/demote", s.handleDemote)
 	s.GET("/ping", func(ctx *gin.Context) {
 		ctx.String(http.StatusOK, "pong")
 	})
 	s.GET("/stats", func(ctx *gin.Context) {
-		ctx.JSON(http.StatusOK, s.store.Stats())
+		ctx.JSON(http.StatusOK, s.stats())
 	})
 
-	var wsupgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-
 	s.GET("/ws/stats", func(ctx *gin.Context) {
-		conn, err := wsupgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+		conn, err := wsUpgrader.Upgrade(ctx.Writer, ctx.Request, nil)
 		if err != nil {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err})
 			return
@@ -118,7 +330,7 @@ func New(httpAddr string, raftAddr string, storeDir string) *Service {
 		for {
 			select {
 			case <-time.After(time.Second):
-				b, err := json.Marshal(s.store.Stats())
+				b, err := json.Marshal(s.stats())
 				if err != nil {
 					log.DB.Error(err)
 					continue
@@ -134,6 +346,14 @@ func New(httpAddr string, raftAddr string, storeDir string) *Service {
 	return s
 }
 
+// NewReplica returns an uninitialized HTTP service of a replica, which
+// receives the changes of the leader without voting.
+func NewReplica(httpAddr string, raftAddr string, storeDir string) *Service {
+	s := New(httpAddr, raftAddr, storeDir)
+	s.role = store.RoleReplica
+	return s
+}
+
 // Start starts the service.
 func (s *Service) Start() {
 	if err := s.register(); err != nil {
@@ -147,7 +367,15 @@ func (s *Service) Start() {
 
 	log.DB.Infoln(logPrefix, "Peers:", peers)
 
-	if len(peers) == 0 {
+	if s.role == store.RoleReplica {
+		if len(peers) == 0 {
+			log.DB.Fatal(logPrefix, " a replica needs a cluster to follow")
+		}
+		if err := s.store.OpenReplica(); err != nil {
+			log.DB.Fatal(err)
+		}
+		s.startReplica()
+	} else if len(peers) == 0 {
 		if err := s.store.Open(true); err != nil {
 			log.DB.Fatal(err)
 		}
@@ -159,70 +387,330 @@ func (s *Service) Start() {
 		if err := s.store.Open(false); err != nil {
 			log.DB.Fatal(err)
 		}
-		if err := s.tryToJoin(peers); err != nil {
+		if err := s.tryToJoin(peers, store.RoleVoter); err != nil {
 			log.DB.Fatal(err)
 		}
 	}
 
-	log.DB.Fatal(s.Run(s.httpAddr))
+	go s.runScrubber()
+	go s.runOpsGate()
+	go s.handleSignals()
+	if err := s.server.ListenAndServe(); err != http.ErrServerClosed {
+		log.DB.Fatal(err)
+	}
+	<-s.stopped
 }
 
+// handleGet serves the key on any node: a key never changes once added, so
+// a node holding it can always serve it. A miss is only answered by a node
+// meeting the consistency level, or after the node applies the min_index
+// given by the caller, other nodes forward it to the leader. With the wait
+// query, a miss waits up to that long for the key to be added first.
 func (s *Service) handleGet(ctx *gin.Context) {
-	if s.raftAddr != s.store.Leader() {
-		ctx.JSON(http.StatusBadRequest, StatusNotLeaderError)
+	sc, ok := scopeOf(ctx)
+	if !ok {
 		return
 	}
 
-	key := ctx.Param("key")
-	if key == "" {
+	key := keyParam(ctx)
+	consistency, err := store.ParseConsistency(ctx.Query("consistency"))
+	if !sc.validKey(key) || err != nil {
 		ctx.JSON(http.StatusBadRequest, StatusParamsError)
 		return
 	}
 
-	val, err := s.store.Get(key)
+	var minIndex uint64
+	if param := ctx.Query("min_index"); param != "" {
+		if minIndex, err = strconv.ParseUint(param, 10, 64); err != nil {
+			ctx.JSON(http.StatusBadRequest, StatusParamsError)
+			return
+		}
+	}
+
+	var wait time.Duration
+	if param := ctx.Query("wait"); param != "" {
+		if wait, err = time.ParseDuration(param); err != nil || wait < 0 {
+			ctx.JSON(http.StatusBadRequest, StatusParamsError)
+			return
+		}
+		if wait > maxWait {
+			wait = maxWait
+		}
+	}
+
+	val, meta, err := s.store.GetWithMeta(sc.key(key))
 	if err != nil {
 		fmt.Println(logPrefix, "Get Error: ", val, err)
 		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
 		return
 	}
 
-	if val == "" {
-		ctx.JSON(http.StatusNotFound, StatusKeyNotFound)
+	if meta == nil && wait > 0 {
+		// Every node applies the adds, so waiting needs no leader. The
+		// forwarded miss after the wait does not wait again.
+		waitCtx, cancel := context.WithTimeout(ctx.Request.Context(), wait)
+		val, meta, err = s.store.WaitKey(waitCtx, sc.key(key))
+		cancel()
+		if err != nil {
+			log.DB.Error(logPrefix, err)
+			ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+			return
+		}
+
+		query := ctx.Request.URL.Query()
+		query.Del("wait")
+		ctx.Request.URL.RawQuery = query.Encode()
+	}
+
+	if meta == nil {
+		if !s.verifyRead(ctx, consistency, minIndex) {
+			return
+		}
+
+		// Read again, the key may have been applied while waiting.
+		if val, meta, err = s.store.GetWithMeta(sc.key(key)); err != nil {
+			log.DB.Error(logPrefix, err)
+			ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+			return
+		}
+		if meta == nil {
+			ctx.JSON(http.StatusNotFound, StatusKeyNotFound)
+			return
+		}
+	}
+
+	if ctx.Query("format") == formatRaw {
+		writeRaw(ctx, val, meta)
+		return
+	}
+	ctx.JSON(http.StatusOK, metaRespOf(key, val, meta))
+}
+
+// verifyRead checks that the node can serve a read of the consistency
+// level, or waits until it applies minIndex if it is set. If it can not,
+// the read is forwarded to the leader or answered with the error, and
+// verifyRead returns false.
+func (s *Service) verifyRead(ctx *gin.Context, consistency store.Consistency, minIndex uint64) bool {
+	var err error
+	if minIndex > 0 {
+		err = s.store.WaitApplied(minIndex, minIndexTimeout)
+	} else {
+		err = s.store.VerifyRead(consistency)
+	}
+
+	switch {
+	case err == nil:
+		return true
+	case err == store.ErrNotLeader && !isForwarded(ctx):
+		s.forwardToLeader(ctx)
+	case err == store.ErrNotLeader:
+		ctx.JSON(http.StatusBadRequest, StatusNotLeaderError)
+	case err == store.ErrApplyTimeout:
+		ctx.JSON(http.StatusServiceUnavailable, StatusApplyTimeout)
+	default:
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+	}
+	return false
+}
+
+// handleList lists the keys in order. Unlike a key, a listing changes with
+// every add, so it is always served at the consistency level.
+func (s *Service) handleList(ctx *gin.Context) {
+	sc, ok := scopeOf(ctx)
+	if !ok {
+		return
+	}
+
+	consistency, err := store.ParseConsistency(ctx.Query("consistency"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, StatusParamsError)
 		return
 	}
 
-	ctx.JSON(http.StatusOK, kvResp{Key: key, Value: val})
+	var minIndex uint64
+	if param := ctx.Query("min_index"); param != "" {
+		if minIndex, err = strconv.ParseUint(param, 10, 64); err != nil {
+			ctx.JSON(http.StatusBadRequest, StatusParamsError)
+			return
+		}
+	}
+
+	opts := store.ListOptions{
+		Prefix: ctx.Query("prefix"),
+		After:  ctx.Query("after"),
+		End:    ctx.Query("end"),
+		Limit:  defaultListLimit,
+	}
+	if param := ctx.Query("limit"); param != "" {
+		if opts.Limit, err = strconv.Atoi(param); err != nil || opts.Limit <= 0 {
+			ctx.JSON(http.StatusBadRequest, StatusParamsError)
+			return
+		}
+		if opts.Limit > maxListLimit {
+			opts.Limit = maxListLimit
+		}
+	}
+
+	if !s.verifyRead(ctx, consistency, minIndex) {
+		return
+	}
+
+	keys, more, err := s.store.List(sc.listOptions(opts))
+	if err != nil {
+		log.DB.Error(logPrefix, err)
+		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+		return
+	}
+	for i, key := range keys {
+		keys[i] = sc.userKey(key)
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	ctx.JSON(http.StatusOK, listResp{Keys: keys, More: more})
 }
 
 func (s *Service) handleSet(ctx *gin.Context) {
-	if s.raftAddr != s.store.Leader() {
-		ctx.JSON(http.StatusBadRequest, StatusNotLeaderError)
+	if !s.leadsWrites(ctx) {
 		return
 	}
 
-	params := &struct {
-		Key   string `json:"key"`
-		Value string `json:"value"`
-	}{}
+	sc, ok := scopeOf(ctx)
+	if !ok {
+		return
+	}
 
-	if err := ctx.BindJSON(params); err != nil {
+	params := &setParams{}
+	if err := ctx.BindJSON(params); err != nil || !sc.validKey(params.Key) {
 		ctx.JSON(http.StatusOK, StatusParamsError)
 		return
 	}
 
-	err := s.store.Add(params.Key, params.Value)
-	if err == raftboltdb.ErrKeyDuplicated {
-		ctx.JSON(http.StatusOK, StatusKeyDuplicate)
+	value, err := decodeValue(params.Value, params.Encoding)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, StatusParamsError)
+		return
+	}
+	if int64(len(value)) > sc.maxValueBytes {
+		ctx.JSON(http.StatusRequestEntityTooLarge, StatusValueTooLarge)
+		return
+	}
+	if !sc.verify(params.Key, value, params.ContentAddressed) {
+		ctx.JSON(http.StatusBadRequest, StatusHashMismatch)
 		return
 	}
+	ttl, err := parseTTL(params.TTL)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, StatusParamsError)
+		return
+	}
+
+	opts := store.WriteOptions{RequestID: params.RequestID, Writer: params.Writer, ContentType: params.ContentType, TTL: ttl}
+	s.add(ctx, sc.key(params.Key), value, opts)
+}
+
+// add adds the key/value and responds the outcome.
+func (s *Service) add(ctx *gin.Context, key string, value []byte, opts store.WriteOptions) {
+	if res, ok := s.tryAdd(ctx, key, value, opts); ok {
+		ctx.JSON(http.StatusOK, writeStatusOf(res))
+	}
+}
 
+// tryAdd adds the key/value, or responds the error and returns false if
+// the store failed to add it.
+func (s *Service) tryAdd(ctx *gin.Context, key string, value []byte, opts store.WriteOptions) (store.AddResult, bool) {
+	res, err := s.store.Add(key, value, opts)
+	if err == store.ErrKeyTooLarge {
+		ctx.JSON(http.StatusBadRequest, StatusParamsError)
+		return res, false
+	}
 	if err != nil {
 		log.DB.Error(err)
 		ctx.JSON(http.StatusOK, StatusInternalError)
+		return res, false
+	}
+
+	if res.Result == store.NotLeader {
+		ctx.JSON(http.StatusBadRequest, StatusNotLeaderError)
+		return res, false
+	}
+	return res, true
+}
+
+func (s *Service) handleSetBatch(ctx *gin.Context) {
+	if !s.leadsWrites(ctx) {
 		return
 	}
 
-	ctx.JSON(http.StatusOK, StatusOK)
+	sc, ok := scopeOf(ctx)
+	if !ok {
+		return
+	}
+
+	params := &batchParams{}
+	if err := ctx.BindJSON(params); err != nil ||
+		len(params.Pairs) == 0 || len(params.Pairs) > maxBatchPairs {
+		ctx.JSON(http.StatusBadRequest, StatusParamsError)
+		return
+	}
+	ttl, err := parseTTL(params.TTL)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, StatusParamsError)
+		return
+	}
+
+	pairs := make([]store.Pair, len(params.Pairs))
+	for i, pair := range params.Pairs {
+		value, err := decodeValue(pair.Value, pair.Encoding)
+		if !sc.validKey(pair.Key) || err != nil {
+			ctx.JSON(http.StatusBadRequest, StatusParamsError)
+			return
+		}
+		if int64(len(value)) > sc.maxValueBytes {
+			ctx.JSON(http.StatusRequestEntityTooLarge, StatusValueTooLarge)
+			return
+		}
+		if !sc.verify(pair.Key, value, params.ContentAddressed) {
+			ctx.JSON(http.StatusBadRequest, StatusHashMismatch)
+			return
+		}
+		pairs[i] = store.Pair{Key: sc.key(pair.Key), Value: value}
+	}
+
+	opts := store.WriteOptions{RequestID: params.RequestID, Writer: params.Writer, ContentType: params.ContentType, TTL: ttl}
+	results, err := s.store.AddBatch(pairs, params.Atomic, opts)
+	if err == store.ErrKeyTooLarge {
+		ctx.JSON(http.StatusBadRequest, StatusParamsError)
+		return
+	}
+	if err == store.ErrUnsupportedOp {
+		ctx.JSON(http.StatusServiceUnavailable, StatusUnsupportedOp)
+		return
+	}
+	if err != nil {
+		log.DB.Error(err)
+		ctx.JSON(http.StatusOK, StatusInternalError)
+		return
+	}
+
+	if len(results) > 0 && results[0].Result == store.NotLeader {
+		ctx.JSON(http.StatusBadRequest, StatusNotLeaderError)
+		return
+	}
+
+	resp := BatchStatus{Status: StatusOK, Results: make([]KeyStatus, len(pairs))}
+	for i, res := range results {
+		if res.Result != store.Created && params.Atomic {
+			resp.Status = StatusBatchAborted
+		}
+		resp.Index = res.Index
+		resp.Results[i] = KeyStatus{Key: params.Pairs[i].Key, WriteStatus: writeStatusOf(res)}
+		// all the pairs share the index of the batch
+		resp.Results[i].Index = 0
+	}
+
+	ctx.JSON(http.StatusOK, resp)
 }
 
 func (s *Service) handleJoin(ctx *gin.Context) {
@@ -238,8 +726,34 @@ func (s *Service) handleJoin(ctx *gin.Context) {
 		return
 	}
 
-	if err := s.store.Join(remoteAddr.Addr); err != nil {
-		ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+	switch remoteAddr.Role {
+	case "", store.RoleVoter:
+		// a node joining with no max op predates the ops gate
+		maxOp := remoteAddr.MaxOp
+		if maxOp == 0 {
+			maxOp = store.BaseOp
+		}
+		s.voterOps.set(remoteAddr.Addr, maxOp)
+
+		// a replica promoted joins as a voter
+		if err := s.store.Join(remoteAddr.Addr); err != nil {
+			ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+			return
+		}
+		if raftPeers, err := s.store.Peers(); err == nil {
+			s.updateClusterOp(raftPeers)
+		}
+		if err := master.Default.RemoveReplica(remoteAddr.Addr); err != nil {
+			log.DB.Error(logPrefix, err)
+		}
+	case store.RoleReplica:
+		if err := master.Default.AddReplica(remoteAddr.Addr); err != nil {
+			log.DB.Error(logPrefix, err)
+			ctx.JSON(http.StatusInternalServerError, StatusInternalError)
+			return
+		}
+	default:
+		ctx.JSON(http.StatusBadRequest, StatusParamsError)
 		return
 	}
 
@@ -252,7 +766,9 @@ func (s *Service) handleJoin(ctx *gin.Context) {
 	}()
 }
 
-func (s *Service) tryToJoin(peers []string) error {
+// tryToJoin asks the peers to join the node with the role, until the
+// leader takes it.
+func (s *Service) tryToJoin(peers []string, role string) error {
 	if len(peers) == 0 {
 		return nil
 	}
@@ -262,7 +778,7 @@ func (s *Service) tryToJoin(peers []string) error {
 			continue
 		}
 
-		params := &joinParams{Addr: s.raftAddr}
+		params := &joinParams{Addr: s.raftAddr, Role: role, MaxOp: store.MaxOp}
 		b, err := json.Marshal(params)
 		if err != nil {
 			return err
@@ -289,19 +805,34 @@ func (s *Service) updatePeers() error {
 	if err != nil {
 		return err
 	}
+	return s.updatePeersOf(raftPeers)
+}
 
+// updatePeersOf updates the HTTP addresses of the peers in the meta store
+// to the ones of the raft peers and of the replicas.
+func (s *Service) updatePeersOf(raftPeers []string) error {
 	if len(raftPeers) == 0 {
 		return master.Default.UpdatePeers([]string{s.httpAddr})
 	}
 
+	replicas, err := master.Default.Replicas()
+	if err != nil {
+		return err
+	}
+
 	peers := []string{}
-	for _, raftAddr := range raftPeers {
+	seen := map[string]bool{}
+	for _, raftAddr := range append(append([]string{}, raftPeers...), replicas...) {
 		peer, err := master.Default.PeerHTTPAddr(raftAddr)
 		if err != nil {
 			return err
 		}
 
-		peers = append(peers, peer)
+		// a replica promoted is in both until the leader forgets it
+		if !seen[peer] {
+			seen[peer] = true
+			peers = append(peers, peer)
+		}
 	}
 
 	return master.Default.UpdatePeers(peers)
@@ -6,13 +6,21 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Focinfi/oncekv/config"
 	"github.com/Focinfi/oncekv/db/master"
+	"github.com/Focinfi/oncekv/db/node/store"
+	"github.com/Focinfi/oncekv/namespace"
+	"github.com/Focinfi/oncekv/utils/cas"
 	"github.com/Focinfi/oncekv/utils/mock"
 	"github.com/Focinfi/oncekv/utils/urlutil"
+	"github.com/gorilla/websocket"
 )
 
 var (
@@ -23,16 +31,16 @@ var (
 
 func TestNode(t *testing.T) {
 	node := New(testHTTPAddr, testRaftAddr, "")
-	store := mock.NewStore()
-	store.SetLeader(testRaftAddr)
-	node.store = store
+	leaderStore := mock.NewStore()
+	leaderStore.SetLeader(testRaftAddr)
+	node.store = leaderStore
 	go node.Start()
 
 	// wait a moment
 	time.Sleep(time.Millisecond * 10)
 
 	// POST /key
-	param := map[string]string{"key": "foo", "value": "bar"}
+	param := map[string]string{"key": "foo", "value": "bar", "request_id": "r1", "writer": "w"}
 	b, err := json.Marshal(param)
 	if err != nil {
 		t.Fatal(err)
@@ -47,6 +55,27 @@ func TestNode(t *testing.T) {
 	}
 	resp.Body.Close()
 
+	// POST /key again
+	for value, expect := range map[string]Status{"bar": StatusKeyExists, "baz": StatusKeyDuplicate} {
+		b, err := json.Marshal(map[string]string{"key": "foo", "value": value, "request_id": "r2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(postURL, jsonHTTPHeader, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := WriteStatus{}
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if status.Status != expect || status.RequestID != "r1" || status.Index == 0 {
+			t.Errorf("failed to add foo/%s again, expect: %v, got: %v\n", value, expect, status)
+		}
+	}
+
 	// GET /i/key/:key
 	getURL := fmt.Sprintf("%s/i/key/foo", urlutil.MakeURL(testHTTPAddr))
 	resp, err = http.Get(getURL)
@@ -64,21 +93,447 @@ func TestNode(t *testing.T) {
 	}
 	resp.Body.Close()
 
-	respKV := &kvResp{}
+	respKV := &metaResp{}
 	if err := json.Unmarshal(b, respKV); err != nil {
 		t.Fatalf("response of get has wrong format, err: %v\n", err)
 	}
 
-	if respKV.Key != "foo" || respKV.Value != "bar" {
+	if respKV.Key != "foo" || respKV.Value != "bar" || respKV.Index == 0 ||
+		respKV.Timestamp.IsZero() || respKV.Writer != "w" || respKV.RequestID != "r1" {
 		t.Errorf("failed to get 'foo', expect: foo/bar, got: %v\n", respKV)
 	}
 
+	// GET /i/key/:key with an unknown consistency level
+	resp, err = http.Get(getURL + "?consistency=unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("failed to reject the unknown consistency level, status code: %d\n", resp.StatusCode)
+	}
+
+	// POST /keys
+	batch := batchParams{Pairs: []pairParams{{Key: "foo", Value: "baz"}, {Key: "hello", Value: "world"}}}
+	b, err = json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postURL = fmt.Sprintf("%s/keys", urlutil.MakeURL(testHTTPAddr))
+	resp, err = http.Post(postURL, jsonHTTPHeader, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	batchResp := &BatchStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(batchResp); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	expectResults := []KeyStatus{
+		{Key: "foo", WriteStatus: WriteStatus{Status: StatusKeyDuplicate, RequestID: "r1"}},
+		{Key: "hello", WriteStatus: WriteStatus{Status: StatusOK}},
+	}
+	if batchResp.Index == 0 {
+		t.Errorf("failed to respond the index of the batch")
+	}
+	if !reflect.DeepEqual(batchResp.Results, expectResults) {
+		t.Errorf("failed to add a batch, expect: %v, got: %v\n", expectResults, batchResp.Results)
+	}
+
+	// GET /i/key/:key?wait= returns once the key is added
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		b, _ := json.Marshal(map[string]string{"key": "late", "value": "v"})
+		addURL := fmt.Sprintf("%s/key", urlutil.MakeURL(testHTTPAddr))
+		if resp, err := http.Post(addURL, jsonHTTPHeader, bytes.NewReader(b)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	resp, err = http.Get(urlutil.MakeURL(testHTTPAddr) + "/i/key/late?wait=5s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("failed to wait for the key, status code: %d\n", resp.StatusCode)
+	}
+
+	// PUT /key/:key takes the raw body, GET responds it as it is with the
+	// format=raw query, or in base64 if it is not valid UTF-8
+	for key, value := range map[string][]byte{"bin": {0, 0xff, 'x'}, "empty": {}} {
+		req, err := http.NewRequest(http.MethodPut, urlutil.MakeURL(testHTTPAddr)+"/key/"+key+"?writer=w", bytes.NewReader(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/gzip")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("failed to put %s, status code: %d\n", key, resp.StatusCode)
+		}
+
+		resp, err = http.Get(urlutil.MakeURL(testHTTPAddr) + "/i/key/" + key + "?format=raw")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || !bytes.Equal(b, value) ||
+			resp.Header.Get("Content-Type") != "application/gzip" || resp.Header.Get(headerWriter) != "w" {
+			t.Errorf("failed to get the raw value of %s, got: %d %q %v\n", key, resp.StatusCode, b, resp.Header)
+		}
+
+		resp, err = http.Get(urlutil.MakeURL(testHTTPAddr) + "/i/key/" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		respKV := metaResp{}
+		if err := json.NewDecoder(resp.Body).Decode(&respKV); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got, err := decodeValue(respKV.Value, respKV.Encoding); err != nil || !bytes.Equal(got, value) || respKV.ContentType != "application/gzip" {
+			t.Errorf("failed to get the value of %s, got: %v\n", key, respKV)
+		}
+	}
+
+	// a key with slashes is listed and read back, escaped or not
+	req, err := http.NewRequest(http.MethodPut, urlutil.MakeURL(testHTTPAddr)+"/key/"+url.PathEscape("files/1.2.3/app"), strings.NewReader("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to put the key with slashes, status code: %d\n", resp.StatusCode)
+	}
+	resp, err = http.Get(urlutil.MakeURL(testHTTPAddr) + "/keys?prefix=files/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := listResp{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !reflect.DeepEqual(list.Keys, []string{"files/1.2.3/app"}) {
+		t.Errorf("failed to list the key with slashes, got: %v\n", list)
+	}
+	for _, path := range []string{"/i/key/files/1.2.3/app?format=raw", "/i/key/files%2F1.2.3%2Fapp?format=raw"} {
+		resp, err = http.Get(urlutil.MakeURL(testHTTPAddr) + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(b) != "v1" {
+			t.Errorf("GET %s, expect v1, got: %d %q\n", path, resp.StatusCode, b)
+		}
+	}
+
+	// values larger than the max are rejected
+	maxValueBytes = 2
+	req, err = http.NewRequest(http.MethodPut, urlutil.MakeURL(testHTTPAddr)+"/key/large", strings.NewReader("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	maxValueBytes = config.Config.MaxValueBytes
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("failed to reject the large value, status code: %d\n", resp.StatusCode)
+	}
+
+	// GET /keys lists the keys in order
+	for query, expect := range map[string]listResp{
+		"?limit=2":     {Keys: []string{"bin", "empty"}, More: true},
+		"?after=hello": {Keys: []string{"late"}},
+		"?prefix=x":    {Keys: []string{}},
+	} {
+		resp, err := http.Get(urlutil.MakeURL(testHTTPAddr) + "/keys" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list := listResp{}
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if !reflect.DeepEqual(list, expect) {
+			t.Errorf("GET /keys%s, expect: %v, got: %v\n", query, expect, list)
+		}
+	}
+	resp, err = http.Get(urlutil.MakeURL(testHTTPAddr) + "/keys?limit=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("failed to reject the invalid limit, status code: %d\n", resp.StatusCode)
+	}
+
+	// GET /ws/changes streams the adds from the index
+	wsURL := fmt.Sprintf("ws://%s/ws/changes?from=", testHTTPAddr)
+	for from, expect := range map[string][]string{"0": {"foo", "hello", "late"}, "5": {"late"}} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+from, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for range expect {
+			change := changeResp{}
+			if err := conn.ReadJSON(&change); err != nil {
+				t.Fatal(err)
+			}
+			if change.Op != store.ChangeAdd || change.Index == 0 {
+				t.Errorf("wrong change: %v\n", change)
+			}
+			got = append(got, change.Key)
+		}
+		conn.Close()
+
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("failed to stream the changes from %s, expect: %v, got: %v\n", from, expect, got)
+		}
+	}
+	// the changes compacted are gone, from 0 starts after them
+	leaderStore.CompactChanges(4)
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL+"2", nil); err == nil || resp == nil || resp.StatusCode != http.StatusGone {
+		t.Errorf("expect the compacted changes gone, got %v, err: %v", resp, err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change := changeResp{}
+	if err := conn.ReadJSON(&change); err != nil || change.Key != "late" {
+		t.Errorf("expect the change of late after the compacted ones, got %v, err: %v", change, err)
+	}
+	conn.Close()
+	leaderStore.CompactChanges(0)
+
+	// a key may have a ttl, its expiry time is in its metadata
+	for ttl, expect := range map[string]int{"1h": OK, "x": ParamsError, "-1s": ParamsError} {
+		b, err := json.Marshal(map[string]string{"key": "expiring" + ttl, "value": "v", "ttl": ttl})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(urlutil.MakeURL(testHTTPAddr)+"/key", jsonHTTPHeader, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := Status{}
+		json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if status.Code != expect {
+			t.Errorf("POST /key with the ttl %s, expect: %d, got: %d\n", ttl, expect, status.Code)
+		}
+	}
+	resp, err = http.Get(urlutil.MakeURL(testHTTPAddr) + "/i/key/expiring1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttlResp := metaResp{}
+	if err := json.NewDecoder(resp.Body).Decode(&ttlResp); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if ttlResp.ExpiresAt == nil || ttlResp.ExpiresAt.Sub(ttlResp.Timestamp) != time.Hour {
+		t.Errorf("failed to respond the expiry time, got: %v\n", ttlResp)
+	}
+
+	// the keys of a namespace are apart from the default ones
+	if err := namespaces.Create(&namespace.Namespace{Name: "team", MaxKeyBytes: 8, MaxValueBytes: 4, Tokens: []string{"t"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		path   string
+		key    string
+		value  string
+		expect int
+		code   int
+	}{
+		{"/ns/team/key?token=t", "foo", "v1", http.StatusOK, OK},
+		{"/ns/team/key", "foo", "v1", http.StatusUnauthorized, Unauthorized},
+		{"/ns/team/key?token=x", "foo", "v1", http.StatusUnauthorized, Unauthorized},
+		{"/ns/missing/key", "foo", "v1", http.StatusNotFound, NamespaceNotFound},
+		{"/ns/team/key?token=t", "toolongkey", "v1", http.StatusOK, ParamsError},
+		{"/ns/team/key?token=t", "large", "value", http.StatusRequestEntityTooLarge, ValueTooLarge},
+	} {
+		b, err := json.Marshal(map[string]string{"key": c.key, "value": c.value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(urlutil.MakeURL(testHTTPAddr)+c.path, jsonHTTPHeader, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := Status{}
+		json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+
+		if resp.StatusCode != c.expect || status.Code != c.code {
+			t.Errorf("POST %s %q, expect: %d/%d, got: %d/%d\n", c.path, c.key, c.expect, c.code, resp.StatusCode, status.Code)
+		}
+	}
+
+	req, err = http.NewRequest(http.MethodGet, urlutil.MakeURL(testHTTPAddr)+"/ns/team/i/key/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer t")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nsResp := metaResp{}
+	if err := json.NewDecoder(resp.Body).Decode(&nsResp); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if nsResp.Key != "foo" || nsResp.Value != "v1" {
+		t.Errorf("failed to get the key of the namespace, got: %v\n", nsResp)
+	}
+
+	// the stored keys of the namespaces are not keys of the default one
+	req, err = http.NewRequest(http.MethodPut, urlutil.MakeURL(testHTTPAddr)+"/key/%FFteam", strings.NewReader("v"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("failed to reject the reserved key, status code: %d\n", resp.StatusCode)
+	}
+
+	for path, expect := range map[string]listResp{
+		"/ns/team/keys?token=t": {Keys: []string{"foo"}},
+		"/keys?after=hello":     {Keys: []string{"late"}},
+	} {
+		resp, err := http.Get(urlutil.MakeURL(testHTTPAddr) + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list := listResp{}
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if !reflect.DeepEqual(list, expect) {
+			t.Errorf("GET %s, expect: %v, got: %v\n", path, expect, list)
+		}
+	}
+
+	// the admin purges a key of a namespace
+	adminToken = "admin"
+	for token, expect := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "admin": http.StatusOK} {
+		b, _ := json.Marshal(purgeParams{Key: "foo", Namespace: "team", Operator: "alice", Reason: "legal"})
+		resp, err := http.Post(urlutil.MakeURL(testHTTPAddr)+"/purge?token="+token, jsonHTTPHeader, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expect {
+			t.Errorf("POST /purge with token %q, expect: %d, got: %d\n", token, expect, resp.StatusCode)
+		}
+	}
+	b, _ = json.Marshal(purgeParams{Key: "foo", Operator: "alice"})
+	resp, err = http.Post(urlutil.MakeURL(testHTTPAddr)+"/purge?token=admin", jsonHTTPHeader, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expect a purge without a reason rejected, got: %d\n", resp.StatusCode)
+	}
+	resp, err = http.Get(urlutil.MakeURL(testHTTPAddr) + "/ns/team/i/key/foo?token=t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expect the purged key not found, got: %d\n", resp.StatusCode)
+	}
+	resp, err = http.Get(urlutil.MakeURL(testHTTPAddr) + "/purges?token=admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	purges := []purgeResp{}
+	if err := json.NewDecoder(resp.Body).Decode(&purges); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(purges) != 1 || purges[0].Key != "foo" || purges[0].Namespace != "team" || purges[0].Operator != "alice" || !purges[0].Found {
+		t.Errorf("failed to record the purge, got: %v\n", purges)
+	}
+
+	// the content-addressed keys are the hashes of their values
+	helloKey := cas.Key([]byte("hello"))
+	for _, expect := range []int{OK, KeyExists} {
+		resp, err := http.Post(urlutil.MakeURL(testHTTPAddr)+"/cas?writer=w", "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := CASStatus{}
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if status.Code != expect || status.Key != helloKey {
+			t.Errorf("POST /cas, expect: %d, got: %v\n", expect, status)
+		}
+	}
+	if err := namespaces.Create(&namespace.Namespace{Name: "blobs", ContentAddressed: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		path   string
+		params setParams
+		expect int
+	}{
+		{"/key", setParams{Key: "hi", Value: "hi", ContentAddressed: true}, HashMismatch},
+		{"/key", setParams{Key: cas.Key([]byte("hi")), Value: "hi", ContentAddressed: true}, OK},
+		{"/ns/blobs/key", setParams{Key: "hi", Value: "hi"}, HashMismatch},
+		{"/ns/blobs/key", setParams{Key: cas.Key([]byte("hi")), Value: "hi"}, OK},
+	} {
+		b, _ := json.Marshal(c.params)
+		resp, err := http.Post(urlutil.MakeURL(testHTTPAddr)+c.path, jsonHTTPHeader, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := Status{}
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if status.Code != c.expect {
+			t.Errorf("POST %s %v, expect: %d, got: %v\n", c.path, c.params, c.expect, status)
+		}
+	}
+
 	// new node try to join
 	newNodeHTTP := "127.0.0.1:55503"
 	newRaftNode := "127.0.0.1:55504"
 
 	newNode := New(newNodeHTTP, newRaftNode, "")
-	newNode.store = mock.NewStore()
+	newStore := mock.NewStore()
+	newNode.store = newStore
 	go newNode.Start()
 	time.Sleep(time.Millisecond * 10)
 
@@ -90,6 +545,9 @@ func TestNode(t *testing.T) {
 	if !reflect.DeepEqual(nowRaftPeers, raftPeers) {
 		t.Fatalf("leader node can not handle POST /join, now raft peers: %v\n", nowRaftPeers)
 	}
+	if op := leaderStore.ClusterOp(); op != store.MaxOp {
+		t.Errorf("expect the cluster op of the joined voters %d, got %d", store.MaxOp, op)
+	}
 
 	httpPeers := []string{testHTTPAddr, newNodeHTTP}
 	nowHTTPPeers, err := master.Default.Peers()
@@ -99,4 +557,284 @@ func TestNode(t *testing.T) {
 	if !reflect.DeepEqual(nowHTTPPeers, httpPeers) {
 		t.Fatalf("leader node can not handle POST /join, now http peers: %v\n", nowRaftPeers)
 	}
+
+	// GET /i/key/:key on a follower, misses are forwarded to the leader
+	newStore.SetLeader(testRaftAddr)
+	newStore.SetFollower(true)
+	for _, c := range []struct {
+		path   string
+		expect int
+	}{
+		{"/i/key/foo", http.StatusOK},
+		{"/i/key/missing", http.StatusNotFound},
+		{"/i/key/foo?consistency=stale", http.StatusNotFound},
+		{"/i/key/foo?min_index=1", http.StatusNotFound},
+		{"/i/key/foo?min_index=x", http.StatusBadRequest},
+		{"/i/key/missing?wait=10ms", http.StatusNotFound},
+		{"/i/key/foo?wait=x", http.StatusBadRequest},
+	} {
+		resp, err := http.Get(urlutil.MakeURL(newNodeHTTP) + c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != c.expect {
+			t.Errorf("follower GET %s, expect: %d, got: %d\n", c.path, c.expect, resp.StatusCode)
+		}
+	}
+
+	// writes to a follower are forwarded to the leader once, and every
+	// response names the leader
+	for _, forwarded := range []bool{false, true} {
+		req, _ := http.NewRequest(http.MethodPost, urlutil.MakeURL(newNodeHTTP)+"/key", strings.NewReader(`{"key":"forwarded","value":"v"}`))
+		if forwarded {
+			req.Header.Set(forwardedHeader, testHTTPAddr)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := WriteStatus{}
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		expect := OK
+		if forwarded {
+			expect = NotLeaderError
+		}
+		if status.Code != expect || resp.Header.Get(leaderHeader) != testHTTPAddr {
+			t.Errorf("POST /key on a follower forwarded: %v, expect: %d, got: %v, leader: %q\n", forwarded, expect, status, resp.Header.Get(leaderHeader))
+		}
+	}
+	if value, err := leaderStore.Get("forwarded"); err != nil || string(value) != "v" {
+		t.Errorf("expect the forwarded write on the leader, got: %s, %v\n", value, err)
+	}
+
+	// the scrubber finds the key differing from the leader, and repairs it
+	// when most replicas agree, here the leader counted twice by two addresses
+	resp, err = http.Get(urlutil.MakeURL(testHTTPAddr) + "/i/digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expect GET /i/digest without the admin token rejected, got: %d\n", resp.StatusCode)
+	}
+	if _, err := leaderStore.Add("scrubbed", []byte("good"), store.WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newStore.Add("scrubbed", []byte("bad"), store.WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	newNode.scrubOnce()
+	if stats := newNode.scrub.stats(); stats["scrub_mismatched"] != "1" || stats["scrub_repaired"] != "0" {
+		t.Errorf("expect the key mismatched and not repaired without a majority, got: %v\n", stats)
+	}
+
+	run := scrubRun{}
+	sums, _ := newStore.Checksums("", "", 0)
+	newNode.scrubPage(sums, "", "scrubbed", []string{testHTTPAddr, "localhost:55501"}, &run)
+	if value, _ := newStore.Get("scrubbed"); run.repaired != 1 || string(value) != "good" {
+		t.Errorf("expect the key repaired with the entry of the majority, got: %s, %v\n", value, run)
+	}
+
+	resp, err = http.Get(urlutil.MakeURL(newNodeHTTP) + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := map[string]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if stats["scrub_runs"] != "1" || stats["scrub_checked"] != "1" {
+		t.Errorf("expect the scrub on /stats, got: %v\n", stats)
+	}
+
+	// GET /peers, DELETE /peers/:addr, and POST /leave of a follower asks
+	// the leader to remove it, both for the admin
+	resp, err = http.Get(urlutil.MakeURL(testHTTPAddr) + "/peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := peersResp{}
+	if err := json.NewDecoder(resp.Body).Decode(&members); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if members.Leader != testRaftAddr || !reflect.DeepEqual(members.Peers, raftPeers) {
+		t.Errorf("GET /peers, expect %v led by %s, got: %v\n", raftPeers, testRaftAddr, members)
+	}
+
+	for _, c := range []struct {
+		method string
+		addr   string
+		path   string
+		token  string
+		expect int
+	}{
+		{http.MethodDelete, testHTTPAddr, "/peers/" + newRaftNode, "", http.StatusUnauthorized},
+		{http.MethodPost, newNodeHTTP, "/leave", "wrong", http.StatusUnauthorized},
+		{http.MethodDelete, newNodeHTTP, "/peers/127.0.0.1:1", "admin", http.StatusBadRequest},
+		{http.MethodDelete, testHTTPAddr, "/peers/127.0.0.1:1", "admin", http.StatusNotFound},
+		{http.MethodPost, newNodeHTTP, "/leave", "admin", http.StatusOK},
+		{http.MethodPost, newNodeHTTP, "/leave", "admin", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest(c.method, urlutil.MakeURL(c.addr)+c.path, nil)
+		req.Header.Set("Authorization", bearerPrefix+c.token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.expect {
+			t.Errorf("%s %s on %s, expect: %d, got: %d\n", c.method, c.path, c.addr, c.expect, resp.StatusCode)
+		}
+	}
+	if peers, _ := leaderStore.Peers(); !reflect.DeepEqual(peers, []string{testRaftAddr}) {
+		t.Errorf("expect the follower removed, got: %v\n", peers)
+	}
+	time.Sleep(time.Millisecond * 10)
+	if peers, _ := master.Default.Peers(); !reflect.DeepEqual(peers, []string{testHTTPAddr}) {
+		t.Errorf("expect the peers in the meta store updated, got: %v\n", peers)
+	}
+
+	// a replica joins without voting, follows the changes of the leader and
+	// serves the reads, it is promoted to a voter and demoted back
+	replicaHTTP, replicaRaft := "127.0.0.1:55505", "127.0.0.1:55506"
+	replicaNode := NewReplica(replicaHTTP, replicaRaft, "")
+	replicaStore := mock.NewStore()
+	replicaNode.store = replicaStore
+	go replicaNode.Start()
+	time.Sleep(time.Millisecond * 200)
+
+	if peers, _ := leaderStore.Peers(); !reflect.DeepEqual(peers, []string{testRaftAddr}) {
+		t.Errorf("expect the replica out of the raft peers, got: %v\n", peers)
+	}
+	if replicas, _ := master.Default.Replicas(); !reflect.DeepEqual(replicas, []string{replicaRaft}) {
+		t.Errorf("expect the replica recorded, got: %v\n", replicas)
+	}
+	if peers, _ := master.Default.Peers(); !reflect.DeepEqual(peers, []string{testHTTPAddr, replicaHTTP}) {
+		t.Errorf("expect the replica in the peers, got: %v\n", peers)
+	}
+	resp, err = http.Get(urlutil.MakeURL(replicaHTTP) + "/i/key/foo?consistency=stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	respKV = &metaResp{}
+	if err := json.NewDecoder(resp.Body).Decode(respKV); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if respKV.Value != "bar" || replicaStore.Leader() != testRaftAddr {
+		t.Errorf("expect the replica to serve foo/bar following %s, got: %v, %s\n", testRaftAddr, respKV, replicaStore.Leader())
+	}
+
+	resp, err = http.Post(urlutil.MakeURL(replicaHTTP)+"/key", jsonHTTPHeader, strings.NewReader(`{"key":"replicated","value":"v"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	time.Sleep(time.Millisecond * 200)
+	if value, _ := replicaStore.Get("replicated"); string(value) != "v" {
+		t.Errorf("expect the write forwarded to the leader and replicated, got: %q\n", value)
+	}
+
+	for _, c := range []struct {
+		path   string
+		expect int
+		role   string
+		peers  []string
+	}{
+		{"/promote?token=wrong", http.StatusUnauthorized, store.RoleReplica, []string{testRaftAddr}},
+		{"/demote?token=admin", http.StatusConflict, store.RoleReplica, []string{testRaftAddr}},
+		{"/promote?token=admin", http.StatusOK, store.RoleVoter, []string{testRaftAddr, replicaRaft}},
+		{"/promote?token=admin", http.StatusConflict, store.RoleVoter, []string{testRaftAddr, replicaRaft}},
+		{"/demote?token=admin", http.StatusOK, store.RoleReplica, []string{testRaftAddr}},
+	} {
+		resp, err := http.Post(urlutil.MakeURL(replicaHTTP)+c.path, jsonHTTPHeader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		time.Sleep(time.Millisecond * 150)
+
+		peers, _ := leaderStore.Peers()
+		if resp.StatusCode != c.expect || replicaStore.Stats()["role"] != c.role || !reflect.DeepEqual(peers, c.peers) {
+			t.Errorf("POST %s, expect: %d, %s in %v, got: %d, %s in %v\n", c.path, c.expect, c.role, c.peers, resp.StatusCode, replicaStore.Stats()["role"], peers)
+		}
+	}
+	if replicas, _ := master.Default.Replicas(); !reflect.DeepEqual(replicas, []string{replicaRaft}) {
+		t.Errorf("expect the replica demoted recorded again, got: %v\n", replicas)
+	}
+	replicaNode.Shutdown()
+
+	// POST /shutdown shuts a node down gracefully for the admin
+	// the wrong token first, the node is gone after the admin one
+	for _, c := range []struct {
+		token  string
+		expect int
+	}{{"wrong", http.StatusUnauthorized}, {"admin", http.StatusAccepted}} {
+		token, expect := c.token, c.expect
+		resp, err := http.Post(urlutil.MakeURL(newNodeHTTP)+"/shutdown?token="+token, jsonHTTPHeader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expect {
+			t.Errorf("POST /shutdown with token %q, expect: %d, got: %d\n", token, expect, resp.StatusCode)
+		}
+	}
+	time.Sleep(time.Millisecond * 50)
+	if !newStore.IsShutdown() {
+		t.Error("expect the store shut down")
+	}
+	if _, err := http.Get(urlutil.MakeURL(newNodeHTTP) + "/ping"); err == nil {
+		t.Error("expect the node stopped serving")
+	}
+
+	// a node shutting down rejects the writes like a follower
+	atomic.StoreInt32(&node.draining, 1)
+	resp, err = http.Post(postURL, jsonHTTPHeader, strings.NewReader(`{"key":"late","value":"v"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := Status{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || status.Code != NotLeaderError {
+		t.Errorf("expect the write rejected, got: %d, %v\n", resp.StatusCode, status)
+	}
+	node.Shutdown()
+	if !leaderStore.IsShutdown() {
+		t.Error("expect the store of the leader shut down")
+	}
+}
+
+// TestUpdateClusterOp tests the leader proposes the ops every voter applies.
+func TestUpdateClusterOp(t *testing.T) {
+	s := &Service{raftAddr: "a", store: mock.NewStore()}
+	raftPeers := []string{"a", "b", "c"}
+
+	s.updateClusterOp(raftPeers)
+	if op := s.store.(*mock.Store).ClusterOp(); op != store.BaseOp {
+		t.Errorf("expect BaseOp for the voters never heard of, got %d", op)
+	}
+
+	s.voterOps.set("b", store.MaxOp)
+	s.voterOps.set("c", store.MaxOp-1)
+	s.updateClusterOp(raftPeers)
+	if op := s.store.(*mock.Store).ClusterOp(); op != store.MaxOp-1 {
+		t.Errorf("expect the lowest max_op %d, got %d", store.MaxOp-1, op)
+	}
+
+	s.updateClusterOp([]string{"a", "b"})
+	if op := s.store.(*mock.Store).ClusterOp(); op != store.MaxOp {
+		t.Errorf("expect MaxOp once the older voter is removed, got %d", op)
+	}
 }
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Focinfi/oncekv/db/master"
+	"github.com/Focinfi/oncekv/log"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// handoffTimeout bounds the wait of a leader shutting down for a
+	// follower to apply its log
+	handoffTimeout      = 10 * time.Second
+	handoffPollInterval = 50 * time.Millisecond
+
+	// shutdownTimeout bounds the wait for the requests in flight
+	shutdownTimeout = 10 * time.Second
+)
+
+// isDraining reports whether the node is shutting down.
+func (s *Service) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// rejectDrainedWrites answers the writes of a node shutting down like the
+// ones of a follower, so the writers go to another node.
+func (s *Service) rejectDrainedWrites(ctx *gin.Context) {
+	if s.isDraining() && ctx.Request.Method != http.MethodGet {
+		ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, StatusShuttingDown)
+		return
+	}
+	ctx.Next()
+}
+
+// handleShutdown shuts the node down gracefully for the admin, the
+// response comes before the shutdown.
+func (s *Service) handleShutdown(ctx *gin.Context) {
+	if !isAdmin(ctx) {
+		ctx.JSON(http.StatusUnauthorized, StatusUnauthorized)
+		return
+	}
+
+	ctx.JSON(http.StatusAccepted, StatusOK)
+	go s.Shutdown()
+}
+
+// handleSignals shuts the node down gracefully on SIGTERM or an interrupt.
+func (s *Service) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	select {
+	case sig := <-signals:
+		log.DB.Infoln(logPrefix, "received", sig)
+		s.Shutdown()
+	case <-s.stopped:
+	}
+}
+
+// Shutdown stops the node gracefully: it rejects the new writes and waits
+// for the ones in flight, lets a follower apply the whole log if the node
+// is the leader, stops serving HTTP and shuts the store down. It runs once,
+// Start returns after it.
+func (s *Service) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		log.DB.Infoln(logPrefix, "shutting down")
+		atomic.StoreInt32(&s.draining, 1)
+		close(s.done)
+
+		if index, err := s.store.Drain(); err != nil {
+			log.DB.Errorln(logPrefix, "failed to drain the writes:", err)
+		} else if index > 0 && !s.waitFollower(index) {
+			log.DB.Errorln(logPrefix, "no follower applied the log up to", index)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.server.Shutdown(ctx); err != nil {
+			log.DB.Errorln(logPrefix, "failed to wait for the requests:", err)
+		}
+		s.stopReplica()
+		if err := s.store.Shutdown(); err != nil {
+			log.DB.Errorln(logPrefix, "failed to shut the store down:", err)
+		}
+
+		log.DB.Infoln(logPrefix, "shut down")
+		close(s.stopped)
+	})
+}
+
+// waitFollower waits until a follower applies the log of the leader up to
+// the index, raft then elects an up-to-date follower right after the leader
+// is gone, since the vendored raft can not transfer the leadership.
+func (s *Service) waitFollower(index uint64) bool {
+	peers := s.otherVoters()
+	if len(peers) == 0 {
+		return true
+	}
+
+	for deadline := time.Now().Add(handoffTimeout); time.Now().Before(deadline); time.Sleep(handoffPollInterval) {
+		for _, peer := range peers {
+			if applied, err := appliedIndexOf(peer); err == nil && applied >= index {
+				log.DB.Infoln(logPrefix, peer, "applied the log up to", index)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// otherVoters returns the HTTP addresses of the other raft members, the
+// replicas are never elected.
+func (s *Service) otherVoters() []string {
+	raftPeers, err := s.store.Peers()
+	if err != nil {
+		log.DB.Errorln(logPrefix, "failed to get the raft peers:", err)
+		return nil
+	}
+
+	voters := []string{}
+	for _, raftAddr := range excludePeer(raftPeers, s.raftAddr) {
+		peer, err := master.Default.PeerHTTPAddr(raftAddr)
+		if err != nil {
+			log.DB.Errorln(logPrefix, "failed to get the HTTP address of", raftAddr, err)
+			continue
+		}
+		voters = append(voters, peer)
+	}
+	return voters
+}
+
+// appliedIndexOf returns the raft index applied by the node at the HTTP
+// address.
+func appliedIndexOf(peer string) (uint64, error) {
+	stats, err := statsOf(peer)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(stats["applied_index"], 10, 64)
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Focinfi/oncekv/config"
+	"github.com/Focinfi/oncekv/db/node/store"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// encodingBase64 marks a value encoded in base64 in a JSON body, the
+	// values which are not valid UTF-8 are encoded so
+	encodingBase64 = "base64"
+
+	// formatRaw for GET /i/key/:key responding the value as it is
+	formatRaw = "raw"
+
+	defaultContentType = "application/octet-stream"
+
+	// headers of the metadata of a raw value
+	headerIndex     = "X-Oncekv-Index"
+	headerTerm      = "X-Oncekv-Term"
+	headerTimestamp = "X-Oncekv-Timestamp"
+	headerWriter    = "X-Oncekv-Writer"
+	headerRequestID = "X-Oncekv-Request-Id"
+	headerExpiresAt = "X-Oncekv-Expires-At"
+	headerChecksum  = "X-Oncekv-Checksum"
+)
+
+var (
+	maxValueBytes = config.Config.MaxValueBytes
+
+	errUnknownEncoding = errors.New("unknown encoding")
+	errInvalidTTL      = errors.New("invalid ttl")
+)
+
+// encodeValue returns value as a string for a JSON body and its encoding.
+func encodeValue(value []byte) (string, string) {
+	if utf8.Valid(value) {
+		return string(value), ""
+	}
+	return base64.StdEncoding.EncodeToString(value), encodingBase64
+}
+
+// decodeValue returns the value of a JSON body encoded as encoding tells.
+func decodeValue(value string, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(value), nil
+	case encodingBase64:
+		return base64.StdEncoding.DecodeString(value)
+	default:
+		return nil, errUnknownEncoding
+	}
+}
+
+func metaRespOf(key string, value []byte, meta *store.Meta) metaResp {
+	resp := metaResp{
+		Key:         key,
+		ContentType: meta.ContentType,
+		Index:       meta.Index,
+		Term:        meta.Term,
+		Timestamp:   meta.Timestamp,
+		Writer:      meta.Writer,
+		RequestID:   meta.RequestID,
+		Checksum:    fmt.Sprintf("%08x", store.Checksum(value)),
+	}
+	if !meta.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &meta.ExpiresAt
+	}
+	resp.Value, resp.Encoding = encodeValue(value)
+	return resp
+}
+
+// parseTTL parses the time to live of a write, the empty one is none.
+func parseTTL(param string) (time.Duration, error) {
+	if param == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(param)
+	if err == nil && ttl <= 0 {
+		err = errInvalidTTL
+	}
+	return ttl, err
+}
+
+// writeRaw responds the value as the body, with its content type and the
+// metadata in the headers.
+func writeRaw(ctx *gin.Context, value []byte, meta *store.Meta) {
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	ctx.Header(headerIndex, strconv.FormatUint(meta.Index, 10))
+	ctx.Header(headerTerm, strconv.FormatUint(meta.Term, 10))
+	ctx.Header(headerTimestamp, meta.Timestamp.Format(time.RFC3339Nano))
+	if meta.Writer != "" {
+		ctx.Header(headerWriter, meta.Writer)
+	}
+	if meta.RequestID != "" {
+		ctx.Header(headerRequestID, meta.RequestID)
+	}
+	if !meta.ExpiresAt.IsZero() {
+		ctx.Header(headerExpiresAt, meta.ExpiresAt.Format(time.RFC3339Nano))
+	}
+	ctx.Header(headerChecksum, fmt.Sprintf("%08x", store.Checksum(value)))
+	ctx.Data(http.StatusOK, contentType, value)
+}
+
+// handlePut adds the body as the value of the key, with the media type of
+// the Content-Type header. The request_id, the writer, the ttl and the
+// content_addressed flag are given by the query.
+func (s *Service) handlePut(ctx *gin.Context) {
+	if !s.leadsWrites(ctx) {
+		return
+	}
+
+	sc, ok := scopeOf(ctx)
+	if !ok {
+		return
+	}
+
+	key := keyParam(ctx)
+	if !sc.validKey(key) {
+		ctx.JSON(http.StatusBadRequest, StatusParamsError)
+		return
+	}
+	value, opts, ok := readRaw(ctx, sc)
+	if !ok {
+		return
+	}
+	if !sc.verify(key, value, ctx.Query("content_addressed") == "true") {
+		ctx.JSON(http.StatusBadRequest, StatusHashMismatch)
+		return
+	}
+
+	s.add(ctx, sc.key(key), value, opts)
+}
+
+// readRaw reads the body as a value, and the options of the write from the
+// Content-Type header and the query. It responds the error and returns
+// false for a bad request.
+func readRaw(ctx *gin.Context, sc *scope) ([]byte, store.WriteOptions, bool) {
+	value, err := ioutil.ReadAll(io.LimitReader(ctx.Request.Body, sc.maxValueBytes+1))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, StatusParamsError)
+		return nil, store.WriteOptions{}, false
+	}
+	if int64(len(value)) > sc.maxValueBytes {
+		ctx.JSON(http.StatusRequestEntityTooLarge, StatusValueTooLarge)
+		return nil, store.WriteOptions{}, false
+	}
+
+	contentType := ctx.GetHeader("Content-Type")
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	ttl, err := parseTTL(ctx.Query("ttl"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, StatusParamsError)
+		return nil, store.WriteOptions{}, false
+	}
+
+	opts := store.WriteOptions{
+		RequestID:   ctx.Query("request_id"),
+		Writer:      ctx.Query("writer"),
+		ContentType: contentType,
+		TTL:         ttl,
+	}
+	return value, opts, true
+}
@@ -0,0 +1,49 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkAdd adds keys concurrently, every add in a log entry of its own.
+func BenchmarkAdd(b *testing.B) {
+	benchmarkAdd(b, 0)
+}
+
+// BenchmarkAddGrouped adds keys concurrently, with the adds committed in
+// groups.
+func BenchmarkAddGrouped(b *testing.B) {
+	benchmarkAdd(b, 2*time.Millisecond)
+}
+
+func benchmarkAdd(b *testing.B, window time.Duration) {
+	s := New()
+	tmpDir, _ := ioutil.TempDir("", "store_bench")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	s.GroupWindow = window
+	if err := s.Open(true); err != nil {
+		b.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Shutdown()
+	testWaitLeader(b, s)
+
+	value := make([]byte, 100)
+	var n uint64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := fmt.Sprintf("key-%d", atomic.AddUint64(&n, 1))
+			if res, err := s.Add(key, value, WriteOptions{}); err != nil || res.Result != Created {
+				b.Fatalf("failed to add %s, got %v, err: %v", key, res, err)
+			}
+		}
+	})
+}
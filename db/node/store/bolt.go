@@ -0,0 +1,215 @@
+package store
+
+import (
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// Permissions to use on the db file. This is only used if the
+	// database file does not exist and needs to be created.
+	dbFileMode = 0600
+
+	// restoreBatchSize is the count of keys written in one transaction
+	// while restoring from a snapshot.
+	restoreBatchSize = 1024
+
+	// initialMmapSize is the size the db file is mapped with at first. A
+	// write growing the file past the mapping remaps it, which waits for
+	// the read transactions like the one of a snapshot, so the mapping is
+	// large enough for the remaps to be rare. It costs address space only.
+	initialMmapSize = 1 << 30
+)
+
+var (
+	// Bucket names we perform transactions in
+	dbData    = []byte("data")
+	dbFSM     = []byte("fsm")
+	dbChanges = []byte("changes")
+	dbExpiry  = []byte("expiry")
+	dbAudit   = []byte("audit")
+
+	// Keys in the fsm bucket
+	keyAppliedIndex = []byte("applied_index")
+	// keyChangesFloor is the raft index of the last snapshot restored or
+	// of the last trim of the changes, the changes up to it are compacted.
+	keyChangesFloor = []byte("changes_floor")
+)
+
+// kvStore keeps the applied key/value pairs in a BoltDB file, so the key
+// space is limited by the disk rather than by memory.
+type kvStore struct {
+	// conn is the underlying handle to the db.
+	conn *bolt.DB
+
+	// The path to the Bolt database file
+	path string
+}
+
+// openKVStore opens or creates the BoltDB file at path.
+func openKVStore(path string) (*kvStore, error) {
+	handle, err := bolt.Open(path, dbFileMode, &bolt.Options{InitialMmapSize: initialMmapSize})
+	if err != nil {
+		return nil, err
+	}
+
+	store := &kvStore{
+		conn: handle,
+		path: path,
+	}
+
+	if err := store.initialize(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// initialize is used to set up all of the buckets.
+func (kv *kvStore) initialize() error {
+	return kv.conn.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(dbData); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(dbFSM); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(dbExpiry); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(dbAudit); err != nil {
+			return err
+		}
+		if tx.Bucket(dbChanges) != nil {
+			return nil
+		}
+
+		// The files written before the changes bucket get it from the entries.
+		changes, err := tx.CreateBucket(dbChanges)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(dbData).ForEach(func(key, value []byte) error {
+			return putEntryChange(changes, key, value)
+		})
+	})
+}
+
+// Close is used to gracefully close the DB connection.
+func (kv *kvStore) Close() error {
+	return kv.conn.Close()
+}
+
+// get returns a copy of the value of key, or nil if the key does not exist.
+func (kv *kvStore) get(key []byte) ([]byte, error) {
+	var val []byte
+	err := kv.conn.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(dbData).Get(key); v != nil {
+			val = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return val, err
+}
+
+// update runs fn in a writable transaction and records index as the last
+// applied raft index in the same transaction.
+func (kv *kvStore) update(index uint64, fn func(data *bolt.Bucket) error) error {
+	return kv.conn.Update(func(tx *bolt.Tx) error {
+		if err := fn(tx.Bucket(dbData)); err != nil {
+			return err
+		}
+		return tx.Bucket(dbFSM).Put(keyAppliedIndex, uint64ToBytes(index))
+	})
+}
+
+// appliedIndex returns the last raft index applied to the store.
+func (kv *kvStore) appliedIndex() (uint64, error) {
+	var index uint64
+	err := kv.conn.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(dbFSM).Get(keyAppliedIndex); v != nil {
+			index = bytesToUint64(v)
+		}
+		return nil
+	})
+	return index, err
+}
+
+// setSnapshotIndex records index as the last applied raft index and the
+// floor of the changes, once a snapshot at index is restored.
+func (kv *kvStore) setSnapshotIndex(index uint64) error {
+	return kv.conn.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(dbFSM).Put(keyAppliedIndex, uint64ToBytes(index)); err != nil {
+			return err
+		}
+		return tx.Bucket(dbFSM).Put(keyChangesFloor, uint64ToBytes(index))
+	})
+}
+
+// changesFloor returns the raft index up to which the changes are
+// compacted, 0 if none are.
+func (kv *kvStore) changesFloor() (uint64, error) {
+	var index uint64
+	err := kv.conn.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(dbFSM).Get(keyChangesFloor); v != nil {
+			index = bytesToUint64(v)
+		}
+		return nil
+	})
+	return index, err
+}
+
+// setAppliedIndex records index as the last applied raft index.
+func (kv *kvStore) setAppliedIndex(index uint64) error {
+	return kv.conn.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbFSM).Put(keyAppliedIndex, uint64ToBytes(index))
+	})
+}
+
+// reset drops all the data, the changes, the expiry, the audit records, the
+// applied index and the floor of the changes.
+func (kv *kvStore) reset() error {
+	return kv.conn.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{dbData, dbChanges, dbExpiry, dbAudit} {
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(dbFSM).Delete(keyChangesFloor); err != nil {
+			return err
+		}
+		return tx.Bucket(dbFSM).Delete(keyAppliedIndex)
+	})
+}
+
+// putAll writes the pairs outside of the raft log, it is used for restoring.
+func (kv *kvStore) putAll(pairs [][2][]byte) error {
+	return kv.conn.Update(func(tx *bolt.Tx) error {
+		data, expiry := tx.Bucket(dbData), tx.Bucket(dbExpiry)
+		for _, pair := range pairs {
+			if err := data.Put(pair[0], pair[1]); err != nil {
+				return err
+			}
+			if err := putEntryExpiry(expiry, pair[0], pair[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Converts bytes to an integer
+func bytesToUint64(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+// Converts a uint to a byte slice
+func uint64ToBytes(u uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, u)
+	return buf
+}
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/boltdb/bolt"
+)
+
+// The changes bucket indexes the writes by raft index, its keys are
+// index(8) | key and its values are the op, opAdd for the keys added or set
+// and opDelete for the deleted ones. The values are read from the data
+// bucket, so an add superseded by a later write of the key is skipped.
+//
+// The changes are kept like the raft log: once a snapshot is persisted,
+// the changes up to retainChanges entries before it are trimmed. They are
+// not part of the snapshots, a store restored from one keeps the changes
+// after it. The floor of the changes is the raft index of the last trim or
+// of the last snapshot restored, the changes from up to it are compacted.
+
+// retainChanges is the count of the raft entries whose changes are kept
+// before the last snapshot, like the trailing logs of raft.
+const retainChanges = 10240
+
+// ErrChangesCompacted for reading the changes from an index trimmed or
+// before the last snapshot restored
+var ErrChangesCompacted = errors.New("changes compacted")
+
+// Ops of the changes.
+const (
+	ChangeAdd    = "add"
+	ChangeDelete = "delete"
+)
+
+// Change is a write of a key committed in the raft log.
+type Change struct {
+	Index uint64
+	Op    string
+	Key   string
+	// Value and Meta are empty for a delete.
+	Value []byte
+	Meta  *Meta
+
+	entry *entry // The entry of an add, shipped to the replicas.
+}
+
+func changeKey(index uint64, key []byte) []byte {
+	return append(uint64ToBytes(index), key...)
+}
+
+// putChanges records the keys written with op in the entry of index.
+func putChanges(changes *bolt.Bucket, index uint64, keys []string, op byte) error {
+	for _, key := range keys {
+		if err := changes.Put(changeKey(index, []byte(key)), []byte{op}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putEntryChange records the add of an entry read from the data bucket, the entries written before the raft index was recorded
+// have none.
+func putEntryChange(changes *bolt.Bucket, key, b []byte) error {
+	e, err := decodeEntry(b)
+	if err != nil {
+		return err
+	}
+	if e.Index == 0 {
+		return nil
+	}
+	return changes.Put(changeKey(e.Index, key), []byte{opAdd})
+}
+
+// Changes returns the changes from the raft index from in the order of the
+// log, at most about limit of them, the changes of an entry are never
+// split. It also returns the index to read the following changes from.
+// From 0 starts at the oldest change kept, an index compacted gets
+// ErrChangesCompacted.
+func (s *Store) Changes(from uint64, limit int) ([]Change, uint64, error) {
+	return s.kv.changes(from, limit)
+}
+
+func (kv *kvStore) changes(from uint64, limit int) (changes []Change, next uint64, err error) {
+	err = kv.conn.View(func(tx *bolt.Tx) error {
+		var applied, floor uint64
+		if v := tx.Bucket(dbFSM).Get(keyAppliedIndex); v != nil {
+			applied = bytesToUint64(v)
+		}
+		if v := tx.Bucket(dbFSM).Get(keyChangesFloor); v != nil {
+			floor = bytesToUint64(v)
+		}
+		if from <= floor {
+			if from > 0 {
+				return ErrChangesCompacted
+			}
+			from = floor + 1
+		}
+		if next = applied + 1; from > next {
+			next = from
+		}
+
+		data := tx.Bucket(dbData)
+		var last uint64
+		c := tx.Bucket(dbChanges).Cursor()
+		for k, v := c.Seek(uint64ToBytes(from)); k != nil; k, v = c.Next() {
+			index := bytesToUint64(k[:8])
+			if len(changes) >= limit && index != last {
+				next = index
+				return nil
+			}
+			last = index
+
+			change := Change{Index: index, Op: ChangeDelete, Key: string(k[8:])}
+			if len(v) == 1 && v[0] == opDelete {
+				changes = append(changes, change)
+				continue
+			}
+
+			b := data.Get(k[8:])
+			if b == nil {
+				continue
+			}
+			e, err := decodeEntry(b)
+			if err != nil {
+				return err
+			}
+			if e.Index != index {
+				continue
+			}
+			change.Op, change.Value, change.Meta, change.entry = ChangeAdd, e.Value, e.meta(), e
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	return changes, next, err
+}
+
+// trimChanges deletes the changes up to the raft index, a batch of them in
+// a transaction so the applies are not held up. The floor is raised first,
+// so no reader gets the changes trimmed partly.
+func (kv *kvStore) trimChanges(index uint64) error {
+	err := kv.conn.Update(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(dbFSM).Get(keyChangesFloor); v != nil && bytesToUint64(v) >= index {
+			return nil
+		}
+		return tx.Bucket(dbFSM).Put(keyChangesFloor, uint64ToBytes(index))
+	})
+	if err != nil {
+		return err
+	}
+
+	for done := false; !done; {
+		err := kv.conn.Update(func(tx *bolt.Tx) error {
+			changes := tx.Bucket(dbChanges)
+			var keys [][]byte
+			c := changes.Cursor()
+			for k, _ := c.First(); k != nil && len(keys) < restoreBatchSize && bytesToUint64(k[:8]) <= index; k, _ = c.Next() {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			done = len(keys) < restoreBatchSize
+
+			for _, key := range keys {
+				if err := changes.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
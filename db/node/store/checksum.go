@@ -0,0 +1,143 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+
+	"github.com/boltdb/bolt"
+)
+
+// Every entry carries the CRC-32C of its value, it is checked on the reads
+// and by the scrubber of the service, which compares the checksums of the
+// replicas by the digests of key ranges. A corrupted entry is repaired by
+// writing the entry of a healthy replica in place, outside of the raft log,
+// since the log agrees on the entry and only the local copy is damaged.
+
+var (
+	// ErrChecksumMismatch for an entry whose value does not match its checksum
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrRepairConflict for a repair with an entry of another raft index
+	// than the local one
+	ErrRepairConflict = errors.New("repair entry conflicts with the local one")
+)
+
+// Checksum returns the CRC-32C of a value, as kept in its entry.
+func Checksum(value []byte) uint32 {
+	return crc32.Checksum(value, crcTable)
+}
+
+// verify checks the value against the checksum, the entries written before
+// the checksums pass.
+func (e *entry) verify() error {
+	if e.HasChecksum && Checksum(e.Value) != e.Checksum {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// KeyChecksum is the checksum of the entry of a key.
+type KeyChecksum struct {
+	Key      string `json:"key"`
+	Checksum uint32 `json:"checksum"`
+	Index    uint64 `json:"index"`
+	// Corrupted is set if the entry does not decode or fails its checksum
+	Corrupted bool `json:"corrupted,omitempty"`
+}
+
+// Checksums returns the checksums of the entries in the key range
+// (after, last] in byte order, at most limit of them if limit is positive.
+// An empty last leaves the range open. The entries expired but not yet
+// deleted are in it, the replicas delete them in the order of the log.
+func (s *Store) Checksums(after, last string, limit int) ([]KeyChecksum, error) {
+	sums := []KeyChecksum{}
+	err := s.kv.conn.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(dbData).Cursor()
+		k, v := c.Seek([]byte(after))
+		if after != "" && bytes.Equal(k, []byte(after)) {
+			k, v = c.Next()
+		}
+		for ; k != nil; k, v = c.Next() {
+			if last != "" && bytes.Compare(k, []byte(last)) > 0 {
+				return nil
+			}
+			if limit > 0 && len(sums) == limit {
+				return nil
+			}
+
+			sum := KeyChecksum{Key: string(k)}
+			e, err := decodeEntry(v)
+			if err == nil {
+				err = e.verify()
+			}
+			if err != nil {
+				sum.Corrupted = true
+			} else {
+				sum.Checksum, sum.Index = Checksum(e.Value), e.Index
+			}
+			sums = append(sums, sum)
+		}
+		return nil
+	})
+	return sums, err
+}
+
+// Digest returns the digest of the checksums, the replicas agreeing on a
+// key range have the same digest for it.
+func Digest(sums []KeyChecksum) string {
+	h := sha256.New()
+	for _, sum := range sums {
+		h.Write(appendField(nil, []byte(sum.Key)))
+		h.Write(uint32ToBytes(sum.Checksum))
+		h.Write(uint64ToBytes(sum.Index))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Entry returns the encoded entry of the key as stored, or nil if the key
+// does not exist.
+func (s *Store) Entry(key string) ([]byte, error) {
+	return s.kv.get([]byte(key))
+}
+
+// Repair replaces the local entry of the key with the encoded entry b of a
+// healthy replica. The entry b must pass its checksum and have the raft
+// index of the local entry, unless the local one does not decode. A key
+// missing locally is not repaired, it is only written by the log.
+func (s *Store) Repair(key string, b []byte) error {
+	e, err := decodeEntry(b)
+	if err != nil {
+		return err
+	}
+	if !e.HasChecksum {
+		return ErrCommandCorrupted
+	}
+	if err := e.verify(); err != nil {
+		return err
+	}
+
+	return s.kv.conn.Update(func(tx *bolt.Tx) error {
+		data, expiry := tx.Bucket(dbData), tx.Bucket(dbExpiry)
+		local := data.Get([]byte(key))
+		if local == nil {
+			return ErrKeyNotFound
+		}
+		if l, err := decodeEntry(local); err == nil {
+			if l.Index != e.Index {
+				return ErrRepairConflict
+			}
+			if l.ExpiresAt != 0 {
+				if err := expiry.Delete(expiryKey(l.ExpiresAt, []byte(key))); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := data.Put([]byte(key), b); err != nil {
+			return err
+		}
+		return putEntryExpiry(expiry, []byte(key), b)
+	})
+}
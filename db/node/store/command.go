@@ -0,0 +1,387 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// A command is encoded as:
+//
+//	version(1) | op(1) | field...
+//	field: uvarint(len) | bytes
+//
+// Add and set carry the key, the value, the request ID, the timestamp as an
+// uvarint, the writer label, the content type and the expiry time as an
+// uvarint in unix nanoseconds, 0 if the key never expires. Purge carries
+// the key, the operator as the writer, the reason and the timestamp.
+//
+// Decoders read the fields they know and ignore trailing ones, so a newer
+// node may append fields to an op without breaking older nodes. The version
+// only changes when the encoding itself becomes incompatible.
+const (
+	commandVersion = 1
+
+	opAdd    byte = 1
+	opSet    byte = 2
+	opDelete byte = 3
+	// opBatchAdd carries the flags, the count of pairs, the key and the
+	// value of every pair and then the fields following the value of add.
+	opBatchAdd byte = 4
+	// opExpire carries the count of keys, the keys and the timestamp of the
+	// leader, it deletes the keys expired at that time.
+	opExpire byte = 5
+	opPurge  byte = 6
+	// opGroupAdd carries the count of adds and, for every add, its key,
+	// its value and the fields following the value of add nested in one
+	// field, so an add may get more fields. It applies the adds gathered
+	// by the group commit of the leader in order.
+	opGroupAdd byte = 7
+
+	batchFlagAtomic byte = 1 << 0
+)
+
+var (
+	// ErrUnknownCommand for a command this node can not apply, it is the
+	// response of Apply and the entry leaves the store unchanged
+	ErrUnknownCommand = errors.New("unknown command")
+	// ErrCommandCorrupted for a command or an entry failing to decode
+	ErrCommandCorrupted = errors.New("command corrupted")
+)
+
+var opNames = map[byte]string{
+	opAdd:      "add",
+	opSet:      "set",
+	opDelete:   "delete",
+	opBatchAdd: "batch_add",
+	opExpire:   "expire",
+	opPurge:    "purge",
+	opGroupAdd: "group_add",
+}
+
+// Pair is a key/value pair of a batch.
+type Pair struct {
+	Key   string
+	Value []byte
+}
+
+type command struct {
+	Op    byte
+	Key   string
+	Value []byte
+
+	// RequestID identifies the write, a retry of the write carries the same
+	// RequestID, it is optional.
+	RequestID string
+	// Timestamp is assigned by the leader in unix nanoseconds, Writer is
+	// the optional label of the writer and ContentType the optional media
+	// type of the values, all are kept in the entries.
+	Timestamp   int64
+	Writer      string
+	ContentType string
+	// ExpiresAt is the time the added keys expire in unix nanoseconds,
+	// computed by the leader, 0 if they never expire.
+	ExpiresAt int64
+
+	// batch
+	Atomic bool
+	Pairs  []Pair
+
+	// expire
+	Keys []string
+
+	// group add
+	Adds []*command
+
+	// Reason of a purge, kept in its audit record
+	Reason string
+}
+
+// encode returns the binary form of c.
+func (c *command) encode() []byte {
+	b := make([]byte, 0, 2+2*binary.MaxVarintLen64+len(c.Key)+len(c.Value))
+	b = append(b, commandVersion, c.Op)
+	switch c.Op {
+	case opBatchAdd:
+		var flags byte
+		if c.Atomic {
+			flags |= batchFlagAtomic
+		}
+		b = appendField(b, []byte{flags})
+		b = appendField(b, appendUvarint(nil, uint64(len(c.Pairs))))
+		for _, pair := range c.Pairs {
+			b = appendField(b, []byte(pair.Key))
+			b = appendField(b, pair.Value)
+		}
+		b = c.appendWriteFields(b)
+	case opGroupAdd:
+		b = appendField(b, appendUvarint(nil, uint64(len(c.Adds))))
+		for _, add := range c.Adds {
+			b = appendField(b, []byte(add.Key))
+			b = appendField(b, add.Value)
+			b = appendField(b, add.appendWriteFields(nil))
+		}
+	case opDelete:
+		b = appendField(b, []byte(c.Key))
+	case opExpire:
+		b = appendField(b, appendUvarint(nil, uint64(len(c.Keys))))
+		for _, key := range c.Keys {
+			b = appendField(b, []byte(key))
+		}
+		b = appendField(b, appendUvarint(nil, uint64(c.Timestamp)))
+	case opPurge:
+		b = appendField(b, []byte(c.Key))
+		b = appendField(b, []byte(c.Writer))
+		b = appendField(b, []byte(c.Reason))
+		b = appendField(b, appendUvarint(nil, uint64(c.Timestamp)))
+	default:
+		b = appendField(b, []byte(c.Key))
+		b = appendField(b, c.Value)
+		b = c.appendWriteFields(b)
+	}
+	return b
+}
+
+// appendWriteFields appends the fields describing the write.
+func (c *command) appendWriteFields(b []byte) []byte {
+	b = appendField(b, []byte(c.RequestID))
+	b = appendField(b, appendUvarint(nil, uint64(c.Timestamp)))
+	b = appendField(b, []byte(c.Writer))
+	b = appendField(b, []byte(c.ContentType))
+	return appendField(b, appendUvarint(nil, uint64(c.ExpiresAt)))
+}
+
+// readWriteFields reads the fields appended by appendWriteFields, they are
+// missing in the commands written before them.
+func (c *command) readWriteFields(r *fieldReader) {
+	c.RequestID = r.optional()
+	c.Timestamp = int64(r.optionalUvarint())
+	c.Writer = r.optional()
+	c.ContentType = r.optional()
+	c.ExpiresAt = int64(r.optionalUvarint())
+}
+
+// decodeCommand decodes the binary form, or the JSON form written by nodes
+// before the binary encoding.
+func decodeCommand(b []byte) (*command, error) {
+	if len(b) > 0 && b[0] == '{' {
+		return decodeLegacyCommand(b)
+	}
+	if len(b) < 2 {
+		return nil, ErrCommandCorrupted
+	}
+	if b[0] > commandVersion {
+		return nil, ErrUnknownCommand
+	}
+
+	c := &command{Op: b[1]}
+	r := fieldReader(b[2:])
+	switch c.Op {
+	case opAdd, opSet:
+		key, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		c.Key, c.Value = string(key), value
+		c.readWriteFields(&r)
+
+	case opDelete:
+		key, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		c.Key = string(key)
+
+	case opBatchAdd:
+		flags, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if len(flags) != 1 {
+			return nil, ErrCommandCorrupted
+		}
+		c.Atomic = flags[0]&batchFlagAtomic != 0
+
+		countField, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		count, n := binary.Uvarint(countField)
+		if n <= 0 || count > uint64(len(r)) {
+			return nil, ErrCommandCorrupted
+		}
+
+		c.Pairs = make([]Pair, count)
+		for i := range c.Pairs {
+			key, err := r.next()
+			if err != nil {
+				return nil, err
+			}
+			value, err := r.next()
+			if err != nil {
+				return nil, err
+			}
+			c.Pairs[i] = Pair{Key: string(key), Value: value}
+		}
+		c.readWriteFields(&r)
+
+	case opGroupAdd:
+		count, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if count > uint64(len(r)) {
+			return nil, ErrCommandCorrupted
+		}
+
+		c.Adds = make([]*command, count)
+		for i := range c.Adds {
+			key, err := r.next()
+			if err != nil {
+				return nil, err
+			}
+			value, err := r.next()
+			if err != nil {
+				return nil, err
+			}
+			writeFields, err := r.next()
+			if err != nil {
+				return nil, err
+			}
+			add := &command{Op: opAdd, Key: string(key), Value: value}
+			fields := fieldReader(writeFields)
+			add.readWriteFields(&fields)
+			c.Adds[i] = add
+		}
+		if len(c.Adds) > 0 {
+			c.Timestamp = c.Adds[0].Timestamp
+		}
+
+	case opExpire:
+		count, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if count > uint64(len(r)) {
+			return nil, ErrCommandCorrupted
+		}
+
+		c.Keys = make([]string, count)
+		for i := range c.Keys {
+			key, err := r.next()
+			if err != nil {
+				return nil, err
+			}
+			c.Keys[i] = string(key)
+		}
+		timestamp, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		c.Timestamp = int64(timestamp)
+
+	case opPurge:
+		fields := make([][]byte, 3)
+		for i := range fields {
+			field, err := r.next()
+			if err != nil {
+				return nil, err
+			}
+			fields[i] = field
+		}
+		timestamp, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		c.Key, c.Writer, c.Reason = string(fields[0]), string(fields[1]), string(fields[2])
+		c.Timestamp = int64(timestamp)
+
+	default:
+		return nil, ErrUnknownCommand
+	}
+
+	return c, nil
+}
+
+func decodeLegacyCommand(b []byte) (*command, error) {
+	legacy := struct {
+		Op    string `json:"op,omitempty"`
+		Key   string `json:"key,omitempty"`
+		Value string `json:"value,omitempty"`
+	}{}
+	if err := json.Unmarshal(b, &legacy); err != nil {
+		return nil, ErrCommandCorrupted
+	}
+
+	for op, name := range opNames {
+		if name == legacy.Op {
+			return &command{Op: op, Key: legacy.Key, Value: []byte(legacy.Value)}, nil
+		}
+	}
+	return nil, ErrUnknownCommand
+}
+
+func appendField(b []byte, field []byte) []byte {
+	b = appendUvarint(b, uint64(len(field)))
+	return append(b, field...)
+}
+
+type fieldReader []byte
+
+// next returns the next field, the returned slice shares the memory of r.
+func (r *fieldReader) next() ([]byte, error) {
+	size, n := binary.Uvarint(*r)
+	if n <= 0 || uint64(len(*r)-n) < size {
+		return nil, ErrCommandCorrupted
+	}
+
+	field := (*r)[n : n+int(size)]
+	*r = (*r)[n+int(size):]
+	return field, nil
+}
+
+// uvarint returns the next field as an uvarint.
+func (r *fieldReader) uvarint() (uint64, error) {
+	field, err := r.next()
+	if err != nil {
+		return 0, err
+	}
+	v, n := binary.Uvarint(field)
+	if n <= 0 {
+		return 0, ErrCommandCorrupted
+	}
+	return v, nil
+}
+
+// optional returns the next field as a string, or "" if there are no more
+// fields, for fields added after the first version of an op.
+func (r *fieldReader) optional() string {
+	if len(*r) == 0 {
+		return ""
+	}
+
+	field, err := r.next()
+	if err != nil {
+		return ""
+	}
+	return string(field)
+}
+
+// optionalUvarint returns the next field as an uvarint, or 0 if there are
+// no more fields.
+func (r *fieldReader) optionalUvarint() uint64 {
+	if len(*r) == 0 {
+		return 0
+	}
+
+	field, err := r.next()
+	if err != nil {
+		return 0
+	}
+	v, _ := binary.Uvarint(field)
+	return v
+}
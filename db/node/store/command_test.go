@@ -0,0 +1,121 @@
+package store
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestCommandEncoding(t *testing.T) {
+	c := &command{Op: opAdd, Key: "foo", Value: []byte{0, 'b', 'a', 'r', 0xff}, RequestID: "r1", Timestamp: 42, Writer: "w", ContentType: "application/gzip", ExpiresAt: 43}
+	got, err := decodeCommand(c.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Op != c.Op || got.Key != c.Key || !bytes.Equal(got.Value, c.Value) ||
+		got.RequestID != c.RequestID || got.Timestamp != c.Timestamp || got.Writer != c.Writer ||
+		got.ContentType != c.ContentType || got.ExpiresAt != c.ExpiresAt {
+		t.Errorf("expect %v, got %v", c, got)
+	}
+
+	expire := &command{Op: opExpire, Keys: []string{"a", "b"}, Timestamp: 42}
+	if got, err = decodeCommand(expire.encode()); err != nil || len(got.Keys) != 2 || got.Keys[1] != "b" || got.Timestamp != 42 {
+		t.Errorf("failed to decode the expire command, got %v, err: %v", got, err)
+	}
+
+	purge := &command{Op: opPurge, Key: "foo", Writer: "alice", Reason: "legal", Timestamp: 42}
+	if got, err = decodeCommand(purge.encode()); err != nil || got.Key != "foo" || got.Writer != "alice" || got.Reason != "legal" || got.Timestamp != 42 {
+		t.Errorf("failed to decode the purge command, got %v, err: %v", got, err)
+	}
+
+	group := &command{Op: opGroupAdd, Adds: []*command{c, {Op: opAdd, Key: "baz", Value: []byte{}, RequestID: "r2", Timestamp: 44}}}
+	if got, err = decodeCommand(group.encode()); err != nil || len(got.Adds) != 2 || got.Timestamp != 42 ||
+		!reflect.DeepEqual(got.Adds[0], c) || !reflect.DeepEqual(got.Adds[1], group.Adds[1]) {
+		t.Errorf("failed to decode the group add command, got %v, err: %v", got, err)
+	}
+
+	// fields added later are missing in the commands of older nodes
+	b := appendField(appendField([]byte{commandVersion, opAdd}, []byte("foo")), []byte("bar"))
+	if got, err = decodeCommand(b); err != nil || got.RequestID != "" || got.Timestamp != 0 || got.Writer != "" {
+		t.Errorf("failed to decode the command without optional fields, got %v, err: %v", got, err)
+	}
+
+	// fields appended by a newer node are ignored
+	b = appendField(c.encode(), []byte("unknown field"))
+	if got, err = decodeCommand(b); err != nil || got.Key != "foo" {
+		t.Errorf("failed to ignore the trailing field, got %v, err: %v", got, err)
+	}
+
+	// commands written in JSON by old nodes
+	got, err = decodeCommand([]byte(`{"op":"add","key":"foo","value":"bar"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Op != opAdd || got.Key != "foo" || string(got.Value) != "bar" {
+		t.Errorf("failed to decode the legacy command, got %v", got)
+	}
+
+	// unknown op or version
+	for _, b := range [][]byte{
+		{commandVersion, 0xff},
+		{commandVersion + 1, opAdd},
+		[]byte(`{"op":"unknown"}`),
+	} {
+		if _, err := decodeCommand(b); err != ErrUnknownCommand {
+			t.Errorf("expect ErrUnknownCommand for %v, got %v", b, err)
+		}
+	}
+
+	// truncated field
+	if _, err := decodeCommand(c.encode()[:4]); err != ErrCommandCorrupted {
+		t.Errorf("expect ErrCommandCorrupted, got %v", err)
+	}
+}
+
+func TestApplyUnknownCommand(t *testing.T) {
+	f := (*fsm)(testOpenedKV(t))
+	add := &command{Op: opAdd, Key: "foo", Value: []byte("bar")}
+	if res := f.Apply(&raft.Log{Index: 1, Data: []byte{commandVersion, 0xff}}); res != ErrUnknownCommand {
+		t.Errorf("expect ErrUnknownCommand, got %v", res)
+	}
+	if res := f.Apply(&raft.Log{Index: 2, Data: add.encode()[:4]}); res != ErrCommandCorrupted {
+		t.Errorf("expect ErrCommandCorrupted, got %v", res)
+	}
+	if index, err := f.kv.appliedIndex(); err != nil || index != 2 || (*Store)(f).appliedIndex() != 2 {
+		t.Errorf("expect the skipped entries applied, got %d, err: %v", index, err)
+	}
+
+	if res := f.Apply(&raft.Log{Index: 3, Data: add.encode()}); res != (AddResult{Result: Created}) {
+		t.Errorf("failed to apply after an unknown command, got %v", res)
+	}
+}
+
+func TestOpNames(t *testing.T) {
+	for op := opAdd; op <= MaxOp; op++ {
+		if opNames[op] == "" {
+			t.Errorf("expect a name for op %d", op)
+		}
+	}
+}
+
+// TestClusterOp tests the store refuses the ops some voter does not apply.
+func TestClusterOp(t *testing.T) {
+	s := New()
+	if op := s.ClusterOp(); op != BaseOp {
+		t.Errorf("expect BaseOp until set, got %d", op)
+	}
+	if f := s.apply((&command{Op: opPurge, Key: "foo"}).encode()); f.Error() != ErrUnsupportedOp {
+		t.Errorf("expect ErrUnsupportedOp, got %v", f.Error())
+	}
+
+	s.SetClusterOp(0xff)
+	if op := s.ClusterOp(); op != MaxOp {
+		t.Errorf("expect the cluster op at most MaxOp, got %d", op)
+	}
+	if stats := s.Stats(); stats["max_op"] != strconv.Itoa(int(MaxOp)) {
+		t.Errorf("expect the max_op in the stats, got %v", stats)
+	}
+}
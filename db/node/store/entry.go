@@ -0,0 +1,141 @@
+package store
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// An entry is the record of a key in the data bucket, encoded like a
+// command as version(1) | field..., the fields are the value, the request
+// ID of the write which added the key, the raft index and term of the
+// commit, the leader-assigned timestamp in unix nanoseconds, the writer
+// label, the content type, the expiry time in unix nanoseconds and the
+// CRC-32C of the value as 4 bytes. Like commands, decoders ignore the
+// trailing fields they do not know, and the fields after the request ID
+// are missing in the entries written before them.
+const entryVersion = 1
+
+type entry struct {
+	Value     []byte
+	RequestID string
+
+	Index       uint64
+	Term        uint64
+	Timestamp   int64
+	Writer      string
+	ContentType string
+	ExpiresAt   int64
+
+	// Checksum of the value, the entries written before the checksums
+	// have none and get it when they are encoded again
+	Checksum    uint32
+	HasChecksum bool
+}
+
+// Meta is the metadata of a key, recorded when the key is written.
+type Meta struct {
+	// Index and Term are the ones of the raft log entry of the write.
+	Index uint64
+	Term  uint64
+	// Timestamp is assigned by the leader taking the write.
+	Timestamp time.Time
+	// Writer is the optional label of the writer.
+	Writer string
+	// RequestID is the optional ID of the write.
+	RequestID string
+	// ContentType is the optional media type of the value.
+	ContentType string
+	// ExpiresAt is the time the key expires, zero if it never expires.
+	ExpiresAt time.Time
+}
+
+// newEntry returns the entry of value written by c committed in l.
+func newEntry(l *raft.Log, c *command, value []byte) *entry {
+	return &entry{
+		Value:       value,
+		RequestID:   c.RequestID,
+		Index:       l.Index,
+		Term:        l.Term,
+		Timestamp:   c.Timestamp,
+		Writer:      c.Writer,
+		ContentType: c.ContentType,
+		ExpiresAt:   c.ExpiresAt,
+	}
+}
+
+// expiredAt reports whether e is expired at now in unix nanoseconds.
+func (e *entry) expiredAt(now int64) bool {
+	return e.ExpiresAt > 0 && e.ExpiresAt <= now
+}
+
+// meta returns the metadata of e.
+func (e *entry) meta() *Meta {
+	m := &Meta{
+		Index:       e.Index,
+		Term:        e.Term,
+		Writer:      e.Writer,
+		RequestID:   e.RequestID,
+		ContentType: e.ContentType,
+	}
+	if e.Timestamp > 0 {
+		m.Timestamp = time.Unix(0, e.Timestamp)
+	}
+	if e.ExpiresAt > 0 {
+		m.ExpiresAt = time.Unix(0, e.ExpiresAt)
+	}
+	return m
+}
+
+// encode returns the binary form of e.
+func (e *entry) encode() []byte {
+	b := make([]byte, 0, 1+40+len(e.Value)+len(e.RequestID)+len(e.Writer)+len(e.ContentType))
+	b = append(b, entryVersion)
+	b = appendField(b, e.Value)
+	b = appendField(b, []byte(e.RequestID))
+	b = appendField(b, appendUvarint(nil, e.Index))
+	b = appendField(b, appendUvarint(nil, e.Term))
+	b = appendField(b, appendUvarint(nil, uint64(e.Timestamp)))
+	b = appendField(b, []byte(e.Writer))
+	b = appendField(b, []byte(e.ContentType))
+	b = appendField(b, appendUvarint(nil, uint64(e.ExpiresAt)))
+
+	checksum := e.Checksum
+	if !e.HasChecksum {
+		checksum = Checksum(e.Value)
+	}
+	return appendField(b, uint32ToBytes(checksum))
+}
+
+// decodeEntry decodes b, the returned entry copies nothing from b, so it
+// can be used after the transaction b belongs to.
+func decodeEntry(b []byte) (*entry, error) {
+	if len(b) < 1 || b[0] > entryVersion {
+		return nil, ErrCommandCorrupted
+	}
+
+	r := fieldReader(b[1:])
+	value, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	requestID, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+
+	e := &entry{
+		Value:       append([]byte{}, value...),
+		RequestID:   string(requestID),
+		Index:       r.optionalUvarint(),
+		Term:        r.optionalUvarint(),
+		Timestamp:   int64(r.optionalUvarint()),
+		Writer:      r.optional(),
+		ContentType: r.optional(),
+		ExpiresAt:   int64(r.optionalUvarint()),
+	}
+	if checksum := r.optional(); len(checksum) == 4 {
+		e.Checksum, e.HasChecksum = bytesToUint32([]byte(checksum)), true
+	}
+	return e, nil
+}
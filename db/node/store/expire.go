@@ -0,0 +1,168 @@
+package store
+
+import (
+	"time"
+
+	"github.com/Focinfi/oncekv/log"
+	"github.com/boltdb/bolt"
+)
+
+// The expiry bucket indexes the keys with a TTL by their expiry time, its
+// keys are expiresAt(8) | key. The leader scans it and issues opExpire for
+// the keys expired, every node deletes them in the order of the log, so
+// the replicas agree on the keys. An expired key is free to be added again
+// before its opExpire is applied, it is checked against the timestamp of
+// the add. The expiry bucket is rebuilt from the entries on restore.
+
+const (
+	// expireInterval is how often the leader looks for the keys expired
+	expireInterval = time.Second
+
+	// maxExpireKeys limits the keys of one opExpire
+	maxExpireKeys = 1000
+)
+
+func expiryKey(expiresAt int64, key []byte) []byte {
+	return append(uint64ToBytes(uint64(expiresAt)), key...)
+}
+
+// putEntry writes the entry e of the key, replacing the expiry of the
+// entry it overwrites.
+func putEntry(data *bolt.Bucket, key string, e *entry) error {
+	if err := checkPut(key, e); err != nil {
+		return err
+	}
+	expiry := data.Tx().Bucket(dbExpiry)
+	if err := deleteExpiry(data, expiry, []byte(key)); err != nil {
+		return err
+	}
+	if err := data.Put([]byte(key), e.encode()); err != nil {
+		return err
+	}
+	if e.ExpiresAt == 0 {
+		return nil
+	}
+	return expiry.Put(expiryKey(e.ExpiresAt, []byte(key)), nil)
+}
+
+// checkPut returns the error putting the entry e of the key fails with,
+// before anything is written. The expiry key is the key prefixed by the
+// expiry time.
+func checkPut(key string, e *entry) error {
+	switch {
+	case key == "":
+		return bolt.ErrKeyRequired
+	case len(key) > MaxKeyBytes, e.ExpiresAt != 0 && len(key)+8 > bolt.MaxKeySize:
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// deleteExpiry deletes the expiry of the entry of the key in the data
+// bucket, if any.
+func deleteExpiry(data, expiry *bolt.Bucket, key []byte) error {
+	b := data.Get(key)
+	if b == nil {
+		return nil
+	}
+	e, err := decodeEntry(b)
+	if err != nil {
+		return err
+	}
+	if e.ExpiresAt == 0 {
+		return nil
+	}
+	return expiry.Delete(expiryKey(e.ExpiresAt, key))
+}
+
+// putEntryExpiry records the expiry of an entry read from a snapshot or
+// from the data bucket.
+func putEntryExpiry(expiry *bolt.Bucket, key, b []byte) error {
+	e, err := decodeEntry(b)
+	if err != nil {
+		return err
+	}
+	if e.ExpiresAt == 0 {
+		return nil
+	}
+	return expiry.Put(expiryKey(e.ExpiresAt, key), nil)
+}
+
+// applyExpire deletes the keys expired at the timestamp of the leader,
+// a key added again since the leader found it expired is kept.
+func (f *fsm) applyExpire(data *bolt.Bucket, c *command) interface{} {
+	expiry := data.Tx().Bucket(dbExpiry)
+	for _, key := range c.Keys {
+		b := data.Get([]byte(key))
+		if b == nil {
+			continue
+		}
+		e, err := decodeEntry(b)
+		if err != nil {
+			return err
+		}
+		if !e.expiredAt(c.Timestamp) {
+			continue
+		}
+
+		if err := expiry.Delete(expiryKey(e.ExpiresAt, []byte(key))); err != nil {
+			return err
+		}
+		if err := data.Delete([]byte(key)); err != nil {
+			return err
+		}
+		f.deleted = append(f.deleted, key)
+	}
+	return nil
+}
+
+// expiredKeys returns the keys expired at now, at most limit of them.
+func (kv *kvStore) expiredKeys(now int64, limit int) ([]string, error) {
+	var keys []string
+	err := kv.conn.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(dbExpiry).Cursor()
+		for k, _ := c.First(); k != nil && len(keys) < limit; k, _ = c.Next() {
+			if int64(bytesToUint64(k[:8])) > now {
+				return nil
+			}
+			keys = append(keys, string(k[8:]))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// expire issues opExpire for the keys expired now, if the node is the
+// leader and every voter applies it.
+func (s *Store) expire() error {
+	if !s.isLeader() || !s.supportsOp(opExpire) {
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+	keys, err := s.kv.expiredKeys(now, maxExpireKeys)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	c := &command{Op: opExpire, Keys: keys, Timestamp: now}
+	return s.apply(c.encode()).Error()
+}
+
+// runExpirer expires the keys every expireInterval while the node is the
+// leader, until the store shuts down.
+func (s *Store) runExpirer() {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.expire(); err != nil {
+				log.DB.Errorln(logPrefix, "failed to expire keys:", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
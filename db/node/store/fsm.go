@@ -0,0 +1,366 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/Focinfi/oncekv/log"
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/raft"
+)
+
+type fsm Store
+
+// Apply applies a Raft log entry to the key-value store. An entry this node
+// can not decode, for example written by a newer node during a rolling
+// upgrade, leaves the store unchanged and responds the decoding error. The
+// leader only proposes the ops every voter applies, see MaxOp.
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	// The entry has been applied before the node restarted.
+	if l.Index <= f.applied {
+		return nil
+	}
+
+	c, err := decodeCommand(l.Data)
+	if err != nil {
+		log.DB.Errorf("%s skip entry %d: %v", logPrefix, l.Index, err)
+		if err := f.kv.setAppliedIndex(l.Index); err != nil {
+			panic(fmt.Sprintf("failed to skip command: %s", err.Error()))
+		}
+		(*Store)(f).setApplied(l.Index)
+		return err
+	}
+
+	var res interface{}
+	err = f.kv.update(l.Index, func(data *bolt.Bucket) error {
+		switch c.Op {
+		case opAdd:
+			res = f.applyAdd(data, c.Key, newEntry(l, c, c.Value))
+		case opSet:
+			res = f.applySet(data, c.Key, newEntry(l, c, c.Value))
+		case opDelete:
+			res = f.applyDelete(data, c.Key)
+		case opBatchAdd:
+			res = f.applyBatchAdd(data, l, c)
+		case opGroupAdd:
+			res = f.applyGroupAdd(data, l, c)
+		case opExpire:
+			res = f.applyExpire(data, c)
+		case opPurge:
+			res = f.applyPurge(data, l, c)
+		}
+		// A command failing leaves the store unchanged, its partial
+		// writes are rolled back.
+		if err, ok := res.(error); ok {
+			return rollback{err}
+		}
+
+		changes := data.Tx().Bucket(dbChanges)
+		if err := putChanges(changes, l.Index, f.added, opAdd); err != nil {
+			return err
+		}
+		return putChanges(changes, l.Index, f.deleted, opDelete)
+	})
+	if _, ok := err.(rollback); ok {
+		f.added, f.deleted = f.added[:0], f.deleted[:0]
+		err = f.kv.setAppliedIndex(l.Index)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to apply command: %s", err.Error()))
+	}
+
+	(*Store)(f).setApplied(l.Index)
+	if len(f.added) > 0 {
+		f.watches.notify(f.added...)
+		f.added = f.added[:0]
+	}
+	f.deleted = f.deleted[:0]
+	return res
+}
+
+// rollback is returned by a transaction of Apply to roll back the writes of
+// the failing command, its error is the response of the entry.
+type rollback struct{ error }
+
+// Snapshot returns a snapshot of the key-value store.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	// A read-only transaction gives a consistent view of the store while
+	// Apply keeps writing, Persist streams it off the FSM goroutine.
+	tx, err := f.kv.conn.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &fsmSnapshot{tx: tx, kv: f.kv}, nil
+}
+
+// Restore stores the key-value store to a previous state.
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	r := bufio.NewReader(rc)
+	legacy, err := isLegacySnapshot(r)
+	if err != nil {
+		return err
+	}
+
+	// The restored keys wake up the readers waiting for them.
+	defer f.watches.notifyAll()
+
+	// Set the state from the snapshot, no lock required according to
+	// Hashicorp docs.
+	if legacy {
+		return f.restoreLegacy(r)
+	}
+	return f.restore(r)
+}
+
+// restore reads a snapshot written by fsmSnapshot.Persist.
+func (f *fsm) restore(r *bufio.Reader) error {
+	sr, err := newSnapshotReader(r)
+	if err != nil {
+		return err
+	}
+
+	// The entries on disk are already newer than the snapshot, which is the
+	// case when a node restarts, there is nothing to load.
+	if sr.index > 0 && sr.index <= f.applied {
+		return nil
+	}
+
+	if err := f.kv.reset(); err != nil {
+		return err
+	}
+	(*Store)(f).setApplied(0)
+
+	pairs := make([][2][]byte, 0, restoreBatchSize)
+	for {
+		key, value, err := sr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// Snapshots of version 1 carry the values instead of the entries.
+		if sr.version < 2 {
+			value = (&entry{Value: value}).encode()
+		}
+
+		pairs = append(pairs, [2][]byte{key, value})
+		if len(pairs) == restoreBatchSize {
+			if err := f.kv.putAll(pairs); err != nil {
+				return err
+			}
+			pairs = pairs[:0]
+		}
+	}
+
+	if err := f.kv.putAll(pairs); err != nil {
+		return err
+	}
+	if err := f.kv.putAudits(sr.audits); err != nil {
+		return err
+	}
+	if err := f.kv.setSnapshotIndex(sr.index); err != nil {
+		return err
+	}
+	(*Store)(f).setApplied(sr.index)
+	return nil
+}
+
+// restoreLegacy reads a snapshot of the old format, a JSON object of all
+// the key/value pairs. The log entries covered by it are applied again
+// because the format carries no raft index.
+func (f *fsm) restoreLegacy(r io.Reader) error {
+	if err := f.kv.reset(); err != nil {
+		return err
+	}
+	(*Store)(f).setApplied(0)
+
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	pairs := make([][2][]byte, 0, restoreBatchSize)
+	for dec.More() {
+		var key, value string
+		if err := dec.Decode(&key); err != nil {
+			return err
+		}
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+
+		pairs = append(pairs, [2][]byte{[]byte(key), (&entry{Value: []byte(value)}).encode()})
+		if len(pairs) == restoreBatchSize {
+			if err := f.kv.putAll(pairs); err != nil {
+				return err
+			}
+			pairs = pairs[:0]
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return err
+	}
+	return f.kv.putAll(pairs)
+}
+
+func (f *fsm) applySet(data *bolt.Bucket, key string, e *entry) interface{} {
+	if err := putEntry(data, key, e); err != nil {
+		return err
+	}
+	f.added = append(f.added, key)
+	return nil
+}
+
+func (f *fsm) applyAdd(data *bolt.Bucket, key string, e *entry) interface{} {
+	res, exists, err := checkAdd(data, key, e.Value, e.RequestID, e.Timestamp)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return res
+	}
+
+	if err := putEntry(data, key, e); err != nil {
+		return err
+	}
+	// The readers waiting for the key are woken up once the entry is
+	// committed to the store.
+	f.added = append(f.added, key)
+	return res
+}
+
+// checkAdd returns the result of adding the key/value by the write of
+// requestID at the leader timestamp now, without adding it. A key expired
+// at now does not exist.
+func checkAdd(data *bolt.Bucket, key string, value []byte, requestID string, now int64) (res AddResult, exists bool, err error) {
+	b := data.Get([]byte(key))
+	if b == nil {
+		return AddResult{Result: Created, RequestID: requestID}, false, nil
+	}
+
+	e, err := decodeEntry(b)
+	if err != nil {
+		return res, true, err
+	}
+	if e.expiredAt(now) {
+		return AddResult{Result: Created, RequestID: requestID}, false, nil
+	}
+
+	res.RequestID = e.RequestID
+	switch {
+	case !bytes.Equal(e.Value, value):
+		res.Result = Conflict
+	case requestID != "" && requestID == e.RequestID:
+		res.Result = Created
+	default:
+		res.Result = Exists
+	}
+	return res, true, nil
+}
+
+// applyBatchAdd adds the pairs and returns the result of every pair. In the
+// atomic mode, nothing is added if any of the keys exists, the other keys
+// get Aborted. A key repeated in the batch is checked against its first
+// pair, so a retry of the batch gets the same results.
+func (f *fsm) applyBatchAdd(data *bolt.Bucket, l *raft.Log, c *command) interface{} {
+	pairs, requestID := c.Pairs, c.RequestID
+	results := make([]AddResult, len(pairs))
+	missing := make([]bool, len(pairs))
+	seen := make(map[string][]byte, len(pairs))
+	var aborted bool
+	for i, pair := range pairs {
+		if value, ok := seen[pair.Key]; ok {
+			results[i] = AddResult{Result: Conflict, RequestID: requestID}
+			if bytes.Equal(value, pair.Value) {
+				results[i].Result = Exists
+			}
+			continue
+		}
+		seen[pair.Key] = pair.Value
+
+		res, exists, err := checkAdd(data, pair.Key, pair.Value, requestID, c.Timestamp)
+		if err != nil {
+			return err
+		}
+		results[i], missing[i] = res, !exists
+		aborted = aborted || res.Result != Created
+	}
+
+	if c.Atomic && aborted {
+		for i := range results {
+			if results[i].Result == Created {
+				results[i].Result = Aborted
+			}
+		}
+		return results
+	}
+
+	for i, pair := range pairs {
+		if !missing[i] {
+			continue
+		}
+		if err := putEntry(data, pair.Key, newEntry(l, c, pair.Value)); err != nil {
+			return err
+		}
+		f.added = append(f.added, pair.Key)
+	}
+	return results
+}
+
+// applyGroupAdd applies the adds of the group one after another, like in
+// log entries of their own, and returns the result of every add. An add
+// failing its checks writes nothing and gets its error in its result, the
+// other adds go on. A failing write fails the whole group.
+func (f *fsm) applyGroupAdd(data *bolt.Bucket, l *raft.Log, c *command) interface{} {
+	results := make([]AddResult, len(c.Adds))
+	for i, add := range c.Adds {
+		e := newEntry(l, add, add.Value)
+		res, exists, err := checkAdd(data, add.Key, e.Value, e.RequestID, e.Timestamp)
+		if err == nil && !exists {
+			err = checkPut(add.Key, e)
+		}
+		if err != nil {
+			results[i].err = err
+			continue
+		}
+		if !exists {
+			if err := putEntry(data, add.Key, e); err != nil {
+				return err
+			}
+			f.added = append(f.added, add.Key)
+		}
+		results[i] = res
+	}
+	return results
+}
+
+func (f *fsm) applyDelete(data *bolt.Bucket, key string) interface{} {
+	if data.Get([]byte(key)) == nil {
+		return nil
+	}
+	if err := deleteExpiry(data, data.Tx().Bucket(dbExpiry), []byte(key)); err != nil {
+		return err
+	}
+	if err := data.Delete([]byte(key)); err != nil {
+		return err
+	}
+	f.deleted = append(f.deleted, key)
+	return nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("unexpected token in snapshot: %v", t)
+	}
+	return nil
+}
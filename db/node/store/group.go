@@ -0,0 +1,131 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Every add applied on its own is a log entry of its own, with a round
+// trip to the followers and an fsync of the log. With a group window, the
+// leader gathers the adds arriving within the window after the first one
+// and commits them in one opGroupAdd entry, the FSM applies them in order
+// like separate entries and every writer gets the result of its own add.
+// A group is committed before the window ends once it is full. Until every
+// voter applies opGroupAdd, see MaxOp, the adds are committed one by one.
+
+const (
+	// maxGroupAdds is the count of adds committing a group at once
+	maxGroupAdds = 1024
+	// maxGroupBytes is the size of the keys and the values committing a
+	// group at once
+	maxGroupBytes = 4 << 20
+)
+
+// addGroup is the adds gathered for a group commit.
+type addGroup struct {
+	adds  []groupedAdd
+	bytes int
+	timer *time.Timer // Commits the group at the end of the window.
+}
+
+// groupedAdd is an add waiting for the commit of its group.
+type groupedAdd struct {
+	c   *command
+	res chan groupResult
+}
+
+type groupResult struct {
+	AddResult
+	err error
+}
+
+// addGrouped adds the command c to the current group, or starts a group,
+// and waits for the group to be committed.
+func (s *Store) addGrouped(c *command) (AddResult, error) {
+	res := make(chan groupResult, 1)
+
+	s.groupMu.Lock()
+	g := s.group
+	if g == nil {
+		g = &addGroup{}
+		g.timer = time.AfterFunc(s.GroupWindow, func() { s.flushGroup(g) })
+		s.group = g
+	}
+	g.adds = append(g.adds, groupedAdd{c: c, res: res})
+	g.bytes += len(c.Key) + len(c.Value)
+	full := len(g.adds) >= maxGroupAdds || g.bytes >= maxGroupBytes
+	if full {
+		g.timer.Stop()
+		s.group = nil
+	}
+	s.groupMu.Unlock()
+
+	if full {
+		s.commitGroup(g)
+	}
+	r := <-res
+	return r.AddResult, r.err
+}
+
+// flushGroup commits the group g at the end of its window, unless it has
+// been committed once full.
+func (s *Store) flushGroup(g *addGroup) {
+	s.groupMu.Lock()
+	if s.group != g {
+		s.groupMu.Unlock()
+		return
+	}
+	s.group = nil
+	s.groupMu.Unlock()
+
+	s.commitGroup(g)
+}
+
+// commitGroup applies the adds of the group g in one log entry and sends
+// every add its own result and error. A single add, or a group some voter
+// can not apply, is applied as plain adds.
+func (s *Store) commitGroup(g *addGroup) {
+	if len(g.adds) == 1 || !s.supportsOp(opGroupAdd) {
+		for _, add := range g.adds {
+			res, err := addResult(s.apply(add.c.encode()))
+			add.res <- groupResult{AddResult: res, err: err}
+		}
+		return
+	}
+
+	c := &command{Op: opGroupAdd, Adds: make([]*command, len(g.adds))}
+	for i, add := range g.adds {
+		c.Adds[i] = add.c
+	}
+	results, err := groupResults(s.apply(c.encode()), len(g.adds))
+	for i, add := range g.adds {
+		res := groupResult{AddResult: results[i], err: err}
+		if res.err == nil {
+			res.err, res.AddResult.err = results[i].err, nil
+		}
+		add.res <- res
+	}
+}
+
+// groupResults returns the results of the n adds of the group applied by f.
+func groupResults(f raft.ApplyFuture, n int) ([]AddResult, error) {
+	if err := f.Error(); notLeader(err) {
+		return notLeaderResults(n), nil
+	} else if err != nil {
+		return make([]AddResult, n), err
+	}
+
+	switch res := f.Response().(type) {
+	case []AddResult:
+		for i := range res {
+			res[i].Index = f.Index()
+		}
+		return res, nil
+	case error:
+		return make([]AddResult, n), res
+	default:
+		return make([]AddResult, n), fmt.Errorf("unexpected group add response: %v", res)
+	}
+}
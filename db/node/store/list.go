@@ -0,0 +1,64 @@
+package store
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ListOptions selects the keys of a listing.
+type ListOptions struct {
+	// Prefix limits the keys to the ones starting with it.
+	Prefix string
+	// After and End limit the keys to the range (After, End), an empty
+	// bound leaves the range open on its side.
+	After string
+	End   string
+	// Limit is the count of keys at most.
+	Limit int
+}
+
+// List returns the keys selected by opts in byte order, and whether there
+// are more keys after them, the following page starts after the last key.
+// The keys expired are left out.
+func (s *Store) List(opts ListOptions) ([]string, bool, error) {
+	return s.kv.list(opts)
+}
+
+func (kv *kvStore) list(opts ListOptions) (keys []string, more bool, err error) {
+	prefix, after, end := []byte(opts.Prefix), []byte(opts.After), []byte(opts.End)
+	now := time.Now().UnixNano()
+	err = kv.conn.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(dbData).Cursor()
+
+		var k, v []byte
+		if bytes.Compare(after, prefix) >= 0 && len(after) > 0 {
+			if k, v = c.Seek(after); bytes.Equal(k, after) {
+				k, v = c.Next()
+			}
+		} else {
+			k, v = c.Seek(prefix)
+		}
+
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if len(end) > 0 && bytes.Compare(k, end) >= 0 {
+				return nil
+			}
+			e, err := decodeEntry(v)
+			if err != nil {
+				return err
+			}
+			if e.expiredAt(now) {
+				continue
+			}
+			if len(keys) == opts.Limit {
+				more = true
+				return nil
+			}
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys, more, err
+}
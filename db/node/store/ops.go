@@ -0,0 +1,44 @@
+package store
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Every node advertises MaxOp, the highest op it applies, in the max_op of
+// its stats and of its join. The leader only proposes the ops every voter
+// applies, so a cluster keeps running while its nodes are upgraded one by
+// one: a newer op is rejected with ErrUnsupportedOp until every voter runs
+// a binary applying it.
+
+// MaxOp is the highest op of the commands this node applies.
+const MaxOp = opGroupAdd
+
+// BaseOp is the highest op applied by the nodes advertising no max_op.
+const BaseOp = opDelete
+
+// ErrUnsupportedOp for a write needing an op some voter does not apply yet
+var ErrUnsupportedOp = errors.New("op not supported by every voter")
+
+// SetClusterOp sets the highest op every voter of the cluster applies, the
+// lowest of their max_op. It is set by the leader.
+func (s *Store) SetClusterOp(op byte) {
+	if op > MaxOp {
+		op = MaxOp
+	}
+	atomic.StoreUint32(&s.clusterOp, uint32(op))
+}
+
+// ClusterOp returns the highest op the store proposes, BaseOp until the
+// cluster op is set.
+func (s *Store) ClusterOp() byte {
+	if op := atomic.LoadUint32(&s.clusterOp); op != 0 {
+		return byte(op)
+	}
+	return BaseOp
+}
+
+// supportsOp reports whether every voter applies the op.
+func (s *Store) supportsOp(op byte) bool {
+	return op <= s.ClusterOp()
+}
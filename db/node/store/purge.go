@@ -0,0 +1,110 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/raft"
+)
+
+// The audit bucket keeps a record of every purge keyed by its raft index,
+// the purged value is not in it. Unlike the changes and the expiry buckets
+// it can not be rebuilt from the entries, so the snapshots carry it.
+
+// Purge is the audit record of a purge.
+type Purge struct {
+	Key       string    `json:"key"`
+	Operator  string    `json:"operator"`
+	Reason    string    `json:"reason"`
+	Timestamp time.Time `json:"timestamp"`
+	Index     uint64    `json:"index"`
+	// Found reports whether the key existed when it was purged
+	Found bool `json:"found"`
+}
+
+// Purge deletes the key through the raft log, whether or not it expires,
+// and records who purged it and why. The key can be added again after.
+func (s *Store) Purge(key, operator, reason string) (*Purge, error) {
+	if !s.isLeader() {
+		return nil, ErrNotLeader
+	}
+
+	c := &command{
+		Op:        opPurge,
+		Key:       key,
+		Writer:    operator,
+		Reason:    reason,
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	f := s.apply(c.encode())
+	if err := f.Error(); notLeader(err) {
+		return nil, ErrNotLeader
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch res := f.Response().(type) {
+	case *Purge:
+		return res, nil
+	case error:
+		return nil, res
+	default:
+		return nil, fmt.Errorf("unexpected purge response: %v", res)
+	}
+}
+
+// Purges returns the audit records of the purges in the order of the log.
+func (s *Store) Purges() ([]Purge, error) {
+	purges := []Purge{}
+	err := s.kv.conn.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbAudit).ForEach(func(_, v []byte) error {
+			var p Purge
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			purges = append(purges, p)
+			return nil
+		})
+	})
+	return purges, err
+}
+
+// applyPurge deletes the key and records the purge in the audit bucket.
+func (f *fsm) applyPurge(data *bolt.Bucket, l *raft.Log, c *command) interface{} {
+	p := &Purge{
+		Key:       c.Key,
+		Operator:  c.Writer,
+		Reason:    c.Reason,
+		Timestamp: time.Unix(0, c.Timestamp).UTC(),
+		Index:     l.Index,
+		Found:     data.Get([]byte(c.Key)) != nil,
+	}
+	if res := f.applyDelete(data, c.Key); res != nil {
+		return res
+	}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := data.Tx().Bucket(dbAudit).Put(uint64ToBytes(l.Index), b); err != nil {
+		return err
+	}
+	return p
+}
+
+// putAudits writes the audit records read from a snapshot.
+func (kv *kvStore) putAudits(audits [][2][]byte) error {
+	return kv.conn.Update(func(tx *bolt.Tx) error {
+		audit := tx.Bucket(dbAudit)
+		for _, record := range audits {
+			if err := audit.Put(record[0], record[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
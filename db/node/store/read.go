@@ -0,0 +1,134 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Consistency is the consistency level of a read.
+type Consistency string
+
+const (
+	// ConsistencyLinearizable reads on the leader after it confirms its
+	// leadership with a quorum and applies every entry committed before
+	// the read, so a read never misses a completed write.
+	ConsistencyLinearizable Consistency = "linearizable"
+
+	// ConsistencyLeader reads on the node believing it is the leader. A
+	// deposed leader may serve stale data until it steps down, which is
+	// bounded by the raft leader lease.
+	ConsistencyLeader Consistency = "leader"
+
+	// ConsistencyStale reads on any node, followers may lag behind.
+	ConsistencyStale Consistency = "stale"
+)
+
+var (
+	// ErrNotLeader for a request only the leader can handle
+	ErrNotLeader = errors.New("not leader")
+
+	// ErrApplyTimeout for an index not applied in time
+	ErrApplyTimeout = errors.New("timeout waiting for the index to be applied")
+)
+
+// ParseConsistency parses the name of a level, the empty name is
+// ConsistencyLinearizable.
+func ParseConsistency(name string) (Consistency, error) {
+	switch c := Consistency(name); c {
+	case "":
+		return ConsistencyLinearizable, nil
+	case ConsistencyLinearizable, ConsistencyLeader, ConsistencyStale:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown consistency level: %s", name)
+	}
+}
+
+// VerifyRead returns nil if the store can serve a read of the level c, or
+// ErrNotLeader if the level needs the leader and this node is not.
+func (s *Store) VerifyRead(c Consistency) error {
+	switch c {
+	case ConsistencyStale:
+		return nil
+
+	case ConsistencyLeader:
+		if !s.isLeader() {
+			return ErrNotLeader
+		}
+		return nil
+
+	default:
+		// The read index is taken before confirming the leadership, every
+		// write completed before the read is at or below it. A new leader
+		// dispatches a no-op entry first, so the index also covers the
+		// entries committed by the previous leaders.
+		ra := s.node()
+		if ra == nil || ra.State() != raft.Leader {
+			return ErrNotLeader
+		}
+		readIndex := ra.LastIndex()
+
+		if err := ra.VerifyLeader().Error(); notLeader(err) {
+			return ErrNotLeader
+		} else if err != nil {
+			return err
+		}
+		return s.WaitApplied(readIndex, raftTimeout)
+	}
+}
+
+// appliedIndex returns the last raft index applied to the key-value store.
+func (s *Store) appliedIndex() uint64 {
+	return atomic.LoadUint64(&s.applied)
+}
+
+// AppliedIndex returns the last raft index applied to the key-value store,
+// the one of the changes a replica applied.
+func (s *Store) AppliedIndex() uint64 {
+	return s.appliedIndex()
+}
+
+// setApplied records index as the last applied one and wakes up the
+// goroutines waiting for it, it is only called by the FSM, or on a replica
+// by ApplyReplicated.
+func (s *Store) setApplied(index uint64) {
+	s.appliedMu.Lock()
+	defer s.appliedMu.Unlock()
+
+	atomic.StoreUint64(&s.applied, index)
+	if s.appliedCh != nil {
+		close(s.appliedCh)
+		s.appliedCh = nil
+	}
+}
+
+// WaitApplied waits until the raft index is applied to the store, or
+// returns ErrApplyTimeout. Reads after it see every write at or below the
+// index.
+func (s *Store) WaitApplied(index uint64, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.appliedMu.Lock()
+		if atomic.LoadUint64(&s.applied) >= index {
+			s.appliedMu.Unlock()
+			return nil
+		}
+		if s.appliedCh == nil {
+			s.appliedCh = make(chan struct{})
+		}
+		ch := s.appliedCh
+		s.appliedMu.Unlock()
+
+		select {
+		case <-ch:
+		case <-timer.C:
+			return ErrApplyTimeout
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Focinfi/oncekv/log"
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/raft"
+)
+
+// The vendored raft has no non-voting members, every peer counts for the
+// elections and the commit quorum. A replica runs no raft at all: it keeps
+// the key-value store of a voter, fed with the changes of the voter as
+// stored, the entries of the adds with their raft index and checksum, so
+// it serves the same reads. The replica records the applied index of the
+// voter, which it reads the following changes from. A replica is promoted
+// by opening its raft log and joining the cluster, raft then catches it up
+// from the log of the leader, skipping the entries it applied. A voter is
+// demoted once the leader removes it from the cluster. A voter has no
+// changes before the last snapshot it restored or the last trim, so a
+// replica behind the floor of the changes resyncs from a whole snapshot of
+// the voter.
+
+// Roles of a node.
+const (
+	RoleVoter   = "voter"
+	RoleReplica = "replica"
+)
+
+// roleFile keeps the role of the node in the raft dir, so a replica
+// restarts as a replica.
+const roleFile = "role"
+
+// ErrRole for promoting a voter or demoting a replica
+var ErrRole = errors.New("store already has the role")
+
+// ErrResync for reading the changes from below their floor, the replica has
+// to resync from a snapshot
+var ErrResync = errors.New("changes before the snapshot, resync required")
+
+// SavedRole returns the role the store in the raft dir had when it was
+// last open, RoleVoter for a new store.
+func SavedRole(dir string) string {
+	b, err := ioutil.ReadFile(filepath.Join(dir, roleFile))
+	if err != nil || strings.TrimSpace(string(b)) != RoleReplica {
+		return RoleVoter
+	}
+	return RoleReplica
+}
+
+func saveRole(dir, role string) error {
+	if role == RoleVoter {
+		if err := os.Remove(filepath.Join(dir, roleFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(dir, roleFile), []byte(role+"\n"), 0644)
+}
+
+// node returns the raft of the store, nil on a replica.
+func (s *Store) node() *raft.Raft {
+	s.roleMu.RLock()
+	defer s.roleMu.RUnlock()
+	return s.raft
+}
+
+// isLeader reports whether the store is the raft leader.
+func (s *Store) isLeader() bool {
+	ra := s.node()
+	return ra != nil && ra.State() == raft.Leader
+}
+
+// Role returns the role of the store, RoleVoter or RoleReplica.
+func (s *Store) Role() string {
+	if s.node() == nil {
+		return RoleReplica
+	}
+	return RoleVoter
+}
+
+// OpenReplica opens the store as a replica, which applies the changes given
+// to ApplyReplicated instead of a raft log.
+func (s *Store) OpenReplica() error {
+	if err := s.openKV(); err != nil {
+		return err
+	}
+	if err := saveRole(s.RaftDir, RoleReplica); err != nil {
+		return err
+	}
+	s.start()
+	return nil
+}
+
+// Promote turns the replica into a voter by opening its raft log, the node
+// then has to be joined to the cluster by the leader.
+func (s *Store) Promote() error {
+	if s.node() != nil {
+		return ErrRole
+	}
+	if err := s.openRaft(false); err != nil {
+		return err
+	}
+	return saveRole(s.RaftDir, RoleVoter)
+}
+
+// Demote turns the voter into a replica, it waits for the writes in flight
+// and shuts raft down. The leader must have removed the node from the
+// cluster before, or it keeps counting for the quorum.
+func (s *Store) Demote() error {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+
+	if s.node() == nil {
+		return ErrRole
+	}
+	if err := s.closeRaft(); err != nil {
+		return err
+	}
+	return saveRole(s.RaftDir, RoleReplica)
+}
+
+// ReplicatedChange is a change shipped to a replica, with the entry of an
+// add as stored.
+type ReplicatedChange struct {
+	Index uint64
+	Op    string
+	Key   string
+	// Entry is empty for a delete.
+	Entry []byte
+}
+
+// ReplicatedChanges returns the changes from the raft index from like
+// Changes, with the entries of the adds for a replica to store, or
+// ErrResync if the changes from there miss deletes.
+func (s *Store) ReplicatedChanges(from uint64, limit int) ([]ReplicatedChange, uint64, error) {
+	if from == 0 {
+		return nil, 0, ErrResync
+	}
+
+	changes, next, err := s.kv.changes(from, limit)
+	if err == ErrChangesCompacted {
+		return nil, 0, ErrResync
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	replicated := make([]ReplicatedChange, len(changes))
+	for i, c := range changes {
+		replicated[i] = ReplicatedChange{Index: c.Index, Op: c.Op, Key: c.Key}
+		if c.entry != nil {
+			replicated[i].Entry = c.entry.encode()
+		}
+	}
+	return replicated, next, nil
+}
+
+// ApplyReplicated applies the changes of the voter, whose leader is the raft
+// address leader, and records next-1 as the applied index, next being the
+// index to read the following changes from. Only a replica applies them.
+func (s *Store) ApplyReplicated(changes []ReplicatedChange, next uint64, leader string) error {
+	if s.node() != nil {
+		return ErrRole
+	}
+	s.roleMu.Lock()
+	s.leader = leader
+	s.roleMu.Unlock()
+
+	applied := s.appliedIndex()
+	if next <= applied+1 {
+		return nil
+	}
+
+	f := (*fsm)(s)
+	err := s.kv.update(next-1, func(data *bolt.Bucket) error {
+		changesBucket := data.Tx().Bucket(dbChanges)
+		for _, c := range changes {
+			if c.Index <= applied {
+				continue
+			}
+
+			switch c.Op {
+			case ChangeAdd:
+				e, err := decodeEntry(c.Entry)
+				if err == nil {
+					err = e.verify()
+				}
+				if err != nil {
+					return err
+				}
+				if err := putEntry(data, c.Key, e); err != nil {
+					return err
+				}
+				f.added = append(f.added, c.Key)
+				if err := putChanges(changesBucket, c.Index, []string{c.Key}, opAdd); err != nil {
+					return err
+				}
+			case ChangeDelete:
+				if res := f.applyDelete(data, c.Key); res != nil {
+					return res.(error)
+				}
+				if err := putChanges(changesBucket, c.Index, []string{c.Key}, opDelete); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		f.added, f.deleted = f.added[:0], f.deleted[:0]
+		log.DB.Errorln(logPrefix, "failed to apply the replicated changes:", err)
+		return err
+	}
+
+	s.setApplied(next - 1)
+	if len(f.added) > 0 {
+		f.watches.notify(f.added...)
+		f.added = f.added[:0]
+	}
+	f.deleted = f.deleted[:0]
+	return nil
+}
+
+// WriteSnapshot writes a snapshot of the store into w, for a replica to
+// resync from.
+func (s *Store) WriteSnapshot(w io.Writer) error {
+	snap, err := (*fsm)(s).Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	return persist(snap.(*fsmSnapshot).tx, w)
+}
+
+// ResyncReplica replaces the store of the replica with the snapshot of the
+// voter read from r, whose leader is the raft address leader.
+func (s *Store) ResyncReplica(r io.Reader, leader string) error {
+	if s.node() != nil {
+		return ErrRole
+	}
+	s.roleMu.Lock()
+	s.leader = leader
+	s.roleMu.Unlock()
+
+	return (*fsm)(s).Restore(ioutil.NopCloser(r))
+}
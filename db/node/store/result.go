@@ -0,0 +1,48 @@
+package store
+
+// Result is the outcome of adding a key.
+type Result int
+
+const (
+	// Created for a key added by the command, or by an earlier command of
+	// the same request ID and value, which makes retries idempotent
+	Created Result = iota + 1
+	// Exists for a key which has been added with the same value
+	Exists
+	// Conflict for a key which has been added with a different value
+	Conflict
+	// NotLeader for a command rejected because this node is not the leader
+	NotLeader
+	// Aborted for a key not added because its atomic batch failed
+	Aborted
+)
+
+var resultNames = map[Result]string{
+	Created:   "created",
+	Exists:    "exists",
+	Conflict:  "conflict",
+	NotLeader: "not leader",
+	Aborted:   "aborted",
+}
+
+func (r Result) String() string {
+	if name, ok := resultNames[r]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// AddResult is the outcome of adding a key, with the request ID of the
+// write which added the key.
+type AddResult struct {
+	Result
+	RequestID string
+
+	// Index is the raft index of the command, set by the Store once it is
+	// applied. A read waiting for the index sees the outcome, which makes
+	// it a token for reading your writes.
+	Index uint64
+
+	// err is the error of an add of a group, which fails alone.
+	err error
+}
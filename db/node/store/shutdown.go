@@ -0,0 +1,121 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/Focinfi/oncekv/log"
+	"github.com/hashicorp/raft"
+)
+
+// The vendored raft has no leadership transfer, a leader shutting down
+// leaves the cluster to elect another one. Drain lets the caller wait for
+// a follower to apply the whole log before, the election restriction of
+// raft then elects an up-to-date follower, and the writes only fail for
+// the election timeout.
+
+// ErrShutdown for a write to a store shutting down, it is answered like a
+// write to a follower, so the writer goes to another node.
+var ErrShutdown = errors.New("store is shutting down")
+
+// notLeader reports whether err means the write has to go to the leader.
+func notLeader(err error) bool {
+	return err == raft.ErrNotLeader || err == raft.ErrLeadershipLost ||
+		err == raft.ErrRaftShutdown || err == ErrShutdown
+}
+
+// errorFuture is the future of a write refused before reaching raft, by a
+// store shutting down or a replica.
+type errorFuture struct{ err error }
+
+func (f errorFuture) Error() error        { return f.err }
+func (errorFuture) Response() interface{} { return nil }
+func (errorFuture) Index() uint64         { return 0 }
+
+// apply applies the encoded command through raft and waits for it, unless
+// the store is shutting down.
+func (s *Store) apply(b []byte) raft.ApplyFuture {
+	s.applyMu.RLock()
+	defer s.applyMu.RUnlock()
+	if s.closing {
+		return errorFuture{ErrShutdown}
+	}
+	if !s.supportsOp(b[1]) {
+		return errorFuture{ErrUnsupportedOp}
+	}
+	ra := s.node()
+	if ra == nil {
+		return errorFuture{raft.ErrNotLeader}
+	}
+
+	f := ra.Apply(b, raftTimeout)
+	f.Error()
+	return f
+}
+
+// Drain stops the store taking writes, and waits for the writes in flight.
+// On the leader it waits for the log to be applied, and returns the index
+// of its last entry, for the followers to catch up with.
+func (s *Store) Drain() (uint64, error) {
+	s.applyMu.Lock()
+	s.closing = true
+	s.applyMu.Unlock()
+
+	ra := s.node()
+	if ra == nil || ra.State() != raft.Leader {
+		return 0, nil
+	}
+	f := ra.Barrier(raftTimeout)
+	if err := f.Error(); err != nil {
+		return 0, err
+	}
+	return ra.LastIndex(), nil
+}
+
+// Shutdown shuts the store down gracefully: it drains the writes, takes a
+// snapshot so the restart replays no log, shuts raft down and closes the
+// raft log and the key-value store. A replica only closes the key-value
+// store. It only shuts down once, the later calls return the error of the
+// first one.
+func (s *Store) Shutdown() error {
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = s.shutdown()
+	})
+	return s.shutdownErr
+}
+
+func (s *Store) shutdown() error {
+	if _, err := s.Drain(); err != nil {
+		log.DB.Errorln(logPrefix, "failed to drain:", err)
+	}
+	// A store never opened has nothing to close.
+	if s.done != nil {
+		close(s.done)
+	}
+
+	if ra := s.node(); ra != nil {
+		if err := ra.Snapshot().Error(); err != nil && err != raft.ErrNothingNewToSnapshot {
+			log.DB.Errorln(logPrefix, "failed to snapshot:", err)
+		}
+		if err := s.closeRaft(); err != nil {
+			return err
+		}
+	}
+	if s.kv == nil {
+		return nil
+	}
+	return s.kv.Close()
+}
+
+// closeRaft shuts raft down and closes the raft log, the store is a
+// replica after.
+func (s *Store) closeRaft() error {
+	s.roleMu.Lock()
+	ra, logStore := s.raft, s.logStore
+	s.raft, s.peerStore, s.logStore = nil, nil, nil
+	s.roleMu.Unlock()
+
+	if err := ra.Shutdown().Error(); err != nil {
+		return err
+	}
+	return logStore.Close()
+}
@@ -0,0 +1,299 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/raft"
+)
+
+// A snapshot is a header followed by frames:
+//
+//	header: magic(4) | version(1) | raft index(8) | crc32(4)
+//	frame:  type(1) | payload length(uvarint) | payload | crc32(4)
+//
+// A pair frame carries uvarint(len(key)) | key | entry, an audit frame
+// carries the raft index of a purge as 8 bytes and its audit record, the
+// end frame carries the count of pair frames as 8 bytes. The crc32 of a frame covers
+// its type and payload. Integers are big endian. Version 1 carried the
+// value instead of the encoded entry.
+const (
+	snapshotVersion = 2
+
+	framePair  = 1
+	frameEnd   = 2
+	frameAudit = 3
+
+	// maxFrameSize limits the payload a reader accepts, protecting it from
+	// allocating on a corrupted length.
+	maxFrameSize = 1 << 30
+)
+
+var (
+	snapshotMagic = []byte("OKVS")
+	crcTable      = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrSnapshotCorrupted for a snapshot failing its checksums
+	ErrSnapshotCorrupted = errors.New("snapshot corrupted")
+	// ErrSnapshotTruncated for a snapshot ending before its end frame
+	ErrSnapshotTruncated = errors.New("snapshot truncated")
+)
+
+// isLegacySnapshot reports whether r holds a snapshot of the old JSON
+// format, without consuming the header of a binary one.
+func isLegacySnapshot(r *bufio.Reader) (bool, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return false, err
+		}
+
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+		case '{':
+			return true, nil
+		default:
+			return false, nil
+		}
+	}
+}
+
+type snapshotWriter struct {
+	w     *bufio.Writer
+	count uint64
+	buf   []byte
+}
+
+func newSnapshotWriter(w io.Writer, index uint64) (*snapshotWriter, error) {
+	sw := &snapshotWriter{w: bufio.NewWriter(w)}
+
+	header := make([]byte, 0, 17)
+	header = append(header, snapshotMagic...)
+	header = append(header, snapshotVersion)
+	header = append(header, uint64ToBytes(index)...)
+	header = append(header, uint32ToBytes(crc32.Checksum(header, crcTable))...)
+	if _, err := sw.w.Write(header); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *snapshotWriter) writePair(key, value []byte) error {
+	sw.buf = sw.buf[:0]
+	sw.buf = appendUvarint(sw.buf, uint64(len(key)))
+	sw.buf = append(sw.buf, key...)
+	sw.buf = append(sw.buf, value...)
+	sw.count++
+	return sw.writeFrame(framePair, sw.buf)
+}
+
+func (sw *snapshotWriter) writeAudit(index, record []byte) error {
+	sw.buf = append(append(sw.buf[:0], index...), record...)
+	return sw.writeFrame(frameAudit, sw.buf)
+}
+
+// close writes the end frame and flushes the buffered data.
+func (sw *snapshotWriter) close() error {
+	if err := sw.writeFrame(frameEnd, uint64ToBytes(sw.count)); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+func (sw *snapshotWriter) writeFrame(typ byte, payload []byte) error {
+	var head [1 + binary.MaxVarintLen64]byte
+	head[0] = typ
+	n := binary.PutUvarint(head[1:], uint64(len(payload)))
+	if _, err := sw.w.Write(head[:1+n]); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(payload); err != nil {
+		return err
+	}
+
+	crc := crc32.Update(crc32.Checksum(head[:1], crcTable), crcTable, payload)
+	_, err := sw.w.Write(uint32ToBytes(crc))
+	return err
+}
+
+type snapshotReader struct {
+	r       *bufio.Reader
+	version byte
+	index   uint64
+	count   uint64
+	done    bool
+
+	// audits are the audit frames read, keyed by the raft index as 8 bytes
+	audits [][2][]byte
+}
+
+func newSnapshotReader(r *bufio.Reader) (*snapshotReader, error) {
+	header := make([]byte, 17)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("read snapshot header: %s", err)
+	}
+	if !bytes.Equal(header[:4], snapshotMagic) {
+		return nil, fmt.Errorf("unknown snapshot format")
+	}
+	if crc32.Checksum(header[:13], crcTable) != bytesToUint32(header[13:]) {
+		return nil, ErrSnapshotCorrupted
+	}
+	if version := header[4]; version > snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version: %d", version)
+	}
+
+	return &snapshotReader{r: r, version: header[4], index: bytesToUint64(header[5:13])}, nil
+}
+
+// next returns the next pair, or io.EOF after the end frame. The audit
+// frames are kept in audits.
+func (sr *snapshotReader) next() (key, value []byte, err error) {
+	if sr.done {
+		return nil, nil, io.EOF
+	}
+
+	typ, payload, err := sr.readFrame()
+	if err != nil {
+		return nil, nil, err
+	}
+	for typ == frameAudit {
+		if len(payload) < 8 {
+			return nil, nil, ErrSnapshotCorrupted
+		}
+		sr.audits = append(sr.audits, [2][]byte{payload[:8], payload[8:]})
+		if typ, payload, err = sr.readFrame(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	switch typ {
+	case framePair:
+		keyLen, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < keyLen {
+			return nil, nil, ErrSnapshotCorrupted
+		}
+		sr.count++
+		return payload[n : n+int(keyLen)], payload[n+int(keyLen):], nil
+
+	case frameEnd:
+		if len(payload) != 8 || bytesToUint64(payload) != sr.count {
+			return nil, nil, ErrSnapshotCorrupted
+		}
+		sr.done = true
+		return nil, nil, io.EOF
+
+	default:
+		return nil, nil, fmt.Errorf("unknown snapshot frame type: %d", typ)
+	}
+}
+
+func (sr *snapshotReader) readFrame() (byte, []byte, error) {
+	typ, err := sr.r.ReadByte()
+	if err == io.EOF {
+		return 0, nil, ErrSnapshotTruncated
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	size, err := binary.ReadUvarint(sr.r)
+	if err != nil {
+		return 0, nil, ErrSnapshotTruncated
+	}
+	if size > maxFrameSize {
+		return 0, nil, ErrSnapshotCorrupted
+	}
+
+	payload := make([]byte, size+4)
+	if _, err := io.ReadFull(sr.r, payload); err != nil {
+		return 0, nil, ErrSnapshotTruncated
+	}
+
+	crc := crc32.Update(crc32.Checksum([]byte{typ}, crcTable), crcTable, payload[:size])
+	if crc != bytesToUint32(payload[size:]) {
+		return 0, nil, ErrSnapshotCorrupted
+	}
+	return typ, payload[:size], nil
+}
+
+// fsmSnapshot streams the read transaction opened by Snapshot, so taking a
+// snapshot costs Apply nothing and needs no disk space. The pages of the
+// transaction are kept from reuse until it is released, and a write
+// remapping the db file waits for it, see initialMmapSize.
+type fsmSnapshot struct {
+	tx *bolt.Tx
+	kv *kvStore
+}
+
+// Persist streams the pairs into the sink, then trims the changes older
+// than retainChanges entries before the snapshot.
+func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	err := persist(f.tx, sink)
+	if err == nil {
+		// Close the sink.
+		err = sink.Close()
+	}
+
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if index := txAppliedIndex(f.tx); index > retainChanges {
+		return f.kv.trimChanges(index - retainChanges)
+	}
+	return nil
+}
+
+// persist writes the pairs and the audit records of tx into w.
+func persist(tx *bolt.Tx, w io.Writer) error {
+	sw, err := newSnapshotWriter(w, txAppliedIndex(tx))
+	if err != nil {
+		return err
+	}
+
+	// Write data to sink.
+	if err := tx.Bucket(dbData).ForEach(sw.writePair); err != nil {
+		return err
+	}
+	if err := tx.Bucket(dbAudit).ForEach(sw.writeAudit); err != nil {
+		return err
+	}
+	return sw.close()
+}
+
+// txAppliedIndex returns the last raft index applied as of tx.
+func txAppliedIndex(tx *bolt.Tx) uint64 {
+	if v := tx.Bucket(dbFSM).Get(keyAppliedIndex); v != nil {
+		return bytesToUint64(v)
+	}
+	return 0
+}
+
+// Release ends the read transaction.
+func (f *fsmSnapshot) Release() {
+	f.tx.Rollback()
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func bytesToUint32(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b)
+}
+
+func uint32ToBytes(u uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, u)
+	return buf
+}
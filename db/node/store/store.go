@@ -7,18 +7,19 @@
 package store
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Focinfi/oncekv/log"
 	"github.com/Focinfi/oncekv/raftboltdb"
+	"github.com/boltdb/bolt"
 	"github.com/hashicorp/raft"
 )
 
@@ -28,34 +29,101 @@ const (
 	logPrefix           = "oncekv/store"
 )
 
-type command struct {
-	Op    string `json:"op,omitempty"`
-	Key   string `json:"key,omitempty"`
-	Value string `json:"value,omitempty"`
-}
-
 // Store is a simple key-value store, where all changes are made via Raft consensus.
 type Store struct {
+	// The last raft index applied to kv, first for the 64-bit alignment
+	// of atomic operations.
+	applied uint64
+	// The count of the reads finding a corrupted entry.
+	checksumErrors uint64
+	// The highest op every voter applies, 0 until it is set.
+	clusterOp uint32
+
+	appliedMu sync.Mutex
+	appliedCh chan struct{} // Closed when applied changes.
+
 	RaftDir  string
 	RaftBind string
+	// GroupWindow is how long the leader gathers the concurrent adds to
+	// commit them in one log entry, 0 commits every add on its own.
+	GroupWindow time.Duration
+
+	kv *kvStore // The key-value store for the system.
 
-	mu sync.Mutex
-	m  map[string]string // The key-value store for the system.
+	watches keyWatches // The readers waiting for keys.
+	added   []string   // The keys added by the entry being applied.
+	deleted []string   // The keys deleted by the entry being applied.
 
-	raft      *raft.Raft // The consensus mechanism
+	roleMu    sync.RWMutex // Guards the raft fields, nil on a replica.
+	raft      *raft.Raft   // The consensus mechanism
 	peerStore *raft.JSONPeers
+	logStore  *raftboltdb.BoltStore
+	leader    string // The raft address of the leader a replica follows.
+
+	groupMu sync.Mutex
+	group   *addGroup // The adds gathered for the next group commit.
+
+	applyMu sync.RWMutex  // Held for reading by the applies in flight.
+	closing bool          // Set once the store stops taking writes.
+	done    chan struct{} // Closed when the store shuts down.
+
+	shutdownOnce sync.Once
+	shutdownErr  error // The error of the first Shutdown.
 }
 
 // New returns a new Store.
 func New() *Store {
-	return &Store{
-		m: make(map[string]string),
-	}
+	return &Store{}
 }
 
 // Open opens the store. If enableSingle is set, and there are no existing peers,
 // then this node becomes the first node, and therefore leader, of the cluster.
 func (s *Store) Open(enableSingle bool) error {
+	if err := s.openKV(); err != nil {
+		return err
+	}
+	if err := s.openRaft(enableSingle); err != nil {
+		return err
+	}
+	if err := saveRole(s.RaftDir, RoleVoter); err != nil {
+		return err
+	}
+	s.start()
+	return nil
+}
+
+// openKV opens the key-value store the FSM applies entries to, unless a
+// replica promoted has it open.
+func (s *Store) openKV() error {
+	if s.kv != nil {
+		return nil
+	}
+
+	kv, err := openKVStore(filepath.Join(s.RaftDir, "fsm.db"))
+	if err != nil {
+		return fmt.Errorf("new kv store: %s", err)
+	}
+	applied, err := kv.appliedIndex()
+	if err != nil {
+		kv.Close()
+		return fmt.Errorf("kv store applied index: %s", err)
+	}
+	s.kv = kv
+	s.setApplied(applied)
+	return nil
+}
+
+// start starts the expirer once the store is open.
+func (s *Store) start() {
+	if s.done != nil {
+		return
+	}
+	s.done = make(chan struct{})
+	go s.runExpirer()
+}
+
+// openRaft opens the raft log and joins the consensus.
+func (s *Store) openRaft(enableSingle bool) error {
 	// Setup Raft configuration.
 	config := raft.DefaultConfig()
 
@@ -84,6 +152,8 @@ func (s *Store) Open(enableSingle bool) error {
 		log.DB.Infoln(logPrefix, "enabling single-node mode")
 		config.EnableSingleNode = true
 		config.DisableBootstrapAfterElect = false
+		// The node alone in its cluster applies every op.
+		s.SetClusterOp(MaxOp)
 	}
 
 	// Create the snapshot store. This allows the Raft to truncate the log.
@@ -103,74 +173,215 @@ func (s *Store) Open(enableSingle bool) error {
 	if err != nil {
 		return fmt.Errorf("new raft: %s", err)
 	}
+	s.roleMu.Lock()
 	s.raft = ra
 	s.peerStore = peerStore
+	s.logStore = logStore
+	s.roleMu.Unlock()
 	return nil
 }
 
-// Get returns the value for the given key.
-func (s *Store) Get(key string) (string, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.m[key], nil
+// WriteOptions describes a write.
+type WriteOptions struct {
+	// RequestID identifies the write, a retry of the write with the same
+	// RequestID and value gets Created again.
+	RequestID string
+	// Writer is an optional label of the writer, kept in the Meta.
+	Writer string
+	// ContentType is the optional media type of the values, kept in the Meta.
+	ContentType string
+	// TTL is the optional time to live of the keys added, an expired key
+	// can be added again.
+	TTL time.Duration
 }
 
-// Set sets the value for the given key.
-func (s *Store) Set(key, value string) error {
-	if s.raft.State() != raft.Leader {
-		return fmt.Errorf("not leader")
+// expiresAt returns the expiry time of the keys added at the timestamp,
+// 0 if they never expire.
+func (opts WriteOptions) expiresAt(timestamp int64) int64 {
+	if opts.TTL <= 0 {
+		return 0
 	}
+	return timestamp + int64(opts.TTL)
+}
 
-	c := &command{
-		Op:    "set",
-		Key:   key,
-		Value: value,
+// ErrKeyNotFound for getting a key which does not exist, a key may have an
+// empty value
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrKeyTooLarge for writing a key longer than MaxKeyBytes
+var ErrKeyTooLarge = errors.New("key too large")
+
+// MaxKeyBytes is the max size of a key the store holds.
+const MaxKeyBytes = bolt.MaxKeySize
+
+// ErrPeerNotFound for removing a node which is not in the cluster
+var ErrPeerNotFound = errors.New("peer not found")
+
+// Get returns the value for the given key, or ErrKeyNotFound.
+func (s *Store) Get(key string) ([]byte, error) {
+	value, meta, err := s.GetWithMeta(key)
+	if err == nil && meta == nil {
+		return nil, ErrKeyNotFound
+	}
+	return value, err
+}
+
+// GetWithMeta returns the value and the metadata for the given key, the
+// metadata is nil if the key does not exist or has expired. An entry
+// failing its checksum gets ErrChecksumMismatch.
+func (s *Store) GetWithMeta(key string) ([]byte, *Meta, error) {
+	b, err := s.kv.get([]byte(key))
+	if err != nil || b == nil {
+		return nil, nil, err
+	}
+
+	e, err := decodeEntry(b)
+	if err == nil {
+		err = e.verify()
 	}
-	b, err := json.Marshal(c)
 	if err != nil {
-		return err
+		atomic.AddUint64(&s.checksumErrors, 1)
+		log.DB.Errorf("%s corrupted entry of %q: %v", logPrefix, key, err)
+		return nil, nil, ErrChecksumMismatch
+	}
+	if e.expiredAt(time.Now().UnixNano()) {
+		return nil, nil, nil
+	}
+	return e.Value, e.meta(), nil
+}
+
+// Set sets the value for the given key.
+func (s *Store) Set(key string, value []byte) error {
+	if len(key) > MaxKeyBytes {
+		return ErrKeyTooLarge
+	}
+	if !s.isLeader() {
+		return ErrNotLeader
+	}
+
+	c := &command{
+		Op:        opSet,
+		Key:       key,
+		Value:     value,
+		Timestamp: time.Now().UnixNano(),
 	}
 
-	f := s.raft.Apply(b, raftTimeout)
+	f := s.apply(c.encode())
 	return f.Error()
 }
 
-// Add adds the key/value, if the key has been added, do nothing.
-func (s *Store) Add(key, value string) error {
-	if s.raft.State() != raft.Leader {
-		return fmt.Errorf("not leader")
+// Add adds the key/value, if the key has been added, do nothing. It
+// returns Created, Exists or Conflict as the FSM applied the command with
+// the request ID of the write holding the key, or NotLeader. The adds are
+// committed in groups if GroupWindow is set and every voter applies them.
+func (s *Store) Add(key string, value []byte, opts WriteOptions) (AddResult, error) {
+	if len(key) > MaxKeyBytes {
+		return AddResult{}, ErrKeyTooLarge
+	}
+	if !s.isLeader() {
+		return AddResult{Result: NotLeader}, nil
 	}
 
 	c := &command{
-		Op:    "add",
-		Key:   key,
-		Value: value,
+		Op:          opAdd,
+		Key:         key,
+		Value:       value,
+		RequestID:   opts.RequestID,
+		Timestamp:   time.Now().UnixNano(),
+		Writer:      opts.Writer,
+		ContentType: opts.ContentType,
 	}
-	b, err := json.Marshal(c)
-	if err != nil {
-		return err
+	c.ExpiresAt = opts.expiresAt(c.Timestamp)
+
+	if s.GroupWindow > 0 && s.supportsOp(opGroupAdd) {
+		return s.addGrouped(c)
 	}
+	return addResult(s.apply(c.encode()))
+}
 
-	f := s.raft.Apply(b, raftTimeout)
-	return f.Error()
+// addResult returns the result of the add applied by f.
+func addResult(f raft.ApplyFuture) (AddResult, error) {
+	if err := f.Error(); notLeader(err) {
+		return AddResult{Result: NotLeader}, nil
+	} else if err != nil {
+		return AddResult{}, err
+	}
+
+	switch res := f.Response().(type) {
+	case AddResult:
+		res.Index = f.Index()
+		return res, nil
+	case error:
+		return AddResult{}, res
+	default:
+		return AddResult{}, fmt.Errorf("unexpected add response: %v", res)
+	}
+}
+
+// AddBatch adds the pairs in one raft log entry and returns the result of
+// every pair in order. If atomic is set, no pair is added when any of the
+// keys exists, the other keys get Aborted.
+func (s *Store) AddBatch(pairs []Pair, atomic bool, opts WriteOptions) ([]AddResult, error) {
+	for _, pair := range pairs {
+		if len(pair.Key) > MaxKeyBytes {
+			return nil, ErrKeyTooLarge
+		}
+	}
+	if !s.isLeader() {
+		return notLeaderResults(len(pairs)), nil
+	}
+
+	c := &command{
+		Op:          opBatchAdd,
+		Atomic:      atomic,
+		Pairs:       pairs,
+		RequestID:   opts.RequestID,
+		Timestamp:   time.Now().UnixNano(),
+		Writer:      opts.Writer,
+		ContentType: opts.ContentType,
+	}
+	c.ExpiresAt = opts.expiresAt(c.Timestamp)
+
+	f := s.apply(c.encode())
+	if err := f.Error(); notLeader(err) {
+		return notLeaderResults(len(pairs)), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch res := f.Response().(type) {
+	case []AddResult:
+		for i := range res {
+			res[i].Index = f.Index()
+		}
+		return res, nil
+	case error:
+		return nil, res
+	default:
+		return nil, fmt.Errorf("unexpected batch response: %v", res)
+	}
+}
+
+func notLeaderResults(n int) []AddResult {
+	results := make([]AddResult, n)
+	for i := range results {
+		results[i].Result = NotLeader
+	}
+	return results
 }
 
 // Delete deletes the given key.
 func (s *Store) Delete(key string) error {
-	if s.raft.State() != raft.Leader {
-		return fmt.Errorf("not leader")
+	if !s.isLeader() {
+		return ErrNotLeader
 	}
 
 	c := &command{
-		Op:  "delete",
+		Op:  opDelete,
 		Key: key,
 	}
-	b, err := json.Marshal(c)
-	if err != nil {
-		return err
-	}
 
-	f := s.raft.Apply(b, raftTimeout)
+	f := s.apply(c.encode())
 	return f.Error()
 }
 
@@ -179,7 +390,11 @@ func (s *Store) Delete(key string) error {
 func (s *Store) Join(addr string) error {
 	log.DB.Infoln(logPrefix, "received join request for remote node as %s", addr)
 
-	f := s.raft.AddPeer(addr)
+	ra := s.node()
+	if ra == nil {
+		return ErrNotLeader
+	}
+	f := ra.AddPeer(addr)
 	if f.Error() != nil {
 		return f.Error()
 	}
@@ -187,124 +402,83 @@ func (s *Store) Join(addr string) error {
 	return nil
 }
 
-// Peers returns the raft peers
-func (s *Store) Peers() ([]string, error) {
-	return s.peerStore.Peers()
-}
-
-// Leader returns current leader of this raft cluster
-func (s *Store) Leader() string {
-	return s.raft.Leader()
-}
-
-// Stats return this raft status
-func (s *Store) Stats() map[string]string {
-	return s.raft.Stats()
-}
-
-type fsm Store
-
-// Apply applies a Raft log entry to the key-value store.
-func (f *fsm) Apply(l *raft.Log) interface{} {
-	var c command
-	if err := json.Unmarshal(l.Data, &c); err != nil {
-		panic(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
+// RemovePeer removes the node at the raft addr from the cluster, which
+// lowers the quorum of the cluster. Only the leader can, a leader removing
+// itself steps down and shuts its raft down.
+func (s *Store) RemovePeer(addr string) error {
+	if !s.isLeader() {
+		return ErrNotLeader
 	}
 
-	switch c.Op {
-	case "add":
-		return f.applyAdd(c.Key, c.Value)
-	case "set":
-		return f.applySet(c.Key, c.Value)
-	case "delete":
-		return f.applyDelete(c.Key)
-	default:
-		panic(fmt.Sprintf("unrecognized command op: %s", c.Op))
+	peers, err := s.Peers()
+	if err != nil {
+		return err
 	}
-}
-
-// Snapshot returns a snapshot of the key-value store.
-func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-
-	// Clone the map.
-	o := make(map[string]string)
-	for k, v := range f.m {
-		o[k] = v
+	if !raft.PeerContained(peers, addr) {
+		return ErrPeerNotFound
 	}
-	return &fsmSnapshot{store: o}, nil
-}
 
-// Restore stores the key-value store to a previous state.
-func (f *fsm) Restore(rc io.ReadCloser) error {
-	o := make(map[string]string)
-	if err := json.NewDecoder(rc).Decode(&o); err != nil {
+	ra := s.node()
+	if ra == nil {
+		return ErrNotLeader
+	}
+	log.DB.Infoln(logPrefix, "removing the node at", addr)
+	f := ra.RemovePeer(addr)
+	if err := f.Error(); notLeader(err) {
+		return ErrNotLeader
+	} else if err != nil {
 		return err
 	}
-
-	// Set the state from the snapshot, no lock required according to
-	// Hashicorp docs.
-	f.m = o
+	log.DB.Infoln(logPrefix, "node at", addr, "removed successfully")
 	return nil
 }
 
-func (f *fsm) applySet(key, value string) interface{} {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	f.m[key] = value
-	return nil
+// Leave removes this node from the cluster, it must be the leader. The
+// other nodes ask the leader to remove them.
+func (s *Store) Leave() error {
+	return s.RemovePeer(s.RaftBind)
 }
 
-func (f *fsm) applyAdd(key, value string) interface{} {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	if _, ok := f.m[key]; ok {
-		return errors.New("key duplicated")
+// Peers returns the raft peers, none on a replica.
+func (s *Store) Peers() ([]string, error) {
+	s.roleMu.RLock()
+	peerStore := s.peerStore
+	s.roleMu.RUnlock()
+	if peerStore == nil {
+		return []string{}, nil
 	}
-
-	f.m[key] = value
-	return nil
-}
-
-func (f *fsm) applyDelete(key string) interface{} {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	delete(f.m, key)
-	return nil
+	return peerStore.Peers()
 }
 
-type fsmSnapshot struct {
-	store map[string]string
+// Leader returns current leader of this raft cluster, a replica returns the
+// leader it follows.
+func (s *Store) Leader() string {
+	s.roleMu.RLock()
+	defer s.roleMu.RUnlock()
+	if s.raft == nil {
+		return s.leader
+	}
+	return s.raft.Leader()
 }
 
-func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
-	err := func() error {
-		// Encode data.
-		b, err := json.Marshal(f.store)
-		if err != nil {
-			return err
-		}
-
-		// Write data to sink.
-		if _, err := sink.Write(b); err != nil {
-			return err
-		}
-
-		// Close the sink.
-		if err := sink.Close(); err != nil {
-			return err
-		}
-
-		return nil
-	}()
-
-	if err != nil {
-		sink.Cancel()
-		return err
+// Stats return this raft status, with the role of the node.
+func (s *Store) Stats() map[string]string {
+	stats := map[string]string{}
+	if ra := s.node(); ra != nil {
+		stats = ra.Stats()
+		stats["role"] = RoleVoter
+	} else {
+		stats["role"] = RoleReplica
+		stats["state"] = "Replica"
+		stats["leader"] = s.Leader()
+		stats["applied_index"] = strconv.FormatUint(s.appliedIndex(), 10)
 	}
-
-	return nil
+	stats["checksum_errors"] = strconv.FormatUint(atomic.LoadUint64(&s.checksumErrors), 10)
+	if s.kv != nil {
+		floor, _ := s.kv.changesFloor()
+		stats["changes_floor"] = strconv.FormatUint(floor, 10)
+	}
+	stats["max_op"] = strconv.Itoa(int(MaxOp))
+	stats["cluster_op"] = strconv.Itoa(int(s.ClusterOp()))
+	return stats
 }
-
-func (f *fsmSnapshot) Release() {}
@@ -1,10 +1,20 @@
 package store
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/raft"
 )
 
 // Test_StoreOpen tests that the store can be opened.
@@ -22,6 +32,13 @@ func Test_StoreOpen(t *testing.T) {
 	if err := s.Open(false); err != nil {
 		t.Fatalf("failed to open store: %s", err)
 	}
+
+	// shutting down again, or a store never opened, does not panic
+	for _, store := range []*Store{s, s, New()} {
+		if err := store.Shutdown(); err != nil {
+			t.Errorf("failed to shut down: %s", err)
+		}
+	}
 }
 
 // Test_StoreOpenSingleNode tests that a command can be applied to the log
@@ -43,7 +60,7 @@ func Test_StoreOpenSingleNode(t *testing.T) {
 	// Simple way to ensure there is a leader.
 	time.Sleep(3 * time.Second)
 
-	if err := s.Set("foo", "bar"); err != nil {
+	if err := s.Set("foo", []byte("bar")); err != nil {
 		t.Fatalf("failed to set key: %s", err.Error())
 	}
 
@@ -53,22 +70,873 @@ func Test_StoreOpenSingleNode(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to get key: %s", err.Error())
 	}
-	if value != "bar" {
+	if string(value) != "bar" {
 		t.Fatalf("key has wrong value: %s", value)
 	}
 
+	for _, c := range []struct {
+		key, value, requestID string
+		expect                AddResult
+	}{
+		{"foo", "bar", "r1", AddResult{Result: Exists}},
+		{"foo", "baz", "r1", AddResult{Result: Conflict}},
+		{"hello", "world", "r2", AddResult{Result: Created, RequestID: "r2"}},
+		{"hello", "world", "r2", AddResult{Result: Created, RequestID: "r2"}},
+		{"hello", "world", "r3", AddResult{Result: Exists, RequestID: "r2"}},
+		{"hello", "word", "r3", AddResult{Result: Conflict, RequestID: "r2"}},
+	} {
+		res, err := s.Add(c.key, []byte(c.value), WriteOptions{RequestID: c.requestID, Writer: "w", ContentType: "text/plain"})
+		if err != nil {
+			t.Fatalf("failed to add key: %s", err.Error())
+		}
+		if res.Index == 0 {
+			t.Errorf("add %s/%s by %s, got no index", c.key, c.value, c.requestID)
+		}
+		if res.Index = 0; res != c.expect {
+			t.Errorf("add %s/%s by %s, expect %v, got %v", c.key, c.value, c.requestID, c.expect, res)
+		}
+	}
+
+	for _, c := range []Consistency{ConsistencyLinearizable, ConsistencyLeader, ConsistencyStale} {
+		if err := s.VerifyRead(c); err != nil {
+			t.Errorf("failed to verify the %s read on the leader: %v", c, err)
+		}
+	}
+
+	value, meta, err := s.GetWithMeta("hello")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err.Error())
+	}
+	if string(value) != "world" || meta == nil || meta.Index == 0 || meta.Term == 0 ||
+		meta.Timestamp.IsZero() || meta.Writer != "w" || meta.RequestID != "r2" || meta.ContentType != "text/plain" {
+		t.Errorf("key has wrong meta: %s, %#v", value, meta)
+	}
+
 	if err := s.Delete("foo"); err != nil {
 		t.Fatalf("failed to delete key: %s", err.Error())
 	}
 
 	// Wait for committed log entry to be applied.
 	time.Sleep(500 * time.Millisecond)
-	value, err = s.Get("foo")
+	if value, err = s.Get("foo"); err != ErrKeyNotFound {
+		t.Fatalf("expect ErrKeyNotFound for the deleted key, got: %s, %v", value, err)
+	}
+
+	if err := s.RemovePeer("127.0.0.1:1"); err != ErrPeerNotFound {
+		t.Errorf("expect ErrPeerNotFound for a node not in the cluster, got: %v", err)
+	}
+
+	// a graceful shutdown keeps the applied keys
+	if res, err := s.Add("kept", []byte("v"), WriteOptions{}); err != nil || res.Result != Created {
+		t.Fatalf("failed to add key: %v, %v", res, err)
+	}
+	if index, err := s.Drain(); err != nil || index == 0 {
+		t.Errorf("expect the last index of the leader, got: %d, %v", index, err)
+	}
+	if res, err := s.Add("late", []byte("v"), WriteOptions{}); err != nil || res.Result != NotLeader {
+		t.Errorf("expect a write after the drain rejected, got: %v, %v", res, err)
+	}
+	if err := s.Shutdown(); err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+
+	reopened := New()
+	reopened.RaftBind = "127.0.0.1:0"
+	reopened.RaftDir = tmpDir
+	if err := reopened.Open(true); err != nil {
+		t.Fatalf("failed to reopen store: %s", err)
+	}
+	defer reopened.Shutdown()
+	if value, err := reopened.Get("kept"); err != nil || string(value) != "v" {
+		t.Errorf("expect the key kept after the restart, got: %s, %v", value, err)
+	}
+
+	// a voter demoted keeps its keys as a replica, and is promoted back
+	if err := reopened.Demote(); err != nil {
+		t.Fatalf("failed to demote: %v", err)
+	}
+	if reopened.Role() != RoleReplica || SavedRole(tmpDir) != RoleReplica || reopened.Stats()["role"] != RoleReplica {
+		t.Errorf("expect a replica, got: %s, saved: %s", reopened.Role(), SavedRole(tmpDir))
+	}
+	if res, err := reopened.Add("replica", []byte("v"), WriteOptions{}); err != nil || res.Result != NotLeader {
+		t.Errorf("expect a write to a replica rejected, got: %v, %v", res, err)
+	}
+	if value, err := reopened.Get("kept"); err != nil || string(value) != "v" {
+		t.Errorf("expect the key kept on the replica, got: %s, %v", value, err)
+	}
+	if err := reopened.Demote(); err != ErrRole {
+		t.Errorf("expect ErrRole demoting a replica, got: %v", err)
+	}
+	if err := reopened.Promote(); err != nil {
+		t.Fatalf("failed to promote: %v", err)
+	}
+	if reopened.Role() != RoleVoter || SavedRole(tmpDir) != RoleVoter {
+		t.Errorf("expect a voter, got: %s, saved: %s", reopened.Role(), SavedRole(tmpDir))
+	}
+}
+
+type testSink struct {
+	bytes.Buffer
+	canceled bool
+}
+
+func (s *testSink) ID() string    { return "test" }
+func (s *testSink) Close() error  { return nil }
+func (s *testSink) Cancel() error { s.canceled = true; return nil }
+
+// Test_StoreSnapshotRestore tests that the entries on disk survive a
+// snapshot and a restore into another store.
+func Test_StoreSnapshotRestore(t *testing.T) {
+	s := testOpenedKV(t)
+	err := s.kv.update(1, func(data *bolt.Bucket) error {
+		if err := data.Put([]byte("foo"), (&entry{Value: []byte("bar")}).encode()); err != nil {
+			return err
+		}
+		return data.Put([]byte("\"quoted\""), (&entry{Value: []byte("baz")}).encode())
+	})
 	if err != nil {
-		t.Fatalf("failed to get key: %s", err.Error())
+		t.Fatal(err)
 	}
-	if value != "" {
-		t.Fatalf("key has wrong value: %s", value)
+
+	snap, err := (*fsm)(s).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a write after Snapshot is not in the snapshot
+	err = s.kv.update(2, func(data *bolt.Bucket) error {
+		return data.Put([]byte("late"), (&entry{Value: []byte("v")}).encode())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &testSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+
+	r := testOpenedKV(t)
+	if err := (*fsm)(r).Restore(ioutil.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := r.Get("late"); err != ErrKeyNotFound {
+		t.Errorf("expect the late key missing, got %s, err: %v", value, err)
+	}
+
+	for key, expect := range map[string]string{"foo": "bar", "\"quoted\"": "baz"} {
+		value, err := r.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != expect {
+			t.Errorf("key %s has wrong value: %s", key, value)
+		}
+	}
+}
+
+// Test_StoreRestoreLegacy tests that a snapshot of the old JSON format can
+// still be restored.
+func Test_StoreRestoreLegacy(t *testing.T) {
+	s := testOpenedKV(t)
+	legacy := `{"foo":"bar","hello":"world"}`
+	if err := (*fsm)(s).Restore(ioutil.NopCloser(strings.NewReader(legacy))); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expect := range map[string]string{"foo": "bar", "hello": "world"} {
+		value, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != expect {
+			t.Errorf("key %s has wrong value: %s", key, value)
+		}
+	}
+}
+
+// Test_StoreRestoreCorrupted tests that a damaged snapshot is rejected.
+func Test_StoreRestoreCorrupted(t *testing.T) {
+	s := testOpenedKV(t)
+	if err := s.kv.update(1, func(data *bolt.Bucket) error {
+		return data.Put([]byte("foo"), (&entry{Value: []byte("bar")}).encode())
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := (*fsm)(s).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &testSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+
+	b := sink.Bytes()
+	truncated := append([]byte{}, b[:len(b)-4]...)
+	if err := (*fsm)(testOpenedKV(t)).Restore(ioutil.NopCloser(bytes.NewReader(truncated))); err != ErrSnapshotTruncated {
+		t.Errorf("expect ErrSnapshotTruncated, got: %v", err)
+	}
+
+	flipped := append([]byte{}, b...)
+	flipped[len(flipped)-20] ^= 0xff
+	if err := (*fsm)(testOpenedKV(t)).Restore(ioutil.NopCloser(bytes.NewReader(flipped))); err != ErrSnapshotCorrupted {
+		t.Errorf("expect ErrSnapshotCorrupted, got: %v", err)
+	}
+}
+
+func testOpenedKV(t *testing.T) *Store {
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	kv, err := openKVStore(filepath.Join(tmpDir, "fsm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Store{RaftDir: tmpDir, kv: kv}
+}
+
+// Test_ApplyBatchAdd tests both modes of the batch add.
+func Test_ApplyBatchAdd(t *testing.T) {
+	f := (*fsm)(testOpenedKV(t))
+	add := &command{Op: opAdd, Key: "foo", Value: []byte("bar")}
+	f.Apply(&raft.Log{Index: 1, Data: add.encode()})
+
+	pairs := []Pair{{Key: "a", Value: []byte("1")}, {Key: "foo", Value: []byte("baz")}, {Key: "b", Value: []byte("2")}, {Key: "b", Value: []byte("2")}}
+	atomic := &command{Op: opBatchAdd, Atomic: true, Pairs: pairs, RequestID: "r1"}
+	res := f.Apply(&raft.Log{Index: 2, Data: atomic.encode()})
+	expect := []AddResult{
+		{Result: Aborted, RequestID: "r1"}, {Result: Conflict},
+		{Result: Aborted, RequestID: "r1"}, {Result: Exists, RequestID: "r1"},
+	}
+	if !reflect.DeepEqual(res, expect) {
+		t.Errorf("atomic batch, expect %v, got %v", expect, res)
+	}
+	if value, err := (*Store)(f).Get("a"); err != ErrKeyNotFound {
+		t.Errorf("atomic batch added a key: %s", value)
+	}
+
+	bestEffort := &command{Op: opBatchAdd, Pairs: pairs, RequestID: "r2"}
+	res = f.Apply(&raft.Log{Index: 3, Data: bestEffort.encode()})
+	expect = []AddResult{
+		{Result: Created, RequestID: "r2"}, {Result: Conflict},
+		{Result: Created, RequestID: "r2"}, {Result: Exists, RequestID: "r2"},
+	}
+	if !reflect.DeepEqual(res, expect) {
+		t.Errorf("best-effort batch, expect %v, got %v", expect, res)
+	}
+	if value, _ := (*Store)(f).Get("b"); string(value) != "2" {
+		t.Errorf("best-effort batch failed to add, got: %s", value)
+	}
+	// a pair failing to be written rolls back the whole entry
+	tooLarge := []Pair{{Key: "c", Value: []byte("3")}, {Key: strings.Repeat("k", MaxKeyBytes+1), Value: []byte("4")}}
+	atomic = &command{Op: opBatchAdd, Atomic: true, Pairs: tooLarge, RequestID: "r3"}
+	if res := f.Apply(&raft.Log{Index: 4, Data: atomic.encode()}); res != ErrKeyTooLarge {
+		t.Errorf("expect ErrKeyTooLarge, got %v", res)
+	}
+	if value, err := (*Store)(f).Get("c"); err != ErrKeyNotFound {
+		t.Errorf("failed batch added a key: %s", value)
+	}
+	if changes, _, err := f.kv.changes(4, 10); err != nil || len(changes) != 0 {
+		t.Errorf("failed batch recorded changes: %v, err: %v", changes, err)
+	}
+	if index, _ := f.kv.appliedIndex(); index != 4 {
+		t.Errorf("expect the failed batch applied at 4, got %d", index)
+	}
+
+	// the store refuses the oversized key before proposing it
+	if _, err := (*Store)(f).AddBatch(tooLarge, true, WriteOptions{}); err != ErrKeyTooLarge {
+		t.Errorf("expect ErrKeyTooLarge, got %v", err)
+	}
+}
+
+// Test_ApplyGroupAdd tests the adds of a group are applied like separate
+// entries, a bad add failing alone.
+func Test_ApplyGroupAdd(t *testing.T) {
+	f := (*fsm)(testOpenedKV(t))
+	add := &command{Op: opAdd, Key: "foo", Value: []byte("bar")}
+	f.Apply(&raft.Log{Index: 1, Data: add.encode()})
+
+	group := &command{Op: opGroupAdd, Adds: []*command{
+		{Op: opAdd, Key: "a", Value: []byte("1"), RequestID: "r1"},
+		{Op: opAdd, Key: "foo", Value: []byte("baz"), RequestID: "r2"},
+		{Op: opAdd, Key: "a", Value: []byte("1"), RequestID: "r3"},
+		{Op: opAdd, Key: "a", Value: []byte("2"), RequestID: "r4"},
+		{Op: opAdd, Key: strings.Repeat("k", MaxKeyBytes+1), Value: []byte("3"), RequestID: "r5"},
+		{Op: opAdd, Key: "b", Value: []byte("4"), RequestID: "r6"},
+	}}
+	res := f.Apply(&raft.Log{Index: 2, Data: group.encode()})
+	expect := []AddResult{
+		{Result: Created, RequestID: "r1"}, {Result: Conflict},
+		{Result: Exists, RequestID: "r1"}, {Result: Conflict, RequestID: "r1"},
+		{err: ErrKeyTooLarge}, {Result: Created, RequestID: "r6"},
+	}
+	if !reflect.DeepEqual(res, expect) {
+		t.Errorf("expect %v, got %v", expect, res)
+	}
+
+	_, meta, err := (*Store)(f).GetWithMeta("a")
+	if err != nil || meta.Index != 2 || meta.RequestID != "r1" {
+		t.Errorf("failed to add with the group, got %v, err: %v", meta, err)
+	}
+	if value, err := (*Store)(f).Get("b"); err != nil || string(value) != "4" {
+		t.Errorf("failed to add after the bad add, got %s, err: %v", value, err)
+	}
+	changes, _, err := f.kv.changes(2, 10)
+	if err != nil || len(changes) != 2 || changes[0].Key != "a" || changes[1].Key != "b" {
+		t.Errorf("expect the changes of a and b, got %v, err: %v", changes, err)
+	}
+}
+
+// Test_GroupCommit tests the concurrent adds get their own results from a
+// group commit.
+func Test_GroupCommit(t *testing.T) {
+	s := New()
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	s.GroupWindow = 50 * time.Millisecond
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Shutdown()
+	testWaitLeader(t, s)
+
+	if res, err := s.Add("taken", []byte("v"), WriteOptions{RequestID: "r0"}); err != nil || res.Result != Created {
+		t.Fatalf("failed to add alone, got %v, err: %v", res, err)
+	}
+
+	// The add of k10 passes the store and fails in the group, its expiry
+	// key is too large.
+	const n, bad = 20, 10
+	results := make([]AddResult, n+1)
+	errs := make([]error, n+1)
+	var wg sync.WaitGroup
+	for i := 0; i <= n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key, value, opts := fmt.Sprintf("k%d", i), []byte("v"), WriteOptions{RequestID: fmt.Sprintf("r%d", i+1)}
+			switch i {
+			case bad:
+				key, opts.TTL = strings.Repeat("k", MaxKeyBytes), time.Hour
+			case n:
+				key, value = "taken", []byte("other")
+			}
+			results[i], errs[i] = s.Add(key, value, opts)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if i == bad && err != ErrKeyTooLarge {
+			t.Errorf("expect ErrKeyTooLarge for the bad add, got %v", err)
+		} else if i != bad && err != nil {
+			t.Errorf("expect add %d not failed by the bad add, got %v", i, err)
+		}
+	}
+
+	indexes := map[uint64]bool{}
+	for i, res := range results[:n] {
+		if i == bad {
+			continue
+		}
+		if res.Result != Created || res.RequestID != fmt.Sprintf("r%d", i+1) {
+			t.Errorf("expect k%d created by its own request, got %v", i, res)
+		}
+		indexes[res.Index] = true
+	}
+	if res := results[n]; res.Result != Conflict || res.RequestID != "r0" {
+		t.Errorf("expect a conflict with r0, got %v", res)
+	}
+	if len(indexes) >= n-1 {
+		t.Errorf("expect the adds grouped in fewer entries, got %d", len(indexes))
+	}
+	if value, err := s.Get("k3"); err != nil || string(value) != "v" {
+		t.Errorf("failed to get the grouped add, got %s, err: %v", value, err)
+	}
+}
+
+// Test_GroupCommitGated tests the adds are committed one by one while some
+// voter does not apply opGroupAdd.
+func Test_GroupCommitGated(t *testing.T) {
+	s := New()
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	s.GroupWindow = 50 * time.Millisecond
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Shutdown()
+	testWaitLeader(t, s)
+	s.SetClusterOp(opPurge)
+
+	const n = 10
+	results := make([]AddResult, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = s.Add(fmt.Sprintf("k%d", i), []byte("v"), WriteOptions{})
+		}(i)
+	}
+	wg.Wait()
+
+	indexes := map[uint64]bool{}
+	for i, res := range results {
+		if errs[i] != nil || res.Result != Created {
+			t.Errorf("expect k%d created, got %v, err: %v", i, res, errs[i])
+		}
+		indexes[res.Index] = true
+	}
+	if len(indexes) != n {
+		t.Errorf("expect every add in an entry of its own, got %d entries", len(indexes))
+	}
+}
+
+// testWaitLeader waits for the single node store s to be elected.
+func testWaitLeader(t testing.TB, s *Store) {
+	for i := 0; !s.isLeader(); i++ {
+		if i == 100 {
+			t.Fatal("no leader elected")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func Test_WaitApplied(t *testing.T) {
+	s := New()
+	if err := s.WaitApplied(1, 10*time.Millisecond); err != ErrApplyTimeout {
+		t.Errorf("expect ErrApplyTimeout, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.setApplied(1)
+		s.setApplied(2)
+	}()
+	if err := s.WaitApplied(2, time.Second); err != nil {
+		t.Errorf("failed to wait for the applied index: %v", err)
+	}
+}
+
+func Test_WaitKey(t *testing.T) {
+	f := (*fsm)(testOpenedKV(t))
+	s := (*Store)(f)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, meta, err := s.WaitKey(ctx, "foo"); meta != nil || err != nil {
+		t.Errorf("expect no key before the timeout, got %v, %v", meta, err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		add := &command{Op: opAdd, Key: "foo", Value: []byte("bar")}
+		f.Apply(&raft.Log{Index: 1, Data: add.encode()})
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	value, meta, err := s.WaitKey(ctx, "foo")
+	if err != nil || meta == nil || string(value) != "bar" {
+		t.Errorf("failed to wait for the key, got %s, %v, %v", value, meta, err)
+	}
+	if len(s.watches.watches) != 0 {
+		t.Errorf("failed to release the watches: %v", s.watches.watches)
+	}
+}
+
+// Test_Changes tests that the changes follow the log and survive a restore.
+func Test_Changes(t *testing.T) {
+	f := (*fsm)(testOpenedKV(t))
+	for i, c := range []*command{
+		{Op: opAdd, Key: "foo", Value: []byte("bar")},
+		{Op: opBatchAdd, Pairs: []Pair{{Key: "a", Value: []byte("1")}, {Key: "b", Value: []byte("2")}}},
+		{Op: opSet, Key: "foo", Value: []byte("baz")},
+		{Op: opDelete, Key: "a"},
+	} {
+		f.Apply(&raft.Log{Index: uint64(i + 1), Data: c.encode()})
+	}
+
+	changes, next, err := (*Store)(f).Changes(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, change := range changes {
+		got = append(got, fmt.Sprintf("%d %s %s=%s", change.Index, change.Op, change.Key, change.Value))
+	}
+	expect := []string{"2 add b=2", "3 add foo=baz", "4 delete a="}
+	if !reflect.DeepEqual(got, expect) || next != 5 {
+		t.Errorf("expect %v before 5, got %v before %d", expect, got, next)
+	}
+
+	// the changes of an entry are not split by the limit
+	if changes, next, _ := (*Store)(f).Changes(0, 1); len(changes) != 1 || next != 3 {
+		t.Errorf("expect 1 change before 3, got %v before %d", changes, next)
+	}
+
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &testSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+
+	r := testOpenedKV(t)
+	if err := (*fsm)(r).Restore(ioutil.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	// the changes start after the snapshot restored
+	if _, _, err := r.Changes(3, 100); err != ErrChangesCompacted {
+		t.Errorf("expect ErrChangesCompacted, got %v", err)
+	}
+	if changes, next, err := r.Changes(0, 100); err != nil || len(changes) != 0 || next != 5 {
+		t.Errorf("expect no changes before 5, got %v before %d, err: %v", changes, next, err)
+	}
+
+	// the changes older than retainChanges entries before a snapshot are
+	// trimmed once it is persisted
+	add := &command{Op: opAdd, Key: "late", Value: []byte("v")}
+	f.Apply(&raft.Log{Index: retainChanges + 3, Data: add.encode()})
+	snap, err = f.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.Persist(&testSink{}); err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+	if _, _, err := (*Store)(f).Changes(3, 100); err != ErrChangesCompacted {
+		t.Errorf("expect the trimmed changes compacted, got %v", err)
+	}
+	changes, next, err = (*Store)(f).Changes(0, 100)
+	if err != nil || len(changes) != 2 || changes[0].Index != 4 || changes[1].Key != "late" || next != retainChanges+4 {
+		t.Errorf("expect the changes from 4 kept, got %v before %d, err: %v", changes, next, err)
+	}
+	if stats := (*Store)(f).Stats(); stats["changes_floor"] != "3" {
+		t.Errorf("expect the changes floor 3, got %s", stats["changes_floor"])
+	}
+}
+
+// Test_Replica tests that a replica applying the replicated changes of a
+// voter holds the same entries.
+func Test_Replica(t *testing.T) {
+	f := (*fsm)(testOpenedKV(t))
+	for i, c := range []*command{
+		{Op: opAdd, Key: "foo", Value: []byte("bar"), Writer: "w"},
+		{Op: opBatchAdd, Pairs: []Pair{{Key: "a", Value: []byte("1")}, {Key: "b", Value: []byte("2")}}},
+		{Op: opAdd, Key: "ttl", Value: []byte("v"), ExpiresAt: time.Now().Add(time.Hour).UnixNano()},
+		{Op: opDelete, Key: "a"},
+	} {
+		f.Apply(&raft.Log{Index: uint64(i + 1), Term: 1, Data: c.encode()})
+	}
+	voter := (*Store)(f)
+
+	replica := testOpenedKV(t)
+	if replica.Role() != RoleReplica {
+		t.Fatalf("expect a store without raft to be a replica, got: %s", replica.Role())
+	}
+	for from := replica.AppliedIndex() + 1; ; from = replica.AppliedIndex() + 1 {
+		changes, next, err := voter.ReplicatedChanges(from, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := replica.ApplyReplicated(changes, next, "leader"); err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) == 0 {
+			break
+		}
+	}
+
+	if replica.AppliedIndex() != 4 || replica.Leader() != "leader" {
+		t.Errorf("expect the index 4 applied following the leader, got: %d, %q", replica.AppliedIndex(), replica.Leader())
+	}
+	expect, _ := voter.Checksums("", "", 0)
+	got, _ := replica.Checksums("", "", 0)
+	if Digest(got) != Digest(expect) || len(got) != 3 {
+		t.Errorf("expect the entries of the voter %v, got: %v", expect, got)
+	}
+	if _, meta, _ := replica.GetWithMeta("foo"); meta == nil || meta.Index != 1 || meta.Writer != "w" {
+		t.Errorf("expect the metadata of foo kept, got: %#v", meta)
+	}
+	if keys, _ := replica.kv.expiredKeys(time.Now().Add(2*time.Hour).UnixNano(), 10); !reflect.DeepEqual(keys, []string{"ttl"}) {
+		t.Errorf("expect the expiry of ttl indexed, got: %v", keys)
+	}
+	if changes, _, _ := replica.Changes(0, 100); len(changes) != 4 {
+		t.Errorf("expect the changes recorded on the replica, got: %v", changes)
+	}
+
+	// a corrupted entry is not applied
+	corrupted := ReplicatedChange{Index: 5, Op: ChangeAdd, Key: "bad", Entry: []byte{entryVersion}}
+	if err := replica.ApplyReplicated([]ReplicatedChange{corrupted}, 6, "leader"); err == nil || replica.AppliedIndex() != 4 {
+		t.Errorf("expect the corrupted entry rejected, got: %v, %d", err, replica.AppliedIndex())
+	}
+	// a voter restored from a snapshot misses the purge before it in its
+	// changes, the replica behind the snapshot resyncs from a snapshot
+	purge := &command{Op: opPurge, Key: "foo", Writer: "alice", Reason: "legal", Timestamp: 42}
+	f.Apply(&raft.Log{Index: 5, Term: 1, Data: purge.encode()})
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &testSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+	restored := testOpenedKV(t)
+	if err := (*fsm)(restored).Restore(ioutil.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := restored.ReplicatedChanges(replica.AppliedIndex()+1, 10); err != ErrResync {
+		t.Fatalf("expect ErrResync behind the snapshot, got: %v", err)
+	}
+	if _, _, err := restored.ReplicatedChanges(6, 10); err != nil {
+		t.Errorf("expect the changes after the snapshot, got: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := restored.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.ResyncReplica(&buf, "leader"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := replica.Get("foo"); err != ErrKeyNotFound || replica.AppliedIndex() != 5 {
+		t.Errorf("expect the purged key gone at 5, got: %s, %v, %d", value, err, replica.AppliedIndex())
+	}
+	if value, _ := replica.Get("b"); string(value) != "2" {
+		t.Errorf("expect b kept, got: %s", value)
 	}
+}
+
+// Test_List tests the prefix, the range and the pages of a listing.
+func Test_List(t *testing.T) {
+	s := testOpenedKV(t)
+	if err := s.kv.update(1, func(data *bolt.Bucket) error {
+		for _, key := range []string{"app/1.0.0/file", "app/1.2.3/file", "app/2.0.0/file", "apple", "b"} {
+			if err := data.Put([]byte(key), (&entry{Value: []byte("v")}).encode()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		opts   ListOptions
+		expect []string
+		more   bool
+	}{
+		{ListOptions{Prefix: "app/", Limit: 10}, []string{"app/1.0.0/file", "app/1.2.3/file", "app/2.0.0/file"}, false},
+		{ListOptions{Prefix: "app/", Limit: 2}, []string{"app/1.0.0/file", "app/1.2.3/file"}, true},
+		{ListOptions{Prefix: "app/", After: "app/1.2.3/file", Limit: 2}, []string{"app/2.0.0/file"}, false},
+		{ListOptions{After: "app/1", End: "app/2", Limit: 10}, []string{"app/1.0.0/file", "app/1.2.3/file"}, false},
+		{ListOptions{After: "apple", Limit: 10}, []string{"b"}, false},
+		{ListOptions{Prefix: "c", Limit: 10}, nil, false},
+	} {
+		keys, more, err := s.List(c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, c.expect) || more != c.more {
+			t.Errorf("list %+v, expect %v %v, got %v %v", c.opts, c.expect, c.more, keys, more)
+		}
+	}
+}
+
+// Test_EmptyValue tests that a key may have an empty value.
+func Test_EmptyValue(t *testing.T) {
+	f := (*fsm)(testOpenedKV(t))
+	add := &command{Op: opAdd, Key: "empty", ContentType: "application/octet-stream"}
+	if res := f.Apply(&raft.Log{Index: 1, Data: add.encode()}); res != (AddResult{Result: Created}) {
+		t.Fatalf("failed to add the empty value: %v", res)
+	}
+
+	value, meta, err := (*Store)(f).GetWithMeta("empty")
+	if err != nil || meta == nil || len(value) != 0 || meta.ContentType != "application/octet-stream" {
+		t.Errorf("failed to get the empty value, got %q, %v, %v", value, meta, err)
+	}
+	if _, err := (*Store)(f).Get("missing"); err != ErrKeyNotFound {
+		t.Errorf("expect ErrKeyNotFound, got %v", err)
+	}
+}
+
+// Test_Expire tests that the keys expire at the timestamps of the log, and
+// can be added again once expired.
+func Test_Expire(t *testing.T) {
+	f := (*fsm)(testOpenedKV(t))
+	s := (*Store)(f)
+	apply := func(index uint64, c *command) interface{} {
+		return f.Apply(&raft.Log{Index: index, Data: c.encode()})
+	}
+
+	apply(1, &command{Op: opAdd, Key: "foo", Value: []byte("v1"), Timestamp: 100, ExpiresAt: 200})
+	if keys, err := s.kv.expiredKeys(199, 10); err != nil || len(keys) != 0 {
+		t.Errorf("expect no key expired, got %v, %v", keys, err)
+	}
+	if keys, err := s.kv.expiredKeys(200, 10); err != nil || !reflect.DeepEqual(keys, []string{"foo"}) {
+		t.Errorf("expect foo expired, got %v, %v", keys, err)
+	}
+
+	// an expired key can be added again, until then it is once-only
+	if res := apply(2, &command{Op: opAdd, Key: "foo", Value: []byte("v2"), Timestamp: 150}); res != (AddResult{Result: Conflict}) {
+		t.Errorf("expect Conflict before the expiry, got %v", res)
+	}
+	if res := apply(3, &command{Op: opAdd, Key: "foo", Value: []byte("v2"), Timestamp: 250}); res != (AddResult{Result: Created}) {
+		t.Errorf("expect Created after the expiry, got %v", res)
+	}
+	if keys, _ := s.kv.expiredKeys(1<<62, 10); len(keys) != 0 {
+		t.Errorf("failed to drop the expiry of the overwritten entry, got %v", keys)
+	}
+
+	// opExpire deletes the keys expired at its timestamp only
+	apply(4, &command{Op: opAdd, Key: "bar", Value: []byte("v"), Timestamp: 100, ExpiresAt: 300})
+	apply(5, &command{Op: opExpire, Keys: []string{"bar", "foo"}, Timestamp: 300})
+	if b, _ := s.kv.get([]byte("bar")); b != nil {
+		t.Errorf("failed to expire bar")
+	}
+	if value, err := s.Get("foo"); err != nil || string(value) != "v2" {
+		t.Errorf("expect foo kept, got %s, %v", value, err)
+	}
+	changes, _, err := s.Changes(5, 10)
+	if err != nil || len(changes) != 1 || changes[0].Op != ChangeDelete || changes[0].Key != "bar" {
+		t.Errorf("expect the delete of bar, got %v, %v", changes, err)
+	}
+
+	// a key expired is hidden before its opExpire
+	now := time.Now()
+	apply(6, &command{Op: opAdd, Key: "baz", Value: []byte("v"), Timestamp: now.Add(-time.Minute).UnixNano(), ExpiresAt: now.Add(-time.Second).UnixNano()})
+	if _, err := s.Get("baz"); err != ErrKeyNotFound {
+		t.Errorf("expect ErrKeyNotFound for the expired key, got %v", err)
+	}
+	if keys, _, err := s.List(ListOptions{Limit: 10}); err != nil || !reflect.DeepEqual(keys, []string{"foo"}) {
+		t.Errorf("expect the expired key left out, got %v, %v", keys, err)
+	}
+}
+
+func Test_Purge(t *testing.T) {
+	f := (*fsm)(testOpenedKV(t))
+	s := (*Store)(f)
+	apply := func(index uint64, c *command) interface{} {
+		return f.Apply(&raft.Log{Index: index, Data: c.encode()})
+	}
+
+	apply(1, &command{Op: opAdd, Key: "foo", Value: []byte("wrong"), ExpiresAt: 1 << 62})
+	res := apply(2, &command{Op: opPurge, Key: "foo", Writer: "alice", Reason: "legal", Timestamp: 100})
+	if p, ok := res.(*Purge); !ok || !p.Found || p.Index != 2 || p.Operator != "alice" {
+		t.Errorf("failed to purge foo, got %v", res)
+	}
+	if _, err := s.Get("foo"); err != ErrKeyNotFound {
+		t.Errorf("expect foo purged, got %v", err)
+	}
+	if keys, _ := s.kv.expiredKeys(1<<62, 10); len(keys) != 0 {
+		t.Errorf("failed to drop the expiry of the purged key, got %v", keys)
+	}
+
+	// the key can be added again
+	if res := apply(3, &command{Op: opAdd, Key: "foo", Value: []byte("right")}); res != (AddResult{Result: Created}) {
+		t.Errorf("expect Created after the purge, got %v", res)
+	}
+	apply(4, &command{Op: opPurge, Key: "missing", Writer: "bob", Timestamp: 200})
+
+	// the audit records survive a snapshot
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &testSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+
+	r := testOpenedKV(t)
+	if err := (*fsm)(r).Restore(ioutil.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	purges, err := r.Purges()
+	if err != nil || len(purges) != 2 {
+		t.Fatalf("expect 2 purges, got %v, %v", purges, err)
+	}
+	if p := purges[0]; p.Key != "foo" || p.Reason != "legal" || !p.Timestamp.Equal(time.Unix(0, 100)) {
+		t.Errorf("wrong audit record, got %#v", p)
+	}
+	if p := purges[1]; p.Key != "missing" || p.Found || p.Index != 4 {
+		t.Errorf("wrong audit record, got %#v", p)
+	}
+	if value, err := r.Get("foo"); err != nil || string(value) != "right" {
+		t.Errorf("expect foo restored, got %s, %v", value, err)
+	}
+}
+
+// Test_ChecksumRepair tests that a corrupted entry is found on the reads
+// and by the checksums, and is repaired with the entry of a replica.
+func Test_ChecksumRepair(t *testing.T) {
+	f, replica := (*fsm)(testOpenedKV(t)), (*fsm)(testOpenedKV(t))
+	add := &command{Op: opAdd, Key: "foo", Value: []byte("bar")}
+	for _, kv := range []*fsm{f, replica} {
+		kv.Apply(&raft.Log{Index: 1, Data: add.encode()})
+	}
+	s := (*Store)(f)
 
+	good, err := s.Entry("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := bytes.Replace(good, []byte("bar"), []byte("baz"), 1)
+	if err := s.kv.putAll([][2][]byte{{[]byte("foo"), corrupted}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get("foo"); err != ErrChecksumMismatch {
+		t.Errorf("expect ErrChecksumMismatch, got %v", err)
+	}
+	sums, err := s.Checksums("", "", 0)
+	if err != nil || len(sums) != 1 || !sums[0].Corrupted {
+		t.Errorf("expect foo corrupted, got %v, %v", sums, err)
+	}
+	healthy, _ := (*Store)(replica).Checksums("", "", 0)
+	if Digest(sums) == Digest(healthy) {
+		t.Error("expect the digests to differ")
+	}
+
+	if err := s.Repair("foo", corrupted); err != ErrChecksumMismatch {
+		t.Errorf("expect the corrupted entry refused, got %v", err)
+	}
+	other := &entry{Value: []byte("bar"), Index: 2}
+	if err := s.Repair("foo", other.encode()); err != ErrRepairConflict {
+		t.Errorf("expect ErrRepairConflict for another index, got %v", err)
+	}
+	entry, _ := (*Store)(replica).Entry("foo")
+	if err := s.Repair("foo", entry); err != nil {
+		t.Errorf("failed to repair, got %v", err)
+	}
+	if value, err := s.Get("foo"); err != nil || string(value) != "bar" {
+		t.Errorf("expect foo repaired, got %s, %v", value, err)
+	}
+	if err := s.Repair("missing", entry); err != ErrKeyNotFound {
+		t.Errorf("expect ErrKeyNotFound for a missing key, got %v", err)
+	}
+
+	// entries written before the checksums pass
+	legacy := appendField(appendField([]byte{entryVersion}, []byte("old")), nil)
+	if err := s.kv.putAll([][2][]byte{{[]byte("legacy"), legacy}}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := s.Get("legacy"); err != nil || string(value) != "old" {
+		t.Errorf("expect the legacy entry, got %s, %v", value, err)
+	}
 }
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"sync"
+)
+
+// keyWatch is closed when its key is added.
+type keyWatch struct {
+	ch      chan struct{}
+	waiters int
+}
+
+// keyWatches wakes up the readers waiting for keys to be added. The zero
+// value is ready to use.
+type keyWatches struct {
+	mu      sync.Mutex
+	watches map[string]*keyWatch
+}
+
+// watch returns the watch of key, release must be called once done.
+func (ws *keyWatches) watch(key string) *keyWatch {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.watches == nil {
+		ws.watches = make(map[string]*keyWatch)
+	}
+
+	w, ok := ws.watches[key]
+	if !ok {
+		w = &keyWatch{ch: make(chan struct{})}
+		ws.watches[key] = w
+	}
+	w.waiters++
+	return w
+}
+
+func (ws *keyWatches) release(key string, w *keyWatch) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	w.waiters--
+	if w.waiters == 0 && ws.watches[key] == w {
+		delete(ws.watches, key)
+	}
+}
+
+// notify wakes up the readers waiting for the keys.
+func (ws *keyWatches) notify(keys ...string) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for _, key := range keys {
+		if w, ok := ws.watches[key]; ok {
+			close(w.ch)
+			delete(ws.watches, key)
+		}
+	}
+}
+
+// notifyAll wakes up all the readers, for a restore replacing the data.
+func (ws *keyWatches) notifyAll() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for key, w := range ws.watches {
+		close(w.ch)
+		delete(ws.watches, key)
+	}
+}
+
+// WaitKey returns the value and the metadata of key once it is added to
+// the store, or a nil metadata if ctx is done before.
+func (s *Store) WaitKey(ctx context.Context, key string) ([]byte, *Meta, error) {
+	for {
+		// Watch before reading, so an add applied in between wakes us up.
+		w := s.watches.watch(key)
+		value, meta, err := s.GetWithMeta(key)
+		if err != nil || meta != nil {
+			s.watches.release(key, w)
+			return value, meta, err
+		}
+
+		select {
+		case <-w.ch:
+			s.watches.release(key, w)
+		case <-ctx.Done():
+			s.watches.release(key, w)
+			return nil, nil, nil
+		}
+	}
+}
@@ -11,7 +11,12 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "node"
 	app.Action = func(c *cli.Context) error {
-		master := service.New(c.Args().Get(0), c.Args().Get(1), c.Args().Get(2))
+		newService := service.New
+		// the optional fourth argument "replica" joins without voting
+		if c.Args().Get(3) == "replica" {
+			newService = service.NewReplica
+		}
+		master := newService(c.Args().Get(0), c.Args().Get(1), c.Args().Get(2))
 		master.Start()
 		return nil
 	}
@@ -0,0 +1,211 @@
+// Package namespace defines the namespaces sharing a cluster. Every
+// namespace has its own limits, cache group and access tokens, and its keys
+// are stored apart from the keys of the other namespaces and of the
+// default one. The namespaces are kept in the meta store, where the
+// databases and the caches read them.
+package namespace
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Focinfi/oncekv/config"
+	"github.com/Focinfi/oncekv/meta"
+)
+
+// keyPrefix starts the stored keys of the namespaces, the byte never
+// appears in UTF-8, so the keys of the default namespace are kept from it
+const keyPrefix = "\xff"
+
+var (
+	// ErrNotFound for a namespace not created
+	ErrNotFound = errors.New("namespace: not found")
+	// ErrExists for creating a namespace which exists
+	ErrExists = errors.New("namespace: exists")
+	// ErrInvalidName for a name not matching validName
+	ErrInvalidName = errors.New("namespace: invalid name")
+
+	validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+	// refreshPeriod is how long a Registry uses the namespaces it read
+	refreshPeriod = time.Second
+)
+
+// Namespace for the policies of a namespace
+type Namespace struct {
+	Name string `json:"name"`
+	// MaxKeyBytes limits the size of the keys, no limit if it is 0
+	MaxKeyBytes int `json:"max_key_bytes"`
+	// MaxValueBytes limits the size of the values
+	MaxValueBytes int64 `json:"max_value_bytes"`
+	// CacheBytes is the budget of the cache group of every cache node
+	CacheBytes int64 `json:"cache_bytes"`
+	// ContentAddressed requires every key to be the SHA-256 of its value in
+	// lowercase hex, the databases reject the other writes
+	ContentAddressed bool `json:"content_addressed,omitempty"`
+	// Tokens grant the access to the namespace, which is open to anyone
+	// if there is none
+	Tokens []string `json:"tokens,omitempty"`
+}
+
+// Key returns the stored key of the key of the namespace
+func (ns *Namespace) Key(key string) string {
+	return Prefix(ns.Name) + key
+}
+
+// Authorized reports whether the token grants the access to ns
+func (ns *Namespace) Authorized(token string) bool {
+	if len(ns.Tokens) == 0 {
+		return true
+	}
+
+	for _, t := range ns.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Prefix returns the prefix of the stored keys of the namespace name
+func Prefix(name string) string {
+	return keyPrefix + name + "/"
+}
+
+// Reserved reports whether the stored key belongs to a namespace, such a
+// key can not be used in the default namespace
+func Reserved(key string) bool {
+	return strings.HasPrefix(key, keyPrefix)
+}
+
+// Split returns the namespace name and the key of the stored key, the name
+// is empty for a key of the default namespace
+func Split(stored string) (name, key string) {
+	if !Reserved(stored) {
+		return "", stored
+	}
+	i := strings.IndexByte(stored, '/')
+	if i < 0 {
+		return "", stored
+	}
+	return stored[len(keyPrefix):i], stored[i+1:]
+}
+
+// ReservedStart is the first stored key of the namespaces, the keys of the
+// default namespace are before it
+func ReservedStart() string {
+	return keyPrefix
+}
+
+// Registry reads and creates the namespaces in a meta store
+type Registry struct {
+	kv  meta.KV
+	key string
+
+	mux        sync.Mutex
+	namespaces map[string]*Namespace
+	readAt     time.Time
+}
+
+// NewRegistry returns a new Registry of the namespaces kept in kv
+func NewRegistry(kv meta.KV) *Registry {
+	return &Registry{kv: kv, key: config.Config.NamespacesKey}
+}
+
+// Get returns the namespace name, the namespaces read within the last
+// second are used
+func (r *Registry) Get(name string) (*Namespace, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.namespaces == nil || time.Since(r.readAt) > refreshPeriod {
+		namespaces, err := r.read()
+		if err != nil {
+			return nil, err
+		}
+		r.namespaces, r.readAt = namespaces, time.Now()
+	}
+
+	ns, ok := r.namespaces[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return ns, nil
+}
+
+// All returns all the namespaces in the order of their names
+func (r *Registry) All() ([]*Namespace, error) {
+	namespaces, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+
+	all := make([]*Namespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		all = append(all, ns)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all, nil
+}
+
+// Create creates the namespace ns, the zero limits are set to the ones of
+// the default namespace. The meta store has no transaction, so the
+// namespaces are expected to be created by one admin at a time.
+func (r *Registry) Create(ns *Namespace) error {
+	if !validName.MatchString(ns.Name) {
+		return ErrInvalidName
+	}
+	if ns.MaxValueBytes <= 0 {
+		ns.MaxValueBytes = config.Config.MaxValueBytes
+	}
+	if ns.CacheBytes <= 0 {
+		ns.CacheBytes = config.Config.CacheBytes
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	namespaces, err := r.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := namespaces[ns.Name]; ok {
+		return ErrExists
+	}
+	namespaces[ns.Name] = ns
+
+	b, err := json.Marshal(namespaces)
+	if err != nil {
+		return err
+	}
+	if err := r.kv.Put(r.key, string(b)); err != nil {
+		return err
+	}
+	r.namespaces, r.readAt = namespaces, time.Now()
+	return nil
+}
+
+func (r *Registry) read() (map[string]*Namespace, error) {
+	namespaces := map[string]*Namespace{}
+	val, err := r.kv.Get(r.key)
+	if err == config.ErrDataNotFound {
+		return namespaces, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(val), &namespaces); err != nil {
+		return nil, err
+	}
+	return namespaces, nil
+}
+
+// Default for the namespaces in the default meta store
+var Default = NewRegistry(meta.Default)
@@ -0,0 +1,65 @@
+package namespace
+
+import (
+	"testing"
+
+	"github.com/Focinfi/oncekv/config"
+	"github.com/Focinfi/oncekv/utils/mock"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry(mock.DefaultMeta)
+	r.key = "test.namespaces"
+
+	if _, err := r.Get("team"); err != ErrNotFound {
+		t.Errorf("expect ErrNotFound, got: %v", err)
+	}
+
+	if err := r.Create(&Namespace{Name: "team", Tokens: []string{"t1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Create(&Namespace{Name: "team"}); err != ErrExists {
+		t.Errorf("expect ErrExists, got: %v", err)
+	}
+	for _, name := range []string{"", "Team", "a/b", "-a"} {
+		if err := r.Create(&Namespace{Name: name}); err != ErrInvalidName {
+			t.Errorf("expect ErrInvalidName for %q, got: %v", name, err)
+		}
+	}
+
+	ns, err := r.Get("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns.MaxValueBytes != config.Config.MaxValueBytes || ns.CacheBytes != config.Config.CacheBytes {
+		t.Errorf("failed to set the default limits, got: %v", ns)
+	}
+	if !ns.Authorized("t1") || ns.Authorized("t2") || ns.Authorized("") {
+		t.Errorf("failed to check the tokens")
+	}
+
+	// another registry reads the namespaces created
+	other := NewRegistry(r.kv)
+	other.key = r.key
+	all, err := other.All()
+	if err != nil || len(all) != 1 || all[0].Name != "team" {
+		t.Errorf("failed to read all the namespaces, got: %v, %v", all, err)
+	}
+}
+
+func TestKey(t *testing.T) {
+	ns := &Namespace{Name: "team"}
+	key := ns.Key("foo")
+	if !Reserved(key) || key < ReservedStart() {
+		t.Errorf("expect %q to be reserved", key)
+	}
+	if name, k := Split(key); name != "team" || k != "foo" {
+		t.Errorf("failed to split %q, got: %q, %q", key, name, k)
+	}
+	if name, k := Split("a/b"); name != "" || k != "a/b" {
+		t.Errorf("failed to split a key of the default namespace, got: %q, %q", name, k)
+	}
+	if Reserved("foo") || "\U0010FFFF" >= ReservedStart() {
+		t.Errorf("expect the UTF-8 keys not to be reserved")
+	}
+}
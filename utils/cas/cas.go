@@ -0,0 +1,19 @@
+// Package cas defines the content-addressed keys, a content-addressed key
+// is the SHA-256 of its value in lowercase hex.
+package cas
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Key returns the content-addressed key of the value
+func Key(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify reports whether key is the content-addressed key of the value
+func Verify(key string, value []byte) bool {
+	return key == Key(value)
+}
@@ -0,0 +1,13 @@
+package cas
+
+import "testing"
+
+func TestVerify(t *testing.T) {
+	key := Key([]byte("hello"))
+	if key != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("wrong key: %s", key)
+	}
+	if !Verify(key, []byte("hello")) || Verify(key, []byte("hello!")) || Verify("HELLO", []byte("hello")) {
+		t.Errorf("failed to verify the key")
+	}
+}
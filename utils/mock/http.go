@@ -46,6 +46,19 @@ func (f HTTPPosterFunc) Post(url string, contentType string, body io.Reader) (re
 	return f(url, contentType, body)
 }
 
+// HTTPDoer for mock http.Client.Do
+type HTTPDoer interface {
+	Do(req *http.Request) (resp *http.Response, err error)
+}
+
+// HTTPDoerFunc implements HTTPDoer
+type HTTPDoerFunc func(req *http.Request) (resp *http.Response, err error)
+
+// Do implements HTTPDoer
+func (f HTTPDoerFunc) Do(req *http.Request) (resp *http.Response, err error) {
+	return f(req)
+}
+
 // MakeHTTPGetter makes a HTTPGetter using the given params
 func MakeHTTPGetter(url string, response string, err error, delay time.Duration) HTTPGetter {
 	return HTTPGetterFunc(func(url string) (*http.Response, error) {
@@ -1,48 +1,414 @@
 package mock
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
 	"sync"
+	"time"
 
 	"sort"
+	"strconv"
+	"strings"
 
-	"errors"
-
+	"github.com/Focinfi/oncekv/db/node/store"
 	"github.com/Focinfi/oncekv/log"
 )
 
 // Store mocks the db/node.Store
 type Store struct {
 	sync.RWMutex
-	data   map[string]string
-	leader string
-	peers  []string
+	data     map[string][]byte
+	metas    map[string]*store.Meta
+	index    uint64
+	leader   string
+	follower bool
+	peers    []string
+	purges   []store.Purge
+	shutdown bool
+	replica  bool
+	// clusterOp is set by SetClusterOp
+	clusterOp byte
+	// changesFloor is set by CompactChanges
+	changesFloor uint64
 }
 
 // NewStore returns a new Store
 func NewStore() *Store {
-	return &Store{data: make(map[string]string)}
+	return &Store{
+		data:  make(map[string][]byte),
+		metas: make(map[string]*store.Meta),
+	}
 }
 
 // Open opens a store in a single mode or not
 func (s *Store) Open(singleMode bool) error { return nil }
 
+// OpenReplica opens the store as a replica.
+func (s *Store) OpenReplica() error {
+	s.Lock()
+	defer s.Unlock()
+	s.replica = true
+	return nil
+}
+
+// Role returns the role of the store.
+func (s *Store) Role() string {
+	s.RLock()
+	defer s.RUnlock()
+	if s.replica {
+		return store.RoleReplica
+	}
+	return store.RoleVoter
+}
+
+// Promote turns the replica into a voter.
+func (s *Store) Promote() error {
+	s.Lock()
+	defer s.Unlock()
+	if !s.replica {
+		return store.ErrRole
+	}
+	s.replica = false
+	return nil
+}
+
+// Demote turns the voter into a replica.
+func (s *Store) Demote() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.replica {
+		return store.ErrRole
+	}
+	s.replica = true
+	return nil
+}
+
+// ReplicatedChanges returns the adds from the index from, with the values
+// as their entries, the mock keeps no encoded entries.
+func (s *Store) ReplicatedChanges(from uint64, limit int) ([]store.ReplicatedChange, uint64, error) {
+	changes, next, err := s.Changes(from, limit)
+	replicated := make([]store.ReplicatedChange, len(changes))
+	for i, c := range changes {
+		replicated[i] = store.ReplicatedChange{Index: c.Index, Op: c.Op, Key: c.Key, Entry: c.Value}
+	}
+	return replicated, next, err
+}
+
+// ApplyReplicated applies the changes on a replica, the entries of the adds
+// being their values.
+func (s *Store) ApplyReplicated(changes []store.ReplicatedChange, next uint64, leader string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.replica {
+		return store.ErrRole
+	}
+	s.leader = leader
+	for _, c := range changes {
+		if c.Index <= s.index {
+			continue
+		}
+		switch c.Op {
+		case store.ChangeAdd:
+			s.data[c.Key] = c.Entry
+			s.metas[c.Key] = &store.Meta{Index: c.Index, Term: 1, Timestamp: time.Now()}
+		case store.ChangeDelete:
+			delete(s.data, c.Key)
+			delete(s.metas, c.Key)
+		}
+	}
+	if next > s.index+1 {
+		s.index = next - 1
+	}
+	return nil
+}
+
+// AppliedIndex returns the index of the last write.
+func (s *Store) AppliedIndex() uint64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.index
+}
+
+// mockSnapshot is the snapshot of a mock Store.
+type mockSnapshot struct {
+	Index uint64
+	Data  map[string][]byte
+}
+
+// WriteSnapshot writes the values and the applied index in JSON into w.
+func (s *Store) WriteSnapshot(w io.Writer) error {
+	s.RLock()
+	defer s.RUnlock()
+	return json.NewEncoder(w).Encode(mockSnapshot{Index: s.index, Data: s.data})
+}
+
+// ResyncReplica replaces the values of a replica with the snapshot read
+// from r.
+func (s *Store) ResyncReplica(r io.Reader, leader string) error {
+	snap := mockSnapshot{}
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if !s.replica {
+		return store.ErrRole
+	}
+	if snap.Data == nil {
+		snap.Data = map[string][]byte{}
+	}
+	s.leader, s.index, s.data = leader, snap.Index, snap.Data
+	s.metas = map[string]*store.Meta{}
+	for key := range snap.Data {
+		s.metas[key] = &store.Meta{Index: snap.Index, Term: 1, Timestamp: time.Now()}
+	}
+	return nil
+}
+
 // Get returns the value for the given key.
-func (s *Store) Get(key string) (string, error) {
+func (s *Store) Get(key string) ([]byte, error) {
 	s.RLock()
 	defer s.RUnlock()
 	return s.data[key], nil
 }
 
+// VerifyRead returns store.ErrNotLeader for the reads needing the leader if
+// the Store is set as a follower.
+func (s *Store) VerifyRead(c store.Consistency) error {
+	if s.follower && c != store.ConsistencyStale {
+		return store.ErrNotLeader
+	}
+	return nil
+}
+
+// WaitApplied returns nil, the mock Store applies every write at once.
+func (s *Store) WaitApplied(index uint64, timeout time.Duration) error { return nil }
+
+// WaitKey polls the key until it is added or ctx is done.
+func (s *Store) WaitKey(ctx context.Context, key string) ([]byte, *store.Meta, error) {
+	for {
+		if value, meta, _ := s.GetWithMeta(key); meta != nil {
+			return value, meta, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, nil
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// GetWithMeta returns the value and the metadata for the given key.
+func (s *Store) GetWithMeta(key string) ([]byte, *store.Meta, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.data[key], s.metas[key], nil
+}
+
+// List returns the keys selected by opts in order.
+func (s *Store) List(opts store.ListOptions) ([]string, bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	keys := []string{}
+	for key := range s.data {
+		if strings.HasPrefix(key, opts.Prefix) && key > opts.After && (opts.End == "" || key < opts.End) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	if len(keys) > opts.Limit {
+		return keys[:opts.Limit], true, nil
+	}
+	return keys, false, nil
+}
+
+// Changes returns the adds of the keys from the index from.
+func (s *Store) Changes(from uint64, limit int) ([]store.Change, uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if from <= s.changesFloor {
+		if from > 0 {
+			return nil, 0, store.ErrChangesCompacted
+		}
+		from = s.changesFloor + 1
+	}
+
+	changes := []store.Change{}
+	for key, meta := range s.metas {
+		if meta.Index >= from {
+			changes = append(changes, store.Change{Index: meta.Index, Op: store.ChangeAdd, Key: key, Value: s.data[key], Meta: meta})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Index != changes[j].Index {
+			return changes[i].Index < changes[j].Index
+		}
+		return changes[i].Key < changes[j].Key
+	})
+
+	next := s.index + 1
+	if from > next {
+		next = from
+	}
+	return changes, next, nil
+}
+
+// CompactChanges drops the changes up to the index.
+func (s *Store) CompactChanges(index uint64) {
+	s.Lock()
+	defer s.Unlock()
+	s.changesFloor = index
+}
+
 // Add adds key/value, via distributed consensus.
-func (s *Store) Add(key, value string) error {
+func (s *Store) Add(key string, value []byte, opts store.WriteOptions) (store.AddResult, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.index++
+	res := s.check(key, value, opts.RequestID)
+	res.Index = s.index
+	if _, ok := s.data[key]; !ok {
+		s.put(key, value, opts)
+	}
+	log.DB.Infoln("mock Store:", s.data)
+	return res, nil
+}
+
+// AddBatch adds the pairs in one step
+func (s *Store) AddBatch(pairs []store.Pair, atomic bool, opts store.WriteOptions) ([]store.AddResult, error) {
 	s.Lock()
 	defer s.Unlock()
-	if _, ok := s.data[key]; ok {
-		return errors.New("duplicate")
+
+	s.index++
+	results := make([]store.AddResult, len(pairs))
+	var aborted bool
+	for i, pair := range pairs {
+		results[i] = s.check(pair.Key, pair.Value, opts.RequestID)
+		results[i].Index = s.index
+		aborted = aborted || results[i].Result != store.Created
 	}
 
+	if atomic && aborted {
+		for i := range results {
+			if results[i].Result == store.Created {
+				results[i].Result = store.Aborted
+			}
+		}
+		return results, nil
+	}
+
+	for _, pair := range pairs {
+		if _, ok := s.data[pair.Key]; !ok {
+			s.put(pair.Key, pair.Value, opts)
+		}
+	}
+	return results, nil
+}
+
+func (s *Store) put(key string, value []byte, opts store.WriteOptions) {
 	s.data[key] = value
-	log.DB.Infoln("mock Store:", s.data)
+	s.metas[key] = &store.Meta{
+		Index:       s.index,
+		Term:        1,
+		Timestamp:   time.Now(),
+		Writer:      opts.Writer,
+		RequestID:   opts.RequestID,
+		ContentType: opts.ContentType,
+	}
+	if opts.TTL > 0 {
+		s.metas[key].ExpiresAt = s.metas[key].Timestamp.Add(opts.TTL)
+	}
+}
+
+func (s *Store) check(key string, value []byte, requestID string) store.AddResult {
+	old, ok := s.data[key]
+	if !ok {
+		return store.AddResult{Result: store.Created, RequestID: requestID}
+	}
+
+	res := store.AddResult{RequestID: s.metas[key].RequestID}
+	switch {
+	case !bytes.Equal(old, value):
+		res.Result = store.Conflict
+	case requestID != "" && requestID == res.RequestID:
+		res.Result = store.Created
+	default:
+		res.Result = store.Exists
+	}
+	return res
+}
+
+// Purge deletes the key and records the purge.
+func (s *Store) Purge(key, operator, reason string) (*store.Purge, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.index++
+	_, found := s.data[key]
+	delete(s.data, key)
+	delete(s.metas, key)
+
+	p := store.Purge{Key: key, Operator: operator, Reason: reason, Timestamp: time.Now(), Index: s.index, Found: found}
+	s.purges = append(s.purges, p)
+	return &p, nil
+}
+
+// Purges returns the purges recorded.
+func (s *Store) Purges() ([]store.Purge, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return append([]store.Purge{}, s.purges...), nil
+}
+
+// Checksums returns the checksums of the keys in the range (after, last].
+func (s *Store) Checksums(after, last string, limit int) ([]store.KeyChecksum, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		if key > after && (last == "" || key <= last) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	sums := make([]store.KeyChecksum, len(keys))
+	for i, key := range keys {
+		sums[i] = store.KeyChecksum{Key: key, Checksum: store.Checksum(s.data[key]), Index: s.metas[key].Index}
+	}
+	return sums, nil
+}
+
+// Entry returns the value of the key as its entry, the mock keeps no
+// encoded entries.
+func (s *Store) Entry(key string) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.data[key], nil
+}
+
+// Repair replaces the value of an existing key with b.
+func (s *Store) Repair(key string, b []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.data[key]; !ok {
+		return store.ErrKeyNotFound
+	}
+	s.data[key] = append([]byte{}, b...)
 	return nil
 }
 
@@ -62,6 +428,23 @@ func (s *Store) Join(addr string) error {
 	return nil
 }
 
+// RemovePeer removes the node at addr from the cluster.
+func (s *Store) RemovePeer(addr string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.follower {
+		return store.ErrNotLeader
+	}
+	for i, peer := range s.peers {
+		if peer == addr {
+			s.peers = append(s.peers[:i:i], s.peers[i+1:]...)
+			return nil
+		}
+	}
+	return store.ErrPeerNotFound
+}
+
 // Peers returns the store peers
 func (s *Store) Peers() ([]string, error) {
 	s.RLock()
@@ -71,12 +454,70 @@ func (s *Store) Peers() ([]string, error) {
 }
 
 // Leader returns the leader address
-func (s *Store) Leader() string { return s.leader }
+func (s *Store) Leader() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.leader
+}
 
-// Stats return the stats as a map[string]string
-func (s *Store) Stats() map[string]string { return map[string]string{} }
+// Stats return the stats as a map[string]string, with the role and the
+// ops
+func (s *Store) Stats() map[string]string {
+	return map[string]string{
+		"role":       s.Role(),
+		"max_op":     strconv.Itoa(int(store.MaxOp)),
+		"cluster_op": strconv.Itoa(int(s.ClusterOp())),
+	}
+}
+
+// SetClusterOp sets the highest op every voter applies.
+func (s *Store) SetClusterOp(op byte) {
+	s.Lock()
+	defer s.Unlock()
+	s.clusterOp = op
+}
+
+// ClusterOp returns the op set by SetClusterOp.
+func (s *Store) ClusterOp() byte {
+	s.RLock()
+	defer s.RUnlock()
+	return s.clusterOp
+}
+
+// Drain returns the last index of a leader, the mock takes writes after.
+func (s *Store) Drain() (uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.follower {
+		return 0, nil
+	}
+	return s.index, nil
+}
+
+// Shutdown records the store shut down.
+func (s *Store) Shutdown() error {
+	s.Lock()
+	defer s.Unlock()
+	s.shutdown = true
+	return nil
+}
+
+// IsShutdown reports whether the store has been shut down
+func (s *Store) IsShutdown() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.shutdown
+}
 
 // SetLeader set the leader for testing
 func (s *Store) SetLeader(leader string) {
+	s.Lock()
+	defer s.Unlock()
 	s.leader = leader
 }
+
+// SetFollower sets the Store as a follower for testing
+func (s *Store) SetFollower(follower bool) {
+	s.follower = follower
+}
@@ -0,0 +1,145 @@
+// Package object describes the large objects stored as chunks. Every chunk
+// is an ordinary key named after the SHA-256 of its content, and the key of
+// the object holds the manifest listing the chunks. The manifest is put
+// after all the chunks, so the object appears at once.
+package object
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Focinfi/oncekv/utils/cas"
+)
+
+const (
+	// ManifestContentType is the content type of a manifest key
+	ManifestContentType = "application/vnd.oncekv.manifest+json"
+
+	// chunkKeyPrefix is the prefix of the chunk keys
+	chunkKeyPrefix = "_chunk."
+)
+
+var (
+	// ErrBadManifest for a manifest failing to describe its chunks
+	ErrBadManifest = errors.New("object: bad manifest")
+	// ErrChunkMismatch for a chunk not matching its hash or size
+	ErrChunkMismatch = errors.New("object: chunk mismatch")
+)
+
+// Manifest lists the chunks of an object in order, every chunk but the
+// last one has ChunkSize bytes
+type Manifest struct {
+	Size        int64    `json:"size"`
+	ChunkSize   int64    `json:"chunk_size"`
+	ContentType string   `json:"content_type,omitempty"`
+	Chunks      []string `json:"chunks"`
+}
+
+// ChunkKey returns the key of the chunk with the hash
+func ChunkKey(hash string) string {
+	return chunkKeyPrefix + hash
+}
+
+// IsChunkKey reports whether key is the key of a chunk
+func IsChunkKey(key string) bool {
+	return strings.HasPrefix(key, chunkKeyPrefix)
+}
+
+// Hash returns the hash naming the chunk b, its content-addressed key
+func Hash(b []byte) string {
+	return cas.Key(b)
+}
+
+// DecodeManifest decodes and checks the manifest b
+func DecodeManifest(b []byte) (*Manifest, error) {
+	m := &Manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, ErrBadManifest
+	}
+
+	n := int64(len(m.Chunks))
+	if m.Size < 0 || m.ChunkSize <= 0 || m.Size > n*m.ChunkSize || (n > 0 && m.Size <= (n-1)*m.ChunkSize) {
+		return nil, ErrBadManifest
+	}
+	return m, nil
+}
+
+// chunkLen returns the size of the chunk i
+func (m *Manifest) chunkLen(i int) int64 {
+	if i == len(m.Chunks)-1 {
+		return m.Size - int64(i)*m.ChunkSize
+	}
+	return m.ChunkSize
+}
+
+// Verify checks that b is the chunk i
+func (m *Manifest) Verify(i int, b []byte) error {
+	if int64(len(b)) != m.chunkLen(i) || Hash(b) != m.Chunks[i] {
+		return ErrChunkMismatch
+	}
+	return nil
+}
+
+// FetchFunc returns the value of the key
+type FetchFunc func(key string) ([]byte, error)
+
+// Reader reads an object, fetching its chunks when it reaches them, it
+// keeps the chunk being read only
+type Reader struct {
+	m      *Manifest
+	fetch  FetchFunc
+	offset int64
+
+	index int // index of chunk, -1 if none
+	chunk []byte
+}
+
+// NewReader returns a Reader of the object of m
+func NewReader(m *Manifest, fetch FetchFunc) *Reader {
+	return &Reader{m: m, fetch: fetch, index: -1}
+}
+
+// Read implements io.Reader
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.m.Size {
+		return 0, io.EOF
+	}
+
+	i := int(r.offset / r.m.ChunkSize)
+	if i != r.index {
+		b, err := r.fetch(ChunkKey(r.m.Chunks[i]))
+		if err != nil {
+			return 0, err
+		}
+		if err := r.m.Verify(i, b); err != nil {
+			return 0, err
+		}
+		r.index, r.chunk = i, b
+	}
+
+	n := copy(p, r.chunk[r.offset-int64(i)*r.m.ChunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// Seek implements io.Seeker
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.m.Size
+	default:
+		return 0, fmt.Errorf("object: invalid whence: %d", whence)
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("object: negative offset: %d", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
@@ -0,0 +1,96 @@
+package object
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func testObject(t *testing.T, data []byte, chunkSize int64) (*Manifest, FetchFunc) {
+	m := &Manifest{Size: int64(len(data)), ChunkSize: chunkSize}
+	chunks := map[string][]byte{}
+	for i := int64(0); i < m.Size; i += chunkSize {
+		end := i + chunkSize
+		if end > m.Size {
+			end = m.Size
+		}
+		hash := Hash(data[i:end])
+		m.Chunks = append(m.Chunks, hash)
+		chunks[ChunkKey(hash)] = data[i:end]
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err = DecodeManifest(b); err != nil {
+		t.Fatal(err)
+	}
+
+	return m, func(key string) ([]byte, error) {
+		if b, ok := chunks[key]; ok {
+			return b, nil
+		}
+		return nil, fmt.Errorf("no chunk: %s", key)
+	}
+}
+
+func TestReader(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	m, fetch := testObject(t, data, 7)
+
+	b, err := ioutil.ReadAll(NewReader(m, fetch))
+	if err != nil || string(b) != string(data) {
+		t.Errorf("failed to read the object, got: %s, %v", b, err)
+	}
+
+	r := NewReader(m, fetch)
+	for _, c := range []struct {
+		offset int64
+		whence int
+		expect string
+	}{
+		{5, io.SeekStart, "56789"},
+		{-3, io.SeekEnd, "hij"},
+		{-10, io.SeekCurrent, "abcde"},
+	} {
+		if _, err := r.Seek(c.offset, c.whence); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(c.expect))
+		if _, err := io.ReadFull(r, b); err != nil || string(b) != c.expect {
+			t.Errorf("seek %d from %d, expect: %s, got: %s, %v", c.offset, c.whence, c.expect, b, err)
+		}
+	}
+
+	// a chunk not matching its hash is rejected
+	r = NewReader(m, func(key string) ([]byte, error) { return []byte("0123456"), nil })
+	r.Seek(7, io.SeekStart)
+	if _, err := r.Read(make([]byte, 1)); err != ErrChunkMismatch {
+		t.Errorf("expect ErrChunkMismatch, got: %v", err)
+	}
+}
+
+func TestDecodeManifest(t *testing.T) {
+	for _, b := range []string{
+		`{"size":0,"chunk_size":4,"chunks":[]}`,
+		`{"size":5,"chunk_size":4,"chunks":["a","b"]}`,
+	} {
+		if _, err := DecodeManifest([]byte(b)); err != nil {
+			t.Errorf("failed to decode %s: %v", b, err)
+		}
+	}
+
+	for _, b := range []string{
+		`{`,
+		`{"size":5,"chunk_size":0,"chunks":["a","b"]}`,
+		`{"size":9,"chunk_size":4,"chunks":["a","b"]}`,
+		`{"size":4,"chunk_size":4,"chunks":["a","b"]}`,
+	} {
+		if _, err := DecodeManifest([]byte(b)); err != ErrBadManifest {
+			t.Errorf("expect ErrBadManifest for %s, got: %v", b, err)
+		}
+	}
+}